@@ -0,0 +1,311 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/files"
+	"github.com/scop/wrun/internal/hashes"
+)
+
+const (
+	// cacheEntryCompleteMarker is the name of the file written last to cache entries that are completely set up.
+	// It contains the name of the downloaded file or extracted archive directory in the entry.
+	cacheEntryCompleteMarker = ".wrun-complete"
+	cacheStagingPattern      = ".wrun-staging-*"
+	cacheEntryArchive        = ".wrun-archive" // downloaded archive kept in entries with digests, for export
+	metadataSuffix           = "-metadata.json"
+	metadataURLKey           = "URL" // URL the entry was downloaded from
+
+	// Cache subdirectories
+	cacheURLDir     = "url"     // entries keyed by URL, links to cacheCASDir for ones with digests
+	cacheCASDir     = "cas"     // content addressed entries keyed by digest
+	cacheObjectsDir = "objects" // deduplicated files keyed by digest, hardlinked to from entries
+	cacheBinDir     = "bin"     // shellenv dirs of symlinks to executables named after their tools
+)
+
+func cacheCommand(w *Wrun) *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "manage the wrun cache",
+		Args:  cobra.NoArgs,
+	}
+	cacheCmd.AddCommand(
+		cacheExportCommand(w),
+		cacheImportCommand(w),
+		cacheMigrateCommand(w),
+	)
+
+	return cacheCmd
+}
+
+// digestKey gets the content addressed key for a digest.
+func digestKey(h crypto.Hash, digest []byte) string {
+	return hashes.HashName(h) + "-" + hex.EncodeToString(digest)
+}
+
+// extractKey gets the cache key suffix for entries with only paths extracted from archives,
+// empty for full extraction.
+// Entries for different selections of paths have different keys, so that they do not replace each other.
+func extractKey(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	cleaned := make([]string, 0, len(paths))
+	for _, p := range paths {
+		cleaned = append(cleaned, path.Clean(p))
+	}
+	slices.Sort(cleaned)
+	cleaned = slices.Compact(cleaned)
+	sum := sha256.Sum256([]byte(strings.Join(cleaned, "\x00")))
+
+	return "-x" + hex.EncodeToString(sum[:8])
+}
+
+// completeCASEntry gets a completely set up content addressed entry for key, and the name of the content in it.
+// Fully extracted entries are preferred over ones with only some paths extracted.
+func completeCASEntry(cacheDir, key string) (entryDir, content string, ok bool) {
+	casDir := filepath.Join(cacheDir, cacheCASDir)
+	entryDir = filepath.Join(casDir, key)
+	if content, ok = cacheEntryContent(entryDir); ok {
+		return entryDir, content, true
+	}
+	partial, _ := filepath.Glob(filepath.Join(casDir, key+"-x*"))
+	for _, entryDir = range partial {
+		if content, ok = cacheEntryContent(entryDir); ok {
+			return entryDir, content, true
+		}
+	}
+
+	return "", "", false
+}
+
+// trimExtractKey removes the extractKey suffix from a content addressed entry name.
+func trimExtractKey(name string) string {
+	if algo, rest, found := strings.Cut(name, "-"); found {
+		digest, _, _ := strings.Cut(rest, "-")
+
+		return algo + "-" + digest
+	}
+
+	return name
+}
+
+// cacheEntryContent gets the name of the content in the cache entry in dir.
+// ok is false if the entry has not been completely set up.
+func cacheEntryContent(dir string) (name string, ok bool) {
+	data, err := os.ReadFile(filepath.Join(dir, cacheEntryCompleteMarker))
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(data)), true
+}
+
+// cacheEntryComplete tells whether the cache entry in dir has been completely set up.
+func cacheEntryComplete(dir string) bool {
+	_, ok := cacheEntryContent(dir)
+
+	return ok
+}
+
+// touchCacheEntry records use of the cache entry in dir by updating its complete marker's modification time.
+// Failures are not fatal, the time is used only for selecting recently used entries.
+func touchCacheEntry(w *Wrun, dir string) {
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(dir, cacheEntryCompleteMarker), now, now); err != nil {
+		w.LogInfo("touch cache entry: %v", err)
+	}
+}
+
+// entryExePath gets the path to the executable in a cache entry.
+// content is the name of the downloaded file or extracted archive dir in the entry,
+// and archiveExePath the /-separated path to the executable within it, if any.
+func entryExePath(entryDir, content, archiveExePath string) string {
+	// Here's hoping we don't hit path too long errors with this implementation anywhere
+	ps := make([]string, 0, strings.Count(archiveExePath, "/")+3)
+	ps = append(ps, entryDir, content)
+	ps = append(ps, strings.Split(archiveExePath, "/")...)
+
+	return filepath.Join(ps...)
+}
+
+// newCacheStaging creates a staging directory for setting up a cache entry to be installed to entryDir.
+// The staging directory is created next to entryDir, so that it can be atomically renamed to it.
+func newCacheStaging(entryDir string) (string, error) {
+	parent := filepath.Dir(entryDir)
+	if err := os.MkdirAll(parent, 0o777); err != nil {
+		return "", err
+	}
+
+	return os.MkdirTemp(parent, cacheStagingPattern)
+}
+
+// installCacheEntry marks the cache entry in staging complete, and renames it to entryDir.
+// content is the name of the downloaded file or extracted archive dir in staging.
+// An existing entry at entryDir is replaced. It is moved aside and removed only after the new one is in place,
+// so that concurrent readers do not find it missing for longer than between the two renames.
+// If another process installs the entry concurrently, its result is kept, and staging is removed.
+func installCacheEntry(w *Wrun, staging, entryDir, content string) error {
+	if err := os.WriteFile(filepath.Join(staging, cacheEntryCompleteMarker), []byte(content), 0o666); err != nil {
+		return fmt.Errorf("write complete marker: %w", err)
+	}
+	if _, err := os.Lstat(entryDir); err == nil {
+		aside, err := os.MkdirTemp(filepath.Dir(entryDir), cacheStagingPattern)
+		if err != nil {
+			return fmt.Errorf("move old entry aside: %w", err)
+		}
+		defer func() {
+			if err := os.RemoveAll(aside); err != nil {
+				w.LogWarn("remove old entry: %v", err)
+			}
+		}()
+		if err = os.Rename(entryDir, filepath.Join(aside, filepath.Base(entryDir))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("move old entry aside: %w", err)
+		}
+	}
+	if err := os.Rename(staging, entryDir); err != nil {
+		if !cacheEntryComplete(entryDir) {
+			return fmt.Errorf("rename staging dir: %w", err)
+		}
+		w.LogInfo("cache entry installed concurrently: %s", entryDir)
+		if rmErr := os.RemoveAll(staging); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			w.LogWarn("remove staging dir: %v", rmErr)
+		}
+	}
+
+	return nil
+}
+
+// linkURLEntry makes the URL keyed entry urlEntry a relative symlink to the content addressed entryDir.
+// Failures are not fatal, as URL keyed entries for content addressed ones are not required for cache lookups.
+func linkURLEntry(w *Wrun, urlEntry, entryDir string) {
+	target, err := filepath.Rel(filepath.Dir(urlEntry), entryDir)
+	if err != nil {
+		w.LogInfo("link URL entry: %v", err)
+
+		return
+	}
+	if current, err := os.Readlink(urlEntry); err == nil && current == target {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(urlEntry), 0o777); err != nil {
+		w.LogInfo("link URL entry: %v", err)
+
+		return
+	}
+	tmp := urlEntry + ".wrun-link-" + strconv.Itoa(os.Getpid())
+	if err = os.Symlink(target, tmp); err != nil {
+		w.LogInfo("link URL entry: %v", err)
+
+		return
+	}
+	if err = os.Rename(tmp, urlEntry); err != nil {
+		// Rename does not replace directories, such as URL keyed entries set up before the content addressed one
+		if err = os.RemoveAll(urlEntry); err == nil {
+			err = os.Rename(tmp, urlEntry)
+		}
+	}
+	if err != nil {
+		w.LogInfo("link URL entry: %v", err)
+		if rmErr := os.Remove(tmp); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			w.LogWarn("remove temporary link: %v", rmErr)
+		}
+	}
+}
+
+// dedupFiles replaces regular files under root with hardlinks to identical ones in objectsDir,
+// and adds ones not yet there to it.
+// Failures are not fatal, files are left as is in such cases.
+func dedupFiles(w *Wrun, objectsDir, root string) {
+	if err := os.MkdirAll(objectsDir, 0o777); err != nil {
+		w.LogInfo("dedup: %v", err)
+
+		return
+	}
+	err := filepath.WalkDir(root, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := objectKey(pth, fi)
+		if err != nil {
+			return err
+		}
+		obj := filepath.Join(objectsDir, key)
+		if ofi, err := os.Stat(obj); err == nil {
+			if os.SameFile(fi, ofi) || ofi.Size() != fi.Size() {
+				return nil
+			}
+			tmp := pth + ".wrun-dedup"
+			if err = os.Link(obj, tmp); err != nil {
+				w.LogInfo("dedup %s: %v", pth, err)
+
+				return nil
+			}
+			if err = os.Rename(tmp, pth); err != nil {
+				_ = os.Remove(tmp)
+
+				return err
+			}
+			w.LogInfo("dedup %s: linked to %s", pth, obj)
+		} else if err = os.Link(pth, obj); err != nil && !errors.Is(err, os.ErrExist) {
+			w.LogInfo("dedup %s: %v", pth, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		w.LogWarn("dedup: %v", err)
+	}
+}
+
+// objectKey gets the dedup object key for the file at pth.
+// Executable files are kept separate from others, because hardlinks share permissions.
+func objectKey(pth string, fi fs.FileInfo) (string, error) {
+	digest, err := fileDigest(pth, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	key := digestKey(crypto.SHA256, digest)
+	if files.HasExecutablePerms(fi) {
+		key += "-x"
+	}
+
+	return key, nil
+}
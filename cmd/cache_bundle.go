@@ -0,0 +1,593 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/files"
+	"github.com/scop/wrun/internal/hashes"
+)
+
+const (
+	cacheBundleVersion      = 1
+	cacheBundleManifestName = "manifest.json"
+	cacheBundleFilesDir     = "files"
+)
+
+// cacheBundleManifest describes the downloads in a cache bundle.
+type cacheBundleManifest struct {
+	Version int                `json:"version"`
+	Entries []cacheBundleEntry `json:"entries"`
+}
+
+type cacheBundleEntry struct {
+	URL     string `json:"url"`
+	Digest  string `json:"digest"`  // hashAlgo-hexDigest
+	File    string `json:"file"`    // /-separated path to download in bundle
+	Archive bool   `json:"archive"` // whether the download is an archive to extract
+}
+
+// cacheBundleSource is a download to include in a cache bundle.
+type cacheBundleSource struct {
+	url    *url.URL
+	h      crypto.Hash
+	digest []byte
+}
+
+// argsFileSources gets the URLs with digests from args files, for all OS/archs.
+// URLs without digests are skipped, as they cannot be verified on import.
+func argsFileSources(w *Wrun, argsFiles []string) ([]cacheBundleSource, error) {
+	var sources []cacheBundleSource
+	for _, argsFile := range argsFiles {
+		cfg, err := parseArgsFile(w, argsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range cfg.urlMatches {
+			h, digest, err := hashes.ParseHashFragment(m.url.Fragment)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", argsFile, m.url, err)
+			}
+			if h == 0 {
+				w.LogWarn("%s: no digest, skipping: %s", argsFile, m.url)
+
+				continue
+			}
+			if isLocalURL(m.url) || m.url.Scheme == ociScheme {
+				w.LogInfo("%s: not an HTTP URL, skipping: %s", argsFile, m.url)
+
+				continue
+			}
+			sources = append(sources, cacheBundleSource{m.url, h, digest})
+		}
+	}
+
+	return sources, nil
+}
+
+// recentlyUsedSources gets the content addressed cache entries used since the given time.
+// Entries with no recorded URL are skipped.
+func recentlyUsedSources(w *Wrun, cacheDir string, since time.Time) ([]cacheBundleSource, error) {
+	casDir := filepath.Join(cacheDir, cacheCASDir)
+	des, err := os.ReadDir(casDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	var sources []cacheBundleSource
+	for _, de := range des {
+		entryDir := filepath.Join(casDir, de.Name())
+		fi, err := os.Stat(filepath.Join(entryDir, cacheEntryCompleteMarker))
+		if err != nil || fi.ModTime().Before(since) {
+			continue
+		}
+		h, digest, err := hashes.ParseHashFragment(trimExtractKey(de.Name()))
+		if err != nil || h == 0 {
+			continue
+		}
+		content, _ := cacheEntryContent(entryDir)
+		ur, err := entryURL(entryDir, content)
+		if err != nil {
+			w.LogWarn("no URL for cache entry, skipping: %s: %v", entryDir, err)
+
+			continue
+		}
+		sources = append(sources, cacheBundleSource{ur, h, digest})
+	}
+
+	return sources, nil
+}
+
+// entryURL gets the URL a cache entry was downloaded from, from its metadata.
+func entryURL(entryDir, content string) (*url.URL, error) {
+	data, err := os.ReadFile(filepath.Join(entryDir, content+metadataSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var meta map[string]string
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	if meta[metadataURLKey] == "" {
+		return nil, errors.New("no URL in metadata")
+	}
+
+	return url.Parse(meta[metadataURLKey])
+}
+
+// exportCache writes a bundle of the cache entries for sources to out.
+// Downloads, including archives kept in their entries, are taken from the cache after verifying their digests.
+// Archives not kept, such as ones in entries set up by older versions,
+// are downloaded again and verified, through the remote cache and proxy in base if set.
+// Sources not in the cache are skipped, and returned.
+func exportCache(w *Wrun, base cacheEntrySpec, sources []cacheBundleSource, out io.Writer) (cacheBundleManifest, []cacheBundleSource, error) {
+	manifest := cacheBundleManifest{Version: cacheBundleVersion}
+	var skipped []cacheBundleSource
+	tmpDir, err := os.MkdirTemp("", "wrun-export-*")
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(tmpDir); rmErr != nil {
+			w.LogWarn("remove temporary dir: %v", rmErr)
+		}
+	}()
+
+	seen := make(map[string]bool)
+	var paths []string
+	for _, src := range sources {
+		key := digestKey(src.h, src.digest)
+		if seen[key] {
+			continue
+		}
+		entryDir, content, ok := completeCASEntry(base.cacheDir, key)
+		if !ok {
+			w.LogWarn("not in cache, skipping: %s", src.url)
+			skipped = append(skipped, src)
+
+			continue
+		}
+		seen[key] = true
+		pth := filepath.Join(entryDir, content)
+		fi, err := os.Lstat(pth)
+		if err != nil {
+			return manifest, skipped, err
+		}
+		archive := fi.IsDir()
+		if archive {
+			pth = filepath.Join(entryDir, cacheEntryArchive)
+			if got, err := fileDigest(pth, src.h); err != nil || !bytes.Equal(got, src.digest) {
+				if err == nil {
+					w.LogWarn("kept archive digest mismatch: %s", entryDir)
+				} else if !errors.Is(err, os.ErrNotExist) {
+					w.LogWarn("kept archive: %v", err)
+				}
+				if pth, err = downloadForExport(w, base, src, tmpDir); err != nil {
+					return manifest, skipped, err
+				}
+			}
+		} else if got, err := fileDigest(pth, src.h); err != nil {
+			return manifest, skipped, err
+		} else if !bytes.Equal(got, src.digest) {
+			return manifest, skipped, fmt.Errorf("cache entry digest mismatch: %s", entryDir)
+		}
+		_, dlBase := path.Split(src.url.Path)
+		manifest.Entries = append(manifest.Entries, cacheBundleEntry{
+			URL:     src.url.String(),
+			Digest:  key,
+			File:    path.Join(cacheBundleFilesDir, key, dlBase),
+			Archive: archive,
+		})
+		paths = append(paths, pth)
+	}
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, skipped, err
+	}
+	if err = writeTarFile(tw, cacheBundleManifestName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return manifest, skipped, err
+	}
+	for i, e := range manifest.Entries {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			return manifest, skipped, err
+		}
+		fi, err := f.Stat()
+		if err == nil {
+			err = writeTarFile(tw, e.File, f, fi.Size())
+		}
+		f.Close()
+		if err != nil {
+			return manifest, skipped, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return manifest, skipped, err
+	}
+
+	return manifest, skipped, gw.Close()
+}
+
+// downloadForExport downloads src to dir, verifying it against its digest, and returns the path to it.
+// The remote cache and proxy in base are used like for downloads to the cache.
+func downloadForExport(w *Wrun, base cacheEntrySpec, src cacheBundleSource, dir string) (string, error) {
+	f, err := os.CreateTemp(dir, "export-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if base.remoteCache != "" && !isLocalURL(src.url) && src.url.Scheme != ociScheme {
+		if err = remoteCacheGet(w, base.remoteCache, src.h, src.digest, f); err == nil {
+			return f.Name(), f.Close()
+		} else if errors.Is(err, errRemoteCacheMiss) {
+			w.LogInfo("remote cache: %v", err)
+		} else {
+			w.LogWarn("remote cache: %v", err)
+		}
+	}
+	spec := base
+	spec.url, spec.h, spec.digest = src.url, src.h, src.digest
+	dlFile, _, err := fetchSource(w, spec, src.url, f, dir, make(map[string]string))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", src.url.Redacted(), err)
+	}
+	if dlFile != "" {
+		return dlFile, nil
+	}
+
+	return f.Name(), f.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+
+	return err
+}
+
+// importCache verifies the downloads in the bundle read from r against their digests,
+// and installs them to the cache in cacheDir.
+// Nothing is installed if any download fails verification.
+// It returns the number of installed entries and ones that were in the cache already.
+func importCache(w *Wrun, cacheDir string, r io.Reader, limits archives.Limits) (installed, present int, err error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	tr := tar.NewReader(gr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, 0, fmt.Errorf("read manifest: %w", err)
+	}
+	if hdr.Name != cacheBundleManifestName {
+		return 0, 0, fmt.Errorf("expected %s as first bundle entry, got %q", cacheBundleManifestName, hdr.Name)
+	}
+	var manifest cacheBundleManifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, 0, fmt.Errorf("decode manifest: %w", err)
+	}
+	if manifest.Version != cacheBundleVersion {
+		return 0, 0, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+	entries := make(map[string]cacheBundleEntry, len(manifest.Entries))
+	for _, e := range manifest.Entries {
+		entries[e.File] = e
+	}
+
+	if err = os.MkdirAll(cacheDir, 0o777); err != nil {
+		return 0, 0, err
+	}
+	importDir, err := os.MkdirTemp(cacheDir, cacheStagingPattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(importDir); rmErr != nil {
+			w.LogWarn("remove staging dir: %v", rmErr)
+		}
+	}()
+
+	// Verify all first
+
+	verified := make(map[string]string, len(entries))
+	for {
+		hdr, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("read bundle: %w", err)
+		}
+		e, found := entries[hdr.Name]
+		if !found || hdr.Typeflag != tar.TypeReg {
+			return 0, 0, fmt.Errorf("unexpected bundle entry: %q", hdr.Name)
+		}
+		if _, found = verified[e.File]; found {
+			return 0, 0, fmt.Errorf("duplicate bundle entry: %q", hdr.Name)
+		}
+		h, digest, err := hashes.ParseHashFragment(e.Digest)
+		if err != nil || h == 0 {
+			return 0, 0, fmt.Errorf("%s: invalid digest %q: %w", e.File, e.Digest, err)
+		}
+		tmpf, _, err := w.SetUpTempfile(path.Base(e.File), importDir)
+		if err != nil {
+			return 0, 0, err
+		}
+		hsh := h.New()
+		_, err = io.Copy(io.MultiWriter(tmpf, hsh), tr)
+		if cErr := tmpf.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", e.File, err)
+		}
+		if got := hsh.Sum(nil); !bytes.Equal(got, digest) {
+			return 0, 0, fmt.Errorf("%s: digest mismatch: expected %x, got %x", e.File, digest, got)
+		}
+		verified[e.File] = tmpf.Name()
+	}
+	for _, e := range manifest.Entries {
+		if _, found := verified[e.File]; !found {
+			return 0, 0, fmt.Errorf("missing bundle entry: %q", e.File)
+		}
+	}
+
+	// Install
+
+	for _, e := range manifest.Entries {
+		ok, err := importCacheEntry(w, cacheDir, e, verified[e.File], limits)
+		if err != nil {
+			return installed, present, fmt.Errorf("%s: %w", e.URL, err)
+		}
+		if ok {
+			installed++
+		} else {
+			present++
+		}
+	}
+
+	return installed, present, nil
+}
+
+// importCacheEntry installs the verified download at pth for the bundle entry e to the cache in cacheDir.
+// It returns false if the entry was in the cache already.
+func importCacheEntry(w *Wrun, cacheDir string, e cacheBundleEntry, pth string, limits archives.Limits) (bool, error) {
+	ur, err := url.Parse(e.URL)
+	if err != nil {
+		return false, err
+	}
+	h, digest, err := hashes.ParseHashFragment(e.Digest)
+	if err != nil {
+		return false, err
+	}
+	if h == 0 {
+		return false, fmt.Errorf("invalid digest %q", e.Digest)
+	}
+	_, dlBase := path.Split(ur.Path)
+	urlRel := urlDir(ur, h, digest)
+	if (ur.Scheme != "http" && ur.Scheme != "https") || dlBase == "" || dlBase == ".." || !filepath.IsLocal(urlRel) {
+		return false, errors.New("invalid URL")
+	}
+	entryDir := filepath.Join(cacheDir, cacheCASDir, digestKey(h, digest))
+	urlEntryDir := filepath.Join(cacheDir, cacheURLDir, urlRel)
+	if cacheEntryComplete(entryDir) {
+		linkURLEntry(w, urlEntryDir, entryDir)
+
+		return false, nil
+	}
+
+	staging, err := newCacheStaging(entryDir)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(staging); rmErr != nil {
+			w.LogWarn("remove staging dir: %v", rmErr)
+		}
+	}()
+	dlPath := filepath.Join(staging, dlBase)
+	if e.Archive {
+		if err = archives.Extract(pth, dlPath, limits); err != nil {
+			return false, fmt.Errorf("extract: %w", err)
+		}
+		if err = os.Rename(pth, filepath.Join(staging, cacheEntryArchive)); err != nil {
+			w.LogWarn("keep archive: %v", err)
+		}
+	} else {
+		if err = os.Rename(pth, dlPath); err != nil {
+			return false, err
+		}
+		if err = files.MakeExecutable(dlPath); err != nil {
+			return false, fmt.Errorf("make executable: %w", err)
+		}
+	}
+	data, err := json.Marshal(map[string]string{metadataURLKey: e.URL})
+	if err != nil {
+		w.LogWarn("encode metadata: %v", err)
+	} else if err = os.WriteFile(dlPath+metadataSuffix, data, 0o666); err != nil {
+		w.LogWarn("write metadata: %v", err)
+	}
+
+	dedupFiles(w, filepath.Join(cacheDir, cacheObjectsDir), dlPath)
+	if err = installCacheEntry(w, staging, entryDir, dlBase); err != nil {
+		return false, err
+	}
+	linkURLEntry(w, urlEntryDir, entryDir)
+
+	return true, nil
+}
+
+func cacheExportCommand(w *Wrun) *cobra.Command {
+	var argsFiles []string
+	var days int
+	cmd := &cobra.Command{
+		Use:   "export [flags] BUNDLE",
+		Short: "export cache entries to a bundle",
+		Long: `export cache entries to a bundle
+
+Entries are selected by URLs in args files, and/or by having been used within the given number of days.
+Only entries for URLs with digests are exported.
+
+The bundle is a gzip compressed tarball containing a manifest of URLs and digests, and the downloads.
+Archives with digests are kept in the cache after extraction, and verified for export.
+Ones not kept, such as archives in entries set up by older wrun versions, are downloaded again.
+The remote cache and proxy are used for the downloads if configured,
+so one of them or the download URLs must be reachable for those.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if len(argsFiles) == 0 && days <= 0 {
+				return errors.New("no entries selected, use --args-file and/or --days")
+			}
+
+			return nil
+		},
+	}
+	cmd.Run = func(_ *cobra.Command, args []string) {
+		cacheHome, err := resolveCacheHome()
+		if err != nil {
+			w.LogError("%s", err)
+			os.Exit(esError)
+		}
+		autoMigrateCache(w, cacheHome)
+		base := cacheEntrySpec{cacheDir: filepath.Join(cacheHome, cacheVersion)}
+		if base.remoteCache, err = resolveRemoteCache(); err != nil {
+			w.LogError("%s", err)
+			os.Exit(esUsage)
+		}
+		if base.proxyURL, err = resolveProxyURL(); err != nil {
+			w.LogError("%s", err)
+			os.Exit(esUsage)
+		}
+
+		sources, err := argsFileSources(w, argsFiles)
+		if err != nil {
+			w.LogError("%s", err)
+			os.Exit(esUsage)
+		}
+		if days > 0 {
+			recent, err := recentlyUsedSources(w, base.cacheDir, time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				w.LogError("%s", err)
+				os.Exit(esError)
+			}
+			sources = append(sources, recent...)
+		}
+
+		pol, err := resolvePolicy()
+		if err != nil {
+			w.LogError("download policy: %v", err)
+			os.Exit(esUsage)
+		}
+		for _, src := range sources {
+			if err = checkDownloadURL(pol, base.proxyURL, src.url); err != nil {
+				w.LogError("download policy: %v", err)
+				os.Exit(esUsage)
+			}
+		}
+		w.setPolicy(pol)
+
+		f, err := os.Create(args[0])
+		if err != nil {
+			w.LogError("%s", err)
+			os.Exit(esError)
+		}
+		manifest, skipped, err := exportCache(w, base, sources, f)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			w.LogError("export: %v", err)
+			if rmErr := os.Remove(args[0]); rmErr != nil {
+				w.LogWarn("remove %s: %v", args[0], rmErr)
+			}
+			os.Exit(esError)
+		}
+		fmt.Printf("exported %d entries, %d not in cache\n", len(manifest.Entries), len(skipped))
+	}
+	cmd.Flags().StringArrayVar(&argsFiles, "args-file", nil, "export entries for URLs in args file")
+	cmd.Flags().IntVar(&days, "days", 0, "export entries used within given number of days")
+
+	return cmd
+}
+
+func cacheImportCommand(w *Wrun) *cobra.Command {
+	return &cobra.Command{
+		Use:   "import BUNDLE...",
+		Short: "import cache entries from bundles",
+		Long: `import cache entries from bundles
+
+All downloads in a bundle are verified against their digests before any of them are installed to the cache.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			cacheHome, err := resolveCacheHome()
+			if err != nil {
+				w.LogError("%s", err)
+				os.Exit(esError)
+			}
+			autoMigrateCache(w, cacheHome)
+			limits, err := resolveExtractLimits()
+			if err != nil {
+				w.LogError("%s", err)
+				os.Exit(esUsage)
+			}
+			for _, bundle := range args {
+				f, err := os.Open(bundle)
+				if err != nil {
+					w.LogError("%s", err)
+					os.Exit(esError)
+				}
+				installed, present, err := importCache(w, filepath.Join(cacheHome, cacheVersion), f, limits)
+				f.Close()
+				if err != nil {
+					w.LogError("import %s: %v", bundle, err)
+					os.Exit(esError)
+				}
+				fmt.Printf("%s: imported %d entries, %d already present\n", bundle, installed, present)
+			}
+		},
+	}
+}
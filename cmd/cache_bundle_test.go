@@ -0,0 +1,230 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+)
+
+// writeTestCacheEntry sets up a content addressed cache entry with content and metadata for ur.
+func writeTestCacheEntry(t *testing.T, cacheDir string, ur *url.URL, h crypto.Hash, digest []byte, files map[string]string) string {
+	t.Helper()
+	entryDir := filepath.Join(cacheDir, cacheCASDir, digestKey(h, digest))
+	for name, data := range files {
+		pth := filepath.Join(entryDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(pth), 0o777))
+		require.NoError(t, os.WriteFile(pth, []byte(data), 0o755))
+	}
+	content := filepath.Base(ur.Path)
+	meta, err := json.Marshal(map[string]string{metadataURLKey: ur.String()})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(entryDir, content+metadataSuffix), meta, 0o666))
+	require.NoError(t, os.WriteFile(filepath.Join(entryDir, cacheEntryCompleteMarker), []byte(content), 0o666))
+
+	return entryDir
+}
+
+func testTarGz(t *testing.T, name, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+func Test_exportImportCache(t *testing.T) {
+	w := NewWrun("wrun-test")
+	archive := testTarGz(t, "bin/tool", "archived tool")
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write(archive)
+	}))
+	defer srv.Close()
+
+	srcCache := t.TempDir()
+	plainDigest := sha256.Sum256([]byte("plain tool"))
+	plainURL, err := url.Parse(srv.URL + "/plain/tool#" + digestKey(crypto.SHA256, plainDigest[:]))
+	require.NoError(t, err)
+	writeTestCacheEntry(t, srcCache, plainURL, crypto.SHA256, plainDigest[:], map[string]string{"tool": "plain tool"})
+	archiveDigest := sha256.Sum256(archive)
+	archiveURL, err := url.Parse(srv.URL + "/archive/tool.tar.gz#" + digestKey(crypto.SHA256, archiveDigest[:]))
+	require.NoError(t, err)
+	writeTestCacheEntry(t, srcCache, archiveURL, crypto.SHA256, archiveDigest[:], map[string]string{"tool.tar.gz/bin/tool": "archived tool"})
+
+	sources, err := recentlyUsedSources(w, srcCache, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, sources, 2)
+	missingDigest := sha256.Sum256([]byte("missing"))
+	sources = append(sources, cacheBundleSource{plainURL.JoinPath("missing"), crypto.SHA256, missingDigest[:]})
+
+	var bundle bytes.Buffer
+	manifest, skipped, err := exportCache(w, cacheEntrySpec{cacheDir: srcCache}, sources, &bundle)
+	require.NoError(t, err)
+	assert.Len(t, manifest.Entries, 2)
+	assert.Len(t, skipped, 1)
+
+	dstCache := t.TempDir()
+	installed, present, err := importCache(w, dstCache, bytes.NewReader(bundle.Bytes()), archives.DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, 2, installed)
+	assert.Zero(t, present)
+	for pth, want := range map[string]string{
+		entryExePath(filepath.Join(dstCache, cacheCASDir, digestKey(crypto.SHA256, plainDigest[:])), "tool", ""):                  "plain tool",
+		entryExePath(filepath.Join(dstCache, cacheCASDir, digestKey(crypto.SHA256, archiveDigest[:])), "tool.tar.gz", "bin/tool"): "archived tool",
+	} {
+		data, err := os.ReadFile(pth)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+
+	installed, present, err = importCache(w, dstCache, bytes.NewReader(bundle.Bytes()), archives.DefaultLimits)
+	require.NoError(t, err)
+	assert.Zero(t, installed)
+	assert.Equal(t, 2, present)
+}
+
+func Test_exportCache_remoteCache(t *testing.T) {
+	w := NewWrun("wrun-test")
+	archive := testTarGz(t, "bin/tool", "archived tool")
+	archiveDigest := sha256.Sum256(archive)
+	key := digestKey(crypto.SHA256, archiveDigest[:])
+	remote, entries := newTestRemoteCache(t)
+	entries["/"+key] = archive
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	srcCache := t.TempDir()
+	archiveURL, err := url.Parse(upstream.URL + "/archive/tool.tar.gz#" + key)
+	require.NoError(t, err)
+	writeTestCacheEntry(t, srcCache, archiveURL, crypto.SHA256, archiveDigest[:], map[string]string{"tool.tar.gz/bin/tool": "archived tool"})
+	sources := []cacheBundleSource{{archiveURL, crypto.SHA256, archiveDigest[:]}}
+
+	var bundle bytes.Buffer
+	_, _, err = exportCache(w, cacheEntrySpec{cacheDir: srcCache}, sources, &bundle)
+	require.Error(t, err)
+
+	bundle.Reset()
+	manifest, skipped, err := exportCache(w, cacheEntrySpec{cacheDir: srcCache, remoteCache: remote.URL}, sources, &bundle)
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	require.Len(t, manifest.Entries, 1)
+	assert.True(t, manifest.Entries[0].Archive)
+}
+
+func Test_exportCache_keptArchive(t *testing.T) {
+	w := NewWrun("wrun-test")
+	archive := testTarGz(t, "bin/tool", "archived tool")
+	archiveDigest := sha256.Sum256(archive)
+	key := digestKey(crypto.SHA256, archiveDigest[:])
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write(archive)
+	}))
+	archiveURL, err := url.Parse(upstream.URL + "/archive/tool.tar.gz#" + key)
+	require.NoError(t, err)
+	srcCache := t.TempDir()
+	_, err = downloadCacheEntry(w, cacheEntrySpec{
+		url:            archiveURL,
+		h:              crypto.SHA256,
+		digest:         archiveDigest[:],
+		archiveExePath: "bin/tool",
+		limits:         archives.DefaultLimits,
+		cacheDir:       srcCache,
+	})
+	require.NoError(t, err)
+	upstream.Close()
+
+	// Kept archive is exported without upstream
+	sources := []cacheBundleSource{{archiveURL, crypto.SHA256, archiveDigest[:]}}
+	var bundle bytes.Buffer
+	manifest, skipped, err := exportCache(w, cacheEntrySpec{cacheDir: srcCache}, sources, &bundle)
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	require.Len(t, manifest.Entries, 1)
+	assert.True(t, manifest.Entries[0].Archive)
+
+	// And kept again on import
+	dstCache := t.TempDir()
+	installed, _, err := importCache(w, dstCache, bytes.NewReader(bundle.Bytes()), archives.DefaultLimits)
+	require.NoError(t, err)
+	assert.Equal(t, 1, installed)
+	data, err := os.ReadFile(filepath.Join(dstCache, cacheCASDir, key, cacheEntryArchive))
+	require.NoError(t, err)
+	assert.Equal(t, archive, data)
+
+	// Tampered kept archive is not exported
+	require.NoError(t, os.WriteFile(filepath.Join(srcCache, cacheCASDir, key, cacheEntryArchive), []byte("tampered"), 0o666))
+	bundle.Reset()
+	_, _, err = exportCache(w, cacheEntrySpec{cacheDir: srcCache}, sources, &bundle)
+	require.Error(t, err)
+}
+
+func Test_importCache_mismatch(t *testing.T) {
+	w := NewWrun("wrun-test")
+	goodDigest := sha256.Sum256([]byte("good"))
+	badDigest := sha256.Sum256([]byte("bad"))
+	manifest := cacheBundleManifest{
+		Version: cacheBundleVersion,
+		Entries: []cacheBundleEntry{
+			{URL: "https://example.com/good", Digest: digestKey(crypto.SHA256, goodDigest[:]), File: "files/good"},
+			{URL: "https://example.com/bad", Digest: digestKey(crypto.SHA256, badDigest[:]), File: "files/bad"},
+		},
+	}
+	var bundle bytes.Buffer
+	gw := gzip.NewWriter(&bundle)
+	tw := tar.NewWriter(gw)
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{cacheBundleManifestName, data},
+		{"files/good", []byte("good")},
+		{"files/bad", []byte("evil")},
+	} {
+		require.NoError(t, writeTarFile(tw, f.name, bytes.NewReader(f.content), int64(len(f.content))))
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	dstCache := t.TempDir()
+	_, _, err = importCache(w, dstCache, &bundle, archives.DefaultLimits)
+	require.ErrorContains(t, err, "digest mismatch")
+	assert.False(t, cacheEntryComplete(filepath.Join(dstCache, cacheCASDir, digestKey(crypto.SHA256, goodDigest[:]))))
+}
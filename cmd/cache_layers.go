@@ -0,0 +1,128 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errCacheLayerEntryInvalid  = errors.New("invalid cache layer entry")
+	errCacheLayerEntryMismatch = errors.New("cache layer entry digest mismatch")
+)
+
+// resolveCacheLayers gets the read-only cache layer dirs to consult before the writable cache.
+func resolveCacheLayers() []string {
+	var layers []string
+	for _, layer := range filepath.SplitList(os.Getenv(cacheLayersEnvVar)) {
+		if layer != "" {
+			layers = append(layers, layer)
+		}
+	}
+
+	return layers
+}
+
+// cacheLayerExePath gets the path to the executable in the content addressed entry for digest
+// in the read-only cache layer layerHome.
+// Layers are looked up by digest, and extractPaths if only some are extracted from the archive.
+// Fully extracted entries are used for ones with only some paths extracted as well.
+func cacheLayerExePath(layerHome string, h crypto.Hash, digest []byte, archiveExePath string, extractPaths []string) (string, error) {
+	casDir := filepath.Join(layerHome, cacheVersion, cacheCASDir)
+	key := digestKey(h, digest)
+	var err error
+	if suffix := extractKey(extractPaths); suffix != "" {
+		var exePath string
+		if exePath, err = cacheLayerEntryExePath(filepath.Join(casDir, key+suffix), h, digest, archiveExePath); err == nil {
+			return exePath, nil
+		}
+	}
+	exePath, fullErr := cacheLayerEntryExePath(filepath.Join(casDir, key), h, digest, archiveExePath)
+	if fullErr != nil && err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	return exePath, fullErr
+}
+
+// cacheLayerEntryExePath gets the path to the executable in the cache layer entry entryDir.
+// The entry must be a real directory, and the executable must resolve to within it.
+// Downloads that are not archives are also verified against the digest,
+// so that layers cannot provide content not matching it.
+func cacheLayerEntryExePath(entryDir string, h crypto.Hash, digest []byte, archiveExePath string) (string, error) {
+	fi, err := os.Lstat(entryDir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%w: not a directory: %s", errCacheLayerEntryInvalid, entryDir)
+	}
+	content, ok := cacheEntryContent(entryDir)
+	if !ok {
+		return "", fmt.Errorf("incomplete entry: %s: %w", entryDir, os.ErrNotExist)
+	}
+	if content == "" || content == "." || content == ".." || strings.ContainsAny(content, `/\`) {
+		return "", fmt.Errorf("%w: content name %q: %s", errCacheLayerEntryInvalid, content, entryDir)
+	}
+
+	exePath := entryExePath(entryDir, content, archiveExePath)
+	realEntryDir, err := filepath.EvalSymlinks(entryDir)
+	if err != nil {
+		return "", err
+	}
+	realExePath, err := filepath.EvalSymlinks(exePath)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realEntryDir, realExePath); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: executable outside entry: %s", errCacheLayerEntryInvalid, exePath)
+	}
+
+	if archiveExePath == "" {
+		got, err := fileDigest(realExePath, h)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(got, digest) {
+			return "", fmt.Errorf("%w: %s", errCacheLayerEntryMismatch, exePath)
+		}
+	}
+
+	return exePath, nil
+}
+
+// fileDigest gets the digest of the file at pth using h.
+func fileDigest(pth string, h crypto.Hash) ([]byte, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hsh := h.New()
+	if _, err = io.Copy(hsh, f); err != nil {
+		return nil, err
+	}
+
+	return hsh.Sum(nil), nil
+}
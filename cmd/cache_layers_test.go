@@ -0,0 +1,96 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLayerEntry(t *testing.T, layerHome, key, content string, files map[string]string) string {
+	t.Helper()
+	entryDir := filepath.Join(layerHome, cacheVersion, cacheCASDir, key)
+	for name, data := range files {
+		pth := filepath.Join(entryDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(pth), 0o777))
+		require.NoError(t, os.WriteFile(pth, []byte(data), 0o755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(entryDir, cacheEntryCompleteMarker), []byte(content), 0o666))
+
+	return entryDir
+}
+
+func Test_cacheLayerExePath(t *testing.T) {
+	good := sha256.Sum256([]byte("good"))
+	bad := sha256.Sum256([]byte("bad"))
+
+	layerHome := t.TempDir()
+	entryDir := writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, good[:]), "exe", map[string]string{"exe": "good"})
+	exePath, err := cacheLayerExePath(layerHome, crypto.SHA256, good[:], "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(entryDir, "exe"), exePath)
+
+	_, err = cacheLayerExePath(t.TempDir(), crypto.SHA256, good[:], "", nil)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	layerHome = t.TempDir()
+	writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, bad[:]), "exe", map[string]string{"exe": "good"})
+	_, err = cacheLayerExePath(layerHome, crypto.SHA256, bad[:], "", nil)
+	require.ErrorIs(t, err, errCacheLayerEntryMismatch)
+
+	layerHome = t.TempDir()
+	writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, good[:]), "../exe", map[string]string{"exe": "good"})
+	_, err = cacheLayerExePath(layerHome, crypto.SHA256, good[:], "", nil)
+	require.ErrorIs(t, err, errCacheLayerEntryInvalid)
+
+	layerHome = t.TempDir()
+	entryDir = writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, bad[:]), "archive", map[string]string{"archive/bin/tool": "tool"})
+	exePath, err = cacheLayerExePath(layerHome, crypto.SHA256, bad[:], "bin/tool", nil)
+	require.NoError(t, err) // Archive content cannot be verified, only the entry dir name
+	assert.Equal(t, filepath.Join(entryDir, "archive", "bin", "tool"), exePath)
+}
+
+func Test_cacheLayerExePath_symlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks")
+	}
+	good := sha256.Sum256([]byte("good"))
+	bad := sha256.Sum256([]byte("bad"))
+
+	// Entry dir symlinked to another digest's
+	layerHome := t.TempDir()
+	entryDir := writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, bad[:]), "archive", map[string]string{"archive/tool": "bad"})
+	require.NoError(t, os.Symlink(filepath.Base(entryDir), filepath.Join(filepath.Dir(entryDir), digestKey(crypto.SHA256, good[:]))))
+	_, err := cacheLayerExePath(layerHome, crypto.SHA256, good[:], "tool", nil)
+	require.ErrorIs(t, err, errCacheLayerEntryInvalid)
+
+	// Executable symlinked outside entry
+	layerHome = t.TempDir()
+	outside := filepath.Join(layerHome, "outside")
+	require.NoError(t, os.WriteFile(outside, []byte("bad"), 0o755))
+	entryDir = writeLayerEntry(t, layerHome, digestKey(crypto.SHA256, bad[:]), "archive", map[string]string{"archive/other": "x"})
+	require.NoError(t, os.Symlink(outside, filepath.Join(entryDir, "archive", "tool")))
+	_, err = cacheLayerExePath(layerHome, crypto.SHA256, bad[:], "tool", nil)
+	require.ErrorIs(t, err, errCacheLayerEntryInvalid)
+}
@@ -0,0 +1,331 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/hashes"
+)
+
+// cacheMigration migrates entries from cache layout version dir oldDir to the next version's dir newDir.
+// It returns the number of migrated entries and the paths of unconvertible ones relative to oldDir.
+type cacheMigration func(w *Wrun, oldDir, newDir string) (migrated int, unconvertible []string, err error)
+
+// cacheMigrations contains migrations from cache layout versions to the next one, keyed by the version migrated from.
+// Versions with no migration here are removed without migrating.
+var cacheMigrations = map[string]cacheMigration{
+	"v2": migrateCacheV2,
+}
+
+type cacheMigrateResult struct {
+	migrated      int
+	unconvertible []string
+	removed       []string
+}
+
+var cacheVersionRE = regexp.MustCompile(`^v([0-9]+)$`)
+
+func cacheVersionNumber(v string) int {
+	m := cacheVersionRE.FindStringSubmatch(v)
+	if m == nil {
+		return -1
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return -1
+	}
+
+	return n
+}
+
+// oldCacheVersions gets cache layout versions older than the current one present in cacheHome, oldest first.
+func oldCacheVersions(cacheHome string) ([]string, error) {
+	des, err := os.ReadDir(cacheHome)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	current := cacheVersionNumber(cacheVersion)
+	var versions []string
+	for _, de := range des {
+		if n := cacheVersionNumber(de.Name()); de.IsDir() && n != -1 && n < current {
+			versions = append(versions, de.Name())
+		}
+	}
+	slices.SortFunc(versions, func(a, b string) int {
+		return cacheVersionNumber(a) - cacheVersionNumber(b)
+	})
+
+	return versions, nil
+}
+
+// staleMigrationAge is the age after which staging dirs of migrations in the cache home are considered left behind
+// by interrupted ones.
+const staleMigrationAge = time.Hour
+
+// claimCacheVersion moves the cache layout version dir v in cacheHome to a new staging dir in it,
+// so that concurrent processes do not migrate or remove it at the same time, and returns its new path.
+// An error satisfying errors.Is(err, os.ErrNotExist) is returned if another process claimed it first.
+func claimCacheVersion(cacheHome, v string) (string, error) {
+	staging, err := os.MkdirTemp(cacheHome, cacheStagingPattern)
+	if err != nil {
+		return "", err
+	}
+	claimed := filepath.Join(staging, v)
+	if err = os.Rename(filepath.Join(cacheHome, v), claimed); err != nil {
+		_ = os.Remove(staging)
+
+		return "", err
+	}
+
+	return claimed, nil
+}
+
+// removeStaleMigrations removes staging dirs left behind in cacheHome by interrupted migrations.
+func removeStaleMigrations(w *Wrun, cacheHome string) {
+	stagings, _ := filepath.Glob(filepath.Join(cacheHome, cacheStagingPattern))
+	for _, staging := range stagings {
+		if fi, err := os.Stat(staging); err != nil || time.Since(fi.ModTime()) < staleMigrationAge {
+			continue
+		}
+		w.LogInfo("cache migration: removing leftover of interrupted migration: %s", staging)
+		if err := os.RemoveAll(staging); err != nil {
+			w.LogWarn("cache migration: %v", err)
+		}
+	}
+}
+
+// migrateCache migrates entries from older cache layout versions in cacheHome to the current one,
+// and removes the old version dirs.
+// Old version dirs are moved aside before migration, so that concurrent processes each migrate different ones.
+func migrateCache(w *Wrun, cacheHome string) (cacheMigrateResult, error) {
+	var res cacheMigrateResult
+	removeStaleMigrations(w, cacheHome)
+	versions, err := oldCacheVersions(cacheHome)
+	if err != nil {
+		return res, err
+	}
+	for _, v := range versions {
+		oldDir, err := claimCacheVersion(cacheHome, v)
+		if errors.Is(err, os.ErrNotExist) {
+			w.LogInfo("cache migration: %s being migrated concurrently", v)
+
+			continue
+		} else if err != nil {
+			return res, fmt.Errorf("claim %s: %w", v, err)
+		}
+		if migrate, found := cacheMigrations[v]; found {
+			next := "v" + strconv.Itoa(cacheVersionNumber(v)+1)
+			w.LogInfo("cache migration: %s to %s", v, next)
+			migrated, unconvertible, err := migrate(w, oldDir, filepath.Join(cacheHome, next))
+			res.migrated += migrated
+			for _, u := range unconvertible {
+				res.unconvertible = append(res.unconvertible, filepath.Join(v, u))
+			}
+			if err != nil {
+				return res, fmt.Errorf("migrate %s to %s: %w", v, next, err)
+			}
+		} else {
+			w.LogInfo("cache migration: no migration from %s", v)
+			res.unconvertible = append(res.unconvertible, v)
+		}
+		if err = os.RemoveAll(filepath.Dir(oldDir)); err != nil {
+			return res, fmt.Errorf("remove %s: %w", v, err)
+		}
+		res.removed = append(res.removed, v)
+	}
+
+	return res, nil
+}
+
+// autoMigrateCache runs cache migration if the current cache layout version dir does not exist yet.
+func autoMigrateCache(w *Wrun, cacheHome string) {
+	if _, err := os.Stat(filepath.Join(cacheHome, cacheVersion)); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	res, err := migrateCache(w, cacheHome)
+	for _, u := range res.unconvertible {
+		w.LogWarn("cache migration: unconvertible, removed: %s", filepath.Join(cacheHome, u))
+	}
+	if res.migrated != 0 {
+		w.LogInfo("cache migration: migrated %d entries", res.migrated)
+	}
+	if err != nil {
+		w.LogWarn("cache migration: %v", err)
+	}
+}
+
+var legacyTempfileRE = regexp.MustCompile(`^wrun[0-9]+-`)
+
+// isLegacyEntryName tells whether name looks like a v2 cache entry dir name.
+func isLegacyEntryName(name string) bool {
+	if name == cacheDirDigestPlaceholder {
+		return true
+	}
+	h, _, err := hashes.ParseHashFragment(name)
+
+	return err == nil && h != 0
+}
+
+// legacyEntryContent gets the name of the content in a v2 cache entry dir, and whether the entry is complete.
+// Entries set up before completion markers were introduced are complete if they have a metadata file,
+// as that was written last.
+func legacyEntryContent(entryDir string) (content string, complete bool, err error) {
+	des, err := os.ReadDir(entryDir)
+	if err != nil {
+		return "", false, err
+	}
+	var candidates []string
+	hasMetadata := false
+	for _, de := range des {
+		name := de.Name()
+		switch {
+		case name == cacheEntryCompleteMarker:
+			complete = true
+		case strings.HasSuffix(name, metadataSuffix):
+			hasMetadata = true
+		case legacyTempfileRE.MatchString(name):
+			// leftover download tempfile
+		default:
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) != 1 {
+		return "", false, fmt.Errorf("expected one content item, found %d", len(candidates))
+	}
+
+	return candidates[0], complete || hasMetadata, nil
+}
+
+// migrateCacheV2 migrates v2 cache entries to v3.
+// In v2, all entries were keyed by URL directly under the version dir,
+// in v3 they are in the URL keyed dir, and ones with digests in the content addressed dir.
+func migrateCacheV2(w *Wrun, oldDir, newDir string) (int, []string, error) {
+	migrated := 0
+	var unconvertible []string
+	err := filepath.WalkDir(oldDir, func(pth string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if pth == oldDir {
+			return nil
+		}
+		rel, err := filepath.Rel(oldDir, pth)
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			unconvertible = append(unconvertible, rel)
+
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), strings.TrimSuffix(cacheStagingPattern, "*")) {
+			return filepath.SkipDir // incomplete
+		}
+		if !isLegacyEntryName(d.Name()) {
+			return nil
+		}
+		content, complete, err := legacyEntryContent(pth)
+		if err != nil || !complete {
+			if err == nil {
+				err = errors.New("incomplete")
+			}
+			w.LogInfo("cache migration: %s: %v", rel, err)
+			unconvertible = append(unconvertible, rel)
+
+			return filepath.SkipDir
+		}
+
+		urlEntryDir := filepath.Join(newDir, cacheURLDir, rel)
+		entryDir := urlEntryDir
+		if d.Name() != cacheDirDigestPlaceholder {
+			entryDir = filepath.Join(newDir, cacheCASDir, d.Name())
+		}
+		if cacheEntryComplete(entryDir) {
+			w.LogInfo("cache migration: %s: already present", rel)
+		} else {
+			if err = os.WriteFile(filepath.Join(pth, cacheEntryCompleteMarker), []byte(content), 0o666); err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(entryDir), 0o777); err != nil {
+				return err
+			}
+			if err = os.RemoveAll(entryDir); err != nil { // incomplete
+				return err
+			}
+			if err = os.Rename(pth, entryDir); err != nil {
+				return err
+			}
+			dedupFiles(w, filepath.Join(newDir, cacheObjectsDir), filepath.Join(entryDir, content))
+		}
+		if entryDir != urlEntryDir {
+			linkURLEntry(w, urlEntryDir, entryDir)
+		}
+		migrated++
+
+		return filepath.SkipDir
+	})
+
+	return migrated, unconvertible, err
+}
+
+func cacheMigrateCommand(w *Wrun) *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "migrate cache entries from older cache layout versions to the current one",
+		Long: `migrate cache entries from older cache layout versions to the current one
+
+Entries that can be migrated are moved to the current layout, unconvertible ones are reported.
+Older layout version dirs are removed afterwards.
+
+Migration is done automatically on first use of a new cache layout version, this command can be used to run it explicitly.`,
+		ValidArgsFunction: cobra.NoFileCompletions,
+		Args:              cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			cacheHome, err := resolveCacheHome()
+			if err != nil {
+				w.LogError("%s", err)
+				os.Exit(1)
+			}
+			res, err := migrateCache(w, cacheHome)
+			for _, u := range res.unconvertible {
+				fmt.Printf("unconvertible, removed: %s\n", filepath.Join(cacheHome, u))
+			}
+			fmt.Printf("migrated %d entries, %d unconvertible, removed old versions: %s\n",
+				res.migrated, len(res.unconvertible), strings.Join(res.removed, " "))
+			if err != nil {
+				w.LogError("%s", err)
+				os.Exit(1)
+			}
+		},
+	}
+}
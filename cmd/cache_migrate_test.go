@@ -0,0 +1,141 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_migrateCache(t *testing.T) {
+	const key = "sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	w := NewWrun("wrun-test")
+	cacheHome := t.TempDir()
+	writeFile := func(p string) {
+		t.Helper()
+		p = filepath.Join(cacheHome, filepath.FromSlash(p))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o777))
+		require.NoError(t, os.WriteFile(p, []byte(p), 0o666))
+	}
+
+	// Complete pre-marker entry with digest
+	writeFile("v2/example.com/dl/tool.tar.gz/" + key + "/tool.tar.gz/bin/tool")
+	writeFile("v2/example.com/dl/tool.tar.gz/" + key + "/tool.tar.gz-metadata.json")
+	// Complete marked entry without digest
+	writeFile("v2/example.com/dl/tool/_/tool")
+	writeFile("v2/example.com/dl/tool/_/" + cacheEntryCompleteMarker)
+	// Incomplete entry
+	writeFile("v2/example.com/dl/broken/_/broken")
+	// Staging dir
+	writeFile("v2/example.com/dl/other/.wrun-staging-123/other")
+	// Unknown version
+	writeFile("v1/example.com/file")
+	// Not old
+	writeFile("v999/example.com/file")
+
+	res, err := migrateCache(w, cacheHome)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.migrated)
+	assert.ElementsMatch(t, []string{
+		filepath.Join("v2", "example.com", "dl", "broken", "_"),
+		"v1",
+	}, res.unconvertible)
+	assert.Equal(t, []string{"v1", "v2"}, res.removed)
+
+	v3 := filepath.Join(cacheHome, "v3")
+	casEntry := filepath.Join(v3, cacheCASDir, key)
+	content, ok := cacheEntryContent(casEntry)
+	assert.True(t, ok)
+	assert.Equal(t, "tool.tar.gz", content)
+	_, err = os.Stat(filepath.Join(casEntry, "tool.tar.gz", "bin", "tool"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(v3, cacheURLDir, "example.com", "dl", "tool.tar.gz", key, "tool.tar.gz", "bin", "tool"))
+	require.NoError(t, err, "URL entry link")
+
+	urlEntry := filepath.Join(v3, cacheURLDir, "example.com", "dl", "tool", "_")
+	content, ok = cacheEntryContent(urlEntry)
+	assert.True(t, ok)
+	assert.Equal(t, "tool", content)
+
+	for _, dir := range []string{"v1", "v2"} {
+		_, err = os.Stat(filepath.Join(cacheHome, dir))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+	_, err = os.Stat(filepath.Join(cacheHome, "v999"))
+	require.NoError(t, err)
+}
+
+func Test_migrateCache_concurrent(t *testing.T) {
+	w := NewWrun("wrun-test")
+	cacheHome := t.TempDir()
+	const n = 20
+	for i := range n {
+		dir := filepath.Join(cacheHome, "v2", "example.com", "tool"+strconv.Itoa(i), cacheDirDigestPlaceholder)
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "tool"), []byte("tool"), 0o666))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, cacheEntryCompleteMarker), []byte("tool"), 0o666))
+	}
+
+	var wg sync.WaitGroup
+	results := make([]cacheMigrateResult, 4)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = migrateCache(w, cacheHome)
+		}()
+	}
+	wg.Wait()
+	migrated := 0
+	for i := range results {
+		require.NoError(t, errs[i])
+		migrated += results[i].migrated
+	}
+	assert.Equal(t, n, migrated, "each entry migrated exactly once")
+
+	des, err := os.ReadDir(cacheHome)
+	require.NoError(t, err)
+	require.Len(t, des, 1, "old version or staging dirs left behind")
+	assert.Equal(t, cacheVersion, des[0].Name())
+}
+
+func Test_migrateCache_staleStaging(t *testing.T) {
+	w := NewWrun("wrun-test")
+	cacheHome := t.TempDir()
+	stale := filepath.Join(cacheHome, ".wrun-staging-1")
+	fresh := filepath.Join(cacheHome, ".wrun-staging-2")
+	for _, dir := range []string{stale, fresh} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "v2", "example.com"), 0o777))
+	}
+	old := time.Now().Add(-2 * staleMigrationAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	_, err := migrateCache(w, cacheHome)
+	require.NoError(t, err)
+	_, err = os.Stat(stale)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(fresh)
+	require.NoError(t, err, "possibly in progress migration removed")
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_installCacheEntry(t *testing.T) {
+	w := NewWrun("wrun-test")
+	entryDir := filepath.Join(t.TempDir(), "host", "path", "_")
+
+	// Incomplete entry left behind by an interrupted run
+	require.NoError(t, os.MkdirAll(entryDir, 0o777))
+	require.NoError(t, os.WriteFile(filepath.Join(entryDir, "partial"), []byte("x"), 0o666))
+	assert.False(t, cacheEntryComplete(entryDir))
+
+	staging, err := newCacheStaging(entryDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Dir(entryDir), filepath.Dir(staging))
+	require.NoError(t, os.WriteFile(filepath.Join(staging, "exe"), []byte("exe"), 0o666))
+	assert.False(t, cacheEntryComplete(staging))
+
+	require.NoError(t, installCacheEntry(w, staging, entryDir, "exe"))
+	assert.True(t, cacheEntryComplete(entryDir))
+	_, err = os.Stat(filepath.Join(entryDir, "exe"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(entryDir, "partial"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(staging)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	entries, err := os.ReadDir(filepath.Dir(entryDir))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "old entry left aside")
+	assert.Equal(t, filepath.Base(entryDir), entries[0].Name())
+}
+
+func Test_extractKey(t *testing.T) {
+	assert.Empty(t, extractKey(nil))
+	key := extractKey([]string{"bin/tool", "lib/"})
+	assert.Regexp(t, `^-x[0-9a-f]{16}$`, key)
+	assert.Equal(t, key, extractKey([]string{"lib", "./bin/tool", "bin/tool"}), "order, cleaning, and duplicates")
+	assert.NotEqual(t, key, extractKey([]string{"bin/tool"}))
+
+	assert.Equal(t, "sha256-abcd", trimExtractKey("sha256-abcd"+key))
+	assert.Equal(t, "sha256-abcd", trimExtractKey("sha256-abcd"))
+}
+
+func Test_dedupFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions")
+	}
+	w := NewWrun("wrun-test")
+	cacheDir := t.TempDir()
+	objectsDir := filepath.Join(cacheDir, cacheObjectsDir)
+	entry1 := filepath.Join(cacheDir, "entry1")
+	entry2 := filepath.Join(cacheDir, "entry2")
+	for _, dir := range []string{entry1, entry2} {
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "exe"), []byte("same"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "data"), []byte("same"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "unique"), []byte(dir), 0o644))
+	}
+	dedupFiles(w, objectsDir, entry1)
+	dedupFiles(w, objectsDir, entry2)
+
+	stat := func(p string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(p)
+		require.NoError(t, err)
+
+		return fi
+	}
+	assert.True(t, os.SameFile(stat(filepath.Join(entry1, "exe")), stat(filepath.Join(entry2, "exe"))))
+	assert.True(t, os.SameFile(stat(filepath.Join(entry1, "data")), stat(filepath.Join(entry2, "data"))))
+	assert.False(t, os.SameFile(stat(filepath.Join(entry1, "exe")), stat(filepath.Join(entry1, "data"))), "executable and non-executable share inode")
+	assert.False(t, os.SameFile(stat(filepath.Join(entry1, "unique")), stat(filepath.Join(entry2, "unique"))))
+}
+
+func Test_linkURLEntry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks")
+	}
+	w := NewWrun("wrun-test")
+	cacheDir := t.TempDir()
+	entryDir := filepath.Join(cacheDir, cacheCASDir, "sha256-00")
+	require.NoError(t, os.MkdirAll(entryDir, 0o777))
+	urlEntry := filepath.Join(cacheDir, cacheURLDir, "example.com", "file", "sha256-00")
+	require.NoError(t, os.MkdirAll(urlEntry, 0o777)) // Real dir gets replaced
+
+	linkURLEntry(w, urlEntry, entryDir)
+	target, err := os.Readlink(urlEntry)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join("..", "..", "..", cacheCASDir, "sha256-00"), target)
+	fi, err := os.Stat(urlEntry)
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// selectOSArchFallbacks selects the fallback OS/archs for a system from the given matches, in order.
+func selectOSArchFallbacks(s string, matches []osArchFallbackMatch) ([]string, error) {
+	var osArchs []string
+	for _, m := range matches {
+		match, err := matchOSArch(m.pattern, s)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			osArchs = append(osArchs, m.osArch)
+		}
+	}
+
+	return osArchs, nil
+}
+
+// selectURLsWithFallbacks selects URLs for a system like selectURLs.
+// If there are none, the fallback OS/archs the system can run are tried in order.
+// The OS/arch the URLs were selected for is returned, along with a description of how the system can run it if it is a fallback one.
+func selectURLsWithFallbacks(s string, cfg *rootCmdConfig) (osArch string, urls []*url.URL, how string, err error) {
+	if urls, err = selectURLs(s, cfg.urlMatches); err != nil || len(urls) != 0 {
+		return s, urls, "", err
+	}
+	fallbacks, err := selectOSArchFallbacks(s, cfg.osArchFallbackMatches)
+	if err != nil {
+		return s, nil, "", err
+	}
+	for _, fallback := range fallbacks {
+		how, ok := canRunOSArch(s, fallback)
+		if !ok {
+			continue
+		}
+		if urls, err = selectURLs(fallback, cfg.urlMatches); err != nil || len(urls) != 0 {
+			return fallback, urls, how, err
+		}
+	}
+
+	return s, nil, "", nil
+}
+
+// canRunOSArch tells if a system can run executables for another OS/arch, natively or under emulation,
+// and if so, describes how.
+// Qualifiers must be compatible, see canRunQualifiers.
+func canRunOSArch(s, osArch string) (string, bool) {
+	sOS, sArch, _ := strings.Cut(osArchBase(s), "/")
+	fOS, fArch, _ := strings.Cut(osArchBase(osArch), "/")
+	switch {
+	case sOS != fOS, !canRunQualifiers(s, osArch):
+		return "", false
+	case sArch == fArch:
+		return "native", true
+	case sOS != runtime.GOOS || sArch != runtime.GOARCH:
+		// Can detect only for the running OS/arch
+		return "", false
+	}
+
+	return canRunArch(sArch, fArch)
+}
+
+// canRunQualifiers tells if a system can run executables with the qualifiers of osArch.
+// A libc qualifier must be the same as the system's. A microarchitecture level must not be higher than the system's,
+// but levels are compared only for the same arch, as the system's level for another one is not known.
+func canRunQualifiers(s, osArch string) bool {
+	sParts := strings.Split(s, "/")
+	parts := strings.Split(osArch, "/")
+	if len(parts) <= 2 {
+		return true
+	}
+	var sQualifiers []string
+	if len(sParts) > 2 {
+		sQualifiers = sParts[2:]
+	}
+	sameArch := osArchBase(s) == osArchBase(osArch)
+	for _, q := range parts[2:] {
+		level, isLevel := parseLevel(q)
+		switch {
+		case !isLevel:
+			if !slices.Contains(sQualifiers, q) {
+				return false
+			}
+		case sameArch:
+			if !slices.ContainsFunc(sQualifiers, func(sq string) bool {
+				sLevel, ok := parseLevel(sq)
+
+				return ok && level <= sLevel
+			}) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
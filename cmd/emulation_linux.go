@@ -0,0 +1,135 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+const (
+	binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+	// vsyscall32Path exists if the kernel supports running IA-32 executables on x86-64.
+	vsyscall32Path = "/proc/sys/abi/vsyscall32"
+
+	perLinux32       = 0x0008
+	personalityQuery = 0xffffffff
+)
+
+// qemuArchs maps Go archs to QEMU user mode emulator ones, as used in binfmt_misc entry names.
+var qemuArchs = map[string]string{
+	"386":      "i386",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"loong64":  "loongarch64",
+	"mips":     "mips",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"mipsle":   "mipsel",
+	"ppc64":    "ppc64",
+	"ppc64le":  "ppc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// canRunArch tells if the system can run executables for arch in addition to its own sArch, and if so, describes how.
+// The kernel's 32-bit compatibility support, and binfmt_misc registered emulators are checked.
+func canRunArch(sArch, arch string) (string, bool) {
+	switch {
+	case sArch == "amd64" && arch == "386":
+		if _, err := os.Stat(vsyscall32Path); err == nil {
+			return "kernel IA-32 emulation", true
+		}
+	case sArch == "arm64" && arch == "arm":
+		if supportsPersonality(perLinux32) {
+			return "kernel 32-bit personality", true
+		}
+	}
+	if entry, ok := binfmtEmulates(binfmtMiscDir, arch); ok {
+		return "binfmt_misc " + entry, true
+	}
+
+	return "", false
+}
+
+// supportsPersonality tells if the kernel supports an execution domain, by trying to switch to it and back.
+func supportsPersonality(persona uintptr) bool {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	current, _, errno := syscall.Syscall(syscall.SYS_PERSONALITY, personalityQuery, 0, 0)
+	if errno != 0 {
+		return false
+	}
+	if _, _, errno = syscall.Syscall(syscall.SYS_PERSONALITY, persona, 0, 0); errno != 0 {
+		return false
+	}
+	_, _, _ = syscall.Syscall(syscall.SYS_PERSONALITY, current, 0, 0)
+
+	return true
+}
+
+// binfmtEmulates tells if an enabled binfmt_misc entry in dir handles executables for arch, and if so, its name.
+// Entries are recognized by QEMU user mode emulator naming conventions, and Rosetta for amd64.
+func binfmtEmulates(dir, arch string) (string, bool) {
+	if enabled, err := binfmtEnabled(filepath.Join(dir, "status")); err != nil || !enabled {
+		return "", false
+	}
+	var names []string
+	if qemuArch, found := qemuArchs[arch]; found {
+		names = append(names, "qemu-"+qemuArch)
+	}
+	if arch == "amd64" {
+		names = append(names, "rosetta")
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, de := range des {
+		if !slices.Contains(names, de.Name()) {
+			continue
+		}
+		if enabled, err := binfmtEnabled(filepath.Join(dir, de.Name())); err == nil && enabled {
+			return de.Name(), true
+		}
+	}
+
+	return "", false
+}
+
+// binfmtEnabled tells if a binfmt_misc status or entry file says it is enabled.
+func binfmtEnabled(pth string) (bool, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return false, sc.Err()
+	}
+
+	return strings.TrimSpace(sc.Text()) == "enabled", nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_binfmtEmulates(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"status":        "enabled\n",
+		"qemu-aarch64":  "enabled\ninterpreter /usr/bin/qemu-aarch64-static\nflags: F\n",
+		"qemu-riscv64":  "disabled\ninterpreter /usr/bin/qemu-riscv64-static\n",
+		"rosetta":       "enabled\ninterpreter /mnt/lima-rosetta/rosetta\n",
+		"python3.12":    "enabled\ninterpreter /usr/bin/python3.12\n",
+		"qemu-mips64el": "enabled\ninterpreter /usr/bin/qemu-mips64el\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	tests := []struct {
+		arch      string
+		wantEntry string
+	}{
+		{"arm64", "qemu-aarch64"},
+		{"amd64", "rosetta"},
+		{"mips64le", "qemu-mips64el"},
+		{"riscv64", ""},
+		{"s390x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			entry, ok := binfmtEmulates(dir, tt.arch)
+			assert.Equal(t, tt.wantEntry != "", ok)
+			assert.Equal(t, tt.wantEntry, entry)
+		})
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "status"), []byte("disabled\n"), 0o644))
+	_, ok := binfmtEmulates(dir, "arm64")
+	assert.False(t, ok, "binfmt_misc disabled")
+}
@@ -0,0 +1,25 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !darwin && !linux && !windows
+
+package cmd
+
+// canRunArch tells if the system can run executables for arch in addition to its own sArch, and if so, describes how.
+// Detection is not implemented for this OS.
+func canRunArch(_, _ string) (string, bool) {
+	return "", false
+}
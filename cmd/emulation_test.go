@@ -0,0 +1,110 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_canRunOSArch(t *testing.T) {
+	how, ok := canRunOSArch("linux/amd64/v3", "linux/amd64")
+	assert.True(t, ok)
+	assert.Equal(t, "native", how)
+
+	_, ok = canRunOSArch("linux/amd64", "windows/amd64")
+	assert.False(t, ok)
+
+	for _, tt := range []struct {
+		s, osArch string
+		want      bool
+	}{
+		{"linux/amd64/v3/gnu", "linux/amd64/v2/gnu", true},
+		{"linux/amd64/v3/gnu", "linux/amd64/v3", true},
+		{"linux/amd64/v2/gnu", "linux/amd64/v3", false},
+		{"linux/amd64/gnu", "linux/amd64/v1", false},
+		{"linux/arm64/musl", "linux/arm64/gnu", false},
+		{"linux/arm64", "linux/arm64/musl", false},
+	} {
+		_, ok = canRunOSArch(tt.s, tt.osArch)
+		assert.Equal(t, tt.want, ok, "%s running %s", tt.s, tt.osArch)
+	}
+	assert.True(t, canRunQualifiers("linux/arm64/gnu", "linux/arm/v7/gnu"), "levels of other archs not compared")
+	assert.False(t, canRunQualifiers("linux/arm64/musl", "linux/arm/v7/gnu"))
+
+	other := "linux"
+	if runtime.GOOS == other {
+		other = "freebsd"
+	}
+	_, ok = canRunOSArch(other+"/arm64", other+"/amd64")
+	assert.False(t, ok, "detection for other than running OS")
+
+	// E.g. WRUN_OS_ARCH=linux/arm64 on an amd64 host must not be checked for arm using the running kernel
+	sArch, fArch := "arm64", "arm"
+	if runtime.GOARCH == sArch {
+		sArch, fArch = "amd64", "386"
+	}
+	_, ok = canRunOSArch(runtime.GOOS+"/"+sArch, runtime.GOOS+"/"+fArch)
+	assert.False(t, ok, "detection for other than running arch")
+}
+
+func Test_selectURLsWithFallbacks(t *testing.T) {
+	const base = "https://example.com/"
+	other := "linux"
+	if runtime.GOOS == other {
+		other = "freebsd"
+	}
+	cfg := &rootCmdConfig{
+		urlMatches: []urlMatch{
+			{pattern: "linux/arm64/gnu", url: mustParseURL(t, base+"linux-arm64-gnu")},
+			{pattern: "linux/amd64", url: mustParseURL(t, base+"linux-amd64")},
+			{pattern: other + "/amd64", url: mustParseURL(t, base+other+"-amd64")},
+			{pattern: "darwin/arm64", url: mustParseURL(t, base+"darwin-arm64")},
+		},
+		osArchFallbackMatches: []osArchFallbackMatch{
+			{pattern: "linux/arm64/musl", osArch: "linux/arm64/gnu"},
+			{pattern: "*/arm64", osArch: "darwin/arm64"},
+			{pattern: "*/arm64", osArch: other + "/amd64"},
+		},
+	}
+
+	tests := []struct {
+		osArch     string
+		wantOSArch string
+		wantURL    string
+	}{
+		{"linux/amd64", "linux/amd64", base + "linux-amd64"},
+		{"linux/arm64/musl", "linux/arm64/musl", ""},
+		{other + "/arm64", other + "/arm64", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osArch, func(t *testing.T) {
+			osArch, urls, _, err := selectURLsWithFallbacks(tt.osArch, cfg)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantOSArch, osArch)
+			if tt.wantURL == "" {
+				assert.Empty(t, urls)
+			} else {
+				require.NotEmpty(t, urls)
+				assert.Equal(t, tt.wantURL, urls[0].String())
+			}
+		})
+	}
+}
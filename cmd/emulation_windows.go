@@ -0,0 +1,43 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// canRunArch tells if the system can run executables for arch in addition to its own sArch, and if so, describes how.
+// WOW64 is checked for running 386 executables, and x64 emulation for running amd64 ones on arm64.
+func canRunArch(sArch, arch string) (string, bool) {
+	systemRoot := os.Getenv("SystemRoot")
+	if systemRoot == "" {
+		return "", false
+	}
+	switch {
+	case arch == "386" && (sArch == "amd64" || sArch == "arm64"):
+		if _, err := os.Stat(filepath.Join(systemRoot, "SysWOW64")); err == nil {
+			return "WOW64", true
+		}
+	case sArch == "arm64" && arch == "amd64":
+		if _, err := os.Stat(filepath.Join(systemRoot, "System32", "xtajit64.dll")); err == nil {
+			return "x64 emulation", true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Placeholders expanded in --env values and --path-prepend dirs.
+const (
+	archiveRootPlaceholder = "{archive-root}"
+	exeDirPlaceholder      = "{exe-dir}"
+)
+
+type envVar struct {
+	key   string
+	value string
+}
+
+type pathPrependMatch struct {
+	pattern string
+	dir     string
+}
+
+// parseExecFlags parses the flags affecting the environment of the executable.
+func parseExecFlags(cfg *rootCmdConfig, envArgs, pathPrependArgs []string) error {
+	for _, s := range envArgs {
+		key, value, found := strings.Cut(s, "=")
+		if !found || key == "" {
+			return fmt.Errorf("invalid environment variable %q, use KEY=VALUE", s)
+		}
+		cfg.env = append(cfg.env, envVar{key, value})
+	}
+
+	for _, s := range pathPrependArgs {
+		pattern, dir, err := parseMatchArg(s, "dir")
+		if err != nil {
+			return err
+		}
+		cfg.pathPrependMatches = append(cfg.pathPrependMatches, pathPrependMatch{pattern, dir})
+	}
+
+	return nil
+}
+
+// selectPathPrepends selects all dirs to prepend to PATH for a system from the given matches.
+func selectPathPrepends(s string, matches []pathPrependMatch) ([]string, error) {
+	var dirs []string
+	for _, m := range matches {
+		match, err := matchOSArch(m.pattern, s)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			dirs = append(dirs, m.dir)
+		}
+	}
+
+	return dirs, nil
+}
+
+// archiveRoot gets the root dir of the archive exe is extracted from at archiveExePath.
+// For executables not in archives, it is the dir containing exe.
+func archiveRoot(exe, archiveExePath string) string {
+	root := filepath.Dir(exe)
+	if archiveExePath != "" {
+		for range strings.Count(path.Clean(archiveExePath), "/") {
+			root = filepath.Dir(root)
+		}
+	}
+
+	return root
+}
+
+// envKeyIndex gets the index of the variable with key in env, -1 if not found.
+func envKeyIndex(env []string, key string) int {
+	for i := len(env) - 1; i >= 0; i-- { // last one wins, if duplicates
+		k, _, _ := strings.Cut(env[i], "=")
+		if k == key || (runtime.GOOS == "windows" && strings.EqualFold(k, key)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// exeEnv gets the environment for exe extracted from an archive at archiveExePath, if any.
+// vars are set in environ, and pathDirs prepended to PATH in order, with placeholders in them expanded.
+// Relative pathDirs are resolved against the archive root.
+// The resulting environment is returned, along with the variables set in it.
+func exeEnv(environ []string, vars []envVar, pathDirs []string, exe, archiveExePath string) (env, set []string) {
+	if len(vars) == 0 && len(pathDirs) == 0 {
+		return environ, nil
+	}
+	root := archiveRoot(exe, archiveExePath)
+	expand := strings.NewReplacer(archiveRootPlaceholder, root, exeDirPlaceholder, filepath.Dir(exe)).Replace
+
+	env = make([]string, len(environ), len(environ)+len(vars)+1)
+	copy(env, environ)
+	setVar := func(key, value string) {
+		kv := key + "=" + value
+		if i := envKeyIndex(env, key); i != -1 {
+			k, _, _ := strings.Cut(env[i], "=")
+			kv = k + "=" + value // retain case of existing key on Windows
+			env[i] = kv
+		} else {
+			env = append(env, kv)
+		}
+		set = append(set, kv)
+	}
+	for _, v := range vars {
+		setVar(v.key, expand(v.value))
+	}
+	if len(pathDirs) != 0 {
+		dirs := make([]string, 0, len(pathDirs)+1)
+		for _, dir := range pathDirs {
+			dir = filepath.FromSlash(expand(dir))
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(root, dir)
+			}
+			dirs = append(dirs, dir)
+		}
+		if i := envKeyIndex(env, "PATH"); i != -1 {
+			if _, p, _ := strings.Cut(env[i], "="); p != "" {
+				dirs = append(dirs, p)
+			}
+		}
+		setVar("PATH", strings.Join(dirs, string(filepath.ListSeparator)))
+	}
+
+	return env, set
+}
@@ -0,0 +1,117 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseExecFlags(t *testing.T) {
+	cfg := &rootCmdConfig{}
+	require.NoError(t, parseExecFlags(cfg, []string{"FOO=bar=baz", "EMPTY="}, []string{"bin", "linux/*=lib/bin", "=x"}))
+	assert.Equal(t, []envVar{{"FOO", "bar=baz"}, {"EMPTY", ""}}, cfg.env)
+	assert.Equal(t, []pathPrependMatch{{matchAll, "bin"}, {"linux/*", "lib/bin"}, {matchAll, "x"}}, cfg.pathPrependMatches)
+
+	for _, tt := range []struct {
+		env, pathPrepend []string
+	}{
+		{env: []string{"FOO"}},
+		{env: []string{"=bar"}},
+		{pathPrepend: []string{"linux/amd64="}},
+		{pathPrepend: []string{""}},
+		{pathPrepend: []string{"~[=bin"}},
+	} {
+		assert.Error(t, parseExecFlags(&rootCmdConfig{}, tt.env, tt.pathPrepend), "%v %v", tt.env, tt.pathPrepend)
+	}
+}
+
+func Test_selectPathPrepends(t *testing.T) {
+	matches := []pathPrependMatch{
+		{matchAll, "bin"},
+		{"linux/*", "linux-bin"},
+		{"darwin/*", "darwin-bin"},
+	}
+	dirs, err := selectPathPrepends("linux/amd64", matches)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bin", "linux-bin"}, dirs)
+
+	dirs, err = selectPathPrepends("windows/amd64", matches[2:])
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+}
+
+func Test_archiveRoot(t *testing.T) {
+	base := filepath.Join("cache", "entry")
+	for _, tt := range []struct {
+		exe, archiveExePath, want string
+	}{
+		{filepath.Join(base, "tool"), "", base},
+		{filepath.Join(base, "tool"), "tool", base},
+		{filepath.Join(base, "a", "bin", "tool"), "a/bin/tool", base},
+		{filepath.Join(base, "a", "bin", "tool"), "./a//bin/tool", base},
+	} {
+		assert.Equal(t, tt.want, archiveRoot(tt.exe, tt.archiveExePath), "%s %s", tt.exe, tt.archiveExePath)
+	}
+}
+
+func Test_exeEnv(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "entry")
+	exe := filepath.Join(root, "go", "bin", "go")
+	sep := string(filepath.ListSeparator)
+	environ := []string{"HOME=/home/user", "GOROOT=/usr/lib/go", "PATH=/usr/bin"}
+
+	env, set := exeEnv(environ, nil, nil, exe, "go/bin/go")
+	assert.Equal(t, environ, env)
+	assert.Empty(t, set)
+
+	env, set = exeEnv(environ,
+		[]envVar{{"GOROOT", "{archive-root}/go"}, {"TOOL_DIR", "{exe-dir}"}},
+		[]string{"go/bin", "{exe-dir}"},
+		exe, "go/bin/go")
+	wantPath := "PATH=" + strings.Join([]string{filepath.Join(root, "go", "bin"), filepath.Dir(exe), "/usr/bin"}, sep)
+	assert.Equal(t, []string{
+		"HOME=/home/user",
+		"GOROOT=" + root + "/go",
+		wantPath,
+		"TOOL_DIR=" + filepath.Dir(exe),
+	}, env)
+	assert.Equal(t, []string{"GOROOT=" + root + "/go", "TOOL_DIR=" + filepath.Dir(exe), wantPath}, set)
+	assert.Equal(t, "GOROOT=/usr/lib/go", environ[1], "input modified")
+
+	env, _ = exeEnv([]string{"PATH="}, nil, []string{"bin"}, exe, "go/bin/go")
+	assert.Equal(t, []string{"PATH=" + filepath.Join(root, "bin")}, env)
+
+	env, _ = exeEnv(nil, nil, []string{"bin"}, exe, "go/bin/go")
+	assert.Equal(t, []string{"PATH=" + filepath.Join(root, "bin")}, env)
+}
+
+func Test_envKeyIndex(t *testing.T) {
+	env := []string{"Path=a", "FOO=1", "FOO=2"}
+	assert.Equal(t, 2, envKeyIndex(env, "FOO"))
+	assert.Equal(t, -1, envKeyIndex(env, "BAR"))
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, 0, envKeyIndex(env, "PATH"))
+	} else {
+		assert.Equal(t, -1, envKeyIndex(env, "PATH"))
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/scop/wrun/internal/exeformat"
+)
+
+// exeFormatError records an executable format not matching the OS/arch it was selected for.
+type exeFormatError struct {
+	exe    string
+	info   exeformat.Info
+	osArch string
+}
+
+func (e *exeFormatError) Error() string {
+	return fmt.Sprintf("executable %s format %s does not match OS/arch %s", e.exe, e.info, e.osArch)
+}
+
+// exeFormatMatches tells if an executable of the given format is for osArch.
+func exeFormatMatches(info exeformat.Info, osArch string) bool {
+	goos, goarch, _ := strings.Cut(osArchBase(osArch), "/")
+
+	return info.Compatible(goos, goarch)
+}
+
+// checkExeFormat checks that the executable at exe, selected for osArch, can be run on system s.
+// Executables for other archs of the same OS are accepted if s can run them, see canRunOSArch.
+// Failures to inspect the format other than ones accessing the file are logged, but not returned.
+func checkExeFormat(w *Wrun, exe, s, osArch string) error {
+	info, err := exeformat.Inspect(exe)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		w.LogWarn("inspect executable format of %s: %v", exe, err)
+
+		return nil
+	}
+	w.LogInfo("executable format: %s", info)
+	if exeFormatMatches(info, osArch) {
+		return nil
+	}
+	goos, _, _ := strings.Cut(osArchBase(osArch), "/")
+	for _, arch := range info.Archs {
+		if other := goos + "/" + arch; exeFormatMatches(info, other) {
+			if how, ok := canRunOSArch(s, other); ok {
+				w.LogInfo("executable is for %s, runnable on %s (%s)", other, s, how)
+
+				return nil
+			}
+		}
+	}
+
+	return &exeFormatError{exe: exe, info: info, osArch: osArch}
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkExeFormat(t *testing.T) {
+	if runtime.GOARCH == "s390x" {
+		t.Skip("test uses s390x as the foreign arch")
+	}
+	w := NewWrun("wrun-test")
+	s := runtime.GOOS + "/" + runtime.GOARCH
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	require.NoError(t, checkExeFormat(w, exe, s, s))
+	assert.ErrorIs(t, checkExeFormat(w, exe+".nonexistent", s, s), os.ErrNotExist)
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS], ident[elf.EI_DATA], ident[elf.EI_VERSION] = byte(elf.ELFCLASS64), byte(elf.ELFDATA2MSB), byte(elf.EV_CURRENT)
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, elf.Header64{
+		Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_S390), Version: uint32(elf.EV_CURRENT), Ehsize: 64,
+	}))
+	foreign := filepath.Join(t.TempDir(), "tool")
+	require.NoError(t, os.WriteFile(foreign, buf.Bytes(), 0o755))
+	require.NoError(t, checkExeFormat(w, foreign, s, "linux/s390x"))
+	var fe *exeFormatError
+	require.ErrorAs(t, checkExeFormat(w, foreign, "linux/"+runtime.GOARCH, "linux/"+runtime.GOARCH), &fe)
+	assert.Equal(t, "ELF s390x", fe.info.String())
+	require.ErrorAs(t, checkExeFormat(w, foreign, "windows/s390x", "windows/s390x"), &fe)
+
+	script := filepath.Join(t.TempDir(), "script")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755))
+	assert.NoError(t, checkExeFormat(w, script, s, s))
+}
@@ -0,0 +1,279 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/hashes"
+)
+
+// Reasons for matchers being unreachable.
+const (
+	unreachableShadowed  = "shadowed by earlier matchers"
+	unreachableUnmatched = "matches no OS/arch"
+)
+
+// explainRow is the resolution of URL and archive exe path matchers for an OS/arch.
+type explainRow struct {
+	osArch     string
+	fallback   string // fallback OS/arch the URL was selected for, if any
+	how        string // how the system can run the fallback
+	urlIdxs    []int  // selected URL match and its mirrors
+	exePathIdx int    // -1 if none
+	exePath    string
+}
+
+// unreachableMatcher is a matcher argument that is never selected for any OS/arch.
+type unreachableMatcher struct {
+	flag   string // flag name, url or archive-exe-path
+	idx    int    // index of the match in the flag's matches
+	arg    string
+	reason string
+}
+
+// explainOSArch resolves the URL and archive exe path matchers in cfg for an OS/arch.
+// Fallback OS/archs are resolved like in runs, see selectURLsWithFallbacks.
+func explainOSArch(cfg *rootCmdConfig, osArch string) (explainRow, error) {
+	row := explainRow{osArch: osArch}
+	selected, urls, how, err := selectURLsWithFallbacks(osArch, cfg)
+	if err != nil {
+		return row, err
+	}
+	if len(urls) != 0 && selected != osArch {
+		row.fallback, row.how = selected, how
+	}
+	if row.urlIdxs, err = selectURLMatches(selected, cfg.urlMatches); err != nil {
+		return row, err
+	}
+	row.exePathIdx, row.exePath, err = selectArchiveExePathMatch(selected, cfg.archiveExePathMatches)
+
+	return row, err
+}
+
+// explainOSArchs resolves the URL and archive exe path matchers in cfg for the given OS/archs.
+// If none are given, the ones known to Go are used,
+// along with their qualified variants that resolve differently from their unqualified ones.
+// Matchers never selected for any of the OS/archs are returned as unreachable.
+func explainOSArchs(cfg *rootCmdConfig, osArchs []string) ([]explainRow, []unreachableMatcher, error) {
+	all := len(osArchs) == 0
+	if all {
+		osArchs = knownOSArchVariants()
+	}
+	evaluated := make([]explainRow, 0, len(osArchs))
+	for _, osArch := range osArchs {
+		row, err := explainOSArch(cfg, osArch)
+		if err != nil {
+			return nil, nil, err
+		}
+		evaluated = append(evaluated, row)
+	}
+	rows := evaluated
+	if all {
+		rows = nil
+		bases := make(map[string]explainRow)
+		for _, row := range evaluated {
+			base := osArchBase(row.osArch)
+			if row.osArch == base {
+				bases[base] = row
+			} else if b := bases[base]; slices.Equal(row.urlIdxs, b.urlIdxs) && row.exePathIdx == b.exePathIdx && row.fallback == b.fallback {
+				continue
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	urlSelected := make([]bool, len(cfg.urlMatches))
+	exePathSelected := make([]bool, len(cfg.archiveExePathMatches))
+	for _, row := range evaluated {
+		for _, i := range row.urlIdxs {
+			urlSelected[i] = true
+		}
+		if row.exePathIdx != -1 {
+			exePathSelected[row.exePathIdx] = true
+		}
+	}
+	var unreachable []unreachableMatcher
+	for i, m := range cfg.urlMatches {
+		if !urlSelected[i] {
+			unreachable = append(unreachable, unreachableMatcher{
+				flag:   "url",
+				idx:    i,
+				arg:    fmt.Sprintf("--url=%s=%s", m.pattern, m.url.Redacted()),
+				reason: unreachableReason(evaluated, func(osArch string) (bool, error) { return matchOSArch(m.pattern, osArch) }),
+			})
+		}
+	}
+	for i, m := range cfg.archiveExePathMatches {
+		if !exePathSelected[i] {
+			unreachable = append(unreachable, unreachableMatcher{
+				flag:   "archive-exe-path",
+				idx:    i,
+				arg:    fmt.Sprintf("--archive-exe-path=%s=%s", m.pattern, m.exePath),
+				reason: unreachableReason(evaluated, func(osArch string) (bool, error) { return matchOSArch(m.pattern, osArch) }),
+			})
+		}
+	}
+
+	return rows, unreachable, nil
+}
+
+// unreachableReason describes why a matcher is never selected for the OS/archs in rows.
+func unreachableReason(rows []explainRow, match func(osArch string) (bool, error)) string {
+	for _, row := range rows {
+		if m, err := match(row.osArch); err == nil && m {
+			return unreachableShadowed
+		}
+	}
+
+	return unreachableUnmatched
+}
+
+// printExplanation writes a table of explain rows and the unreachable matchers to out.
+func printExplanation(out io.Writer, cfg *rootCmdConfig, rows []explainRow, unreachable []unreachableMatcher) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OS/ARCH\tVIA FALLBACK\tURL MATCHER\tURL\tDIGEST\tEXE PATH MATCHER\tEXE PATH")
+	for _, row := range rows {
+		fallback, urlPattern, ur, digest := "-", "-", "-", "-"
+		osArch := row.osArch
+		if row.fallback != "" {
+			fallback, osArch = fmt.Sprintf("%s (%s)", row.fallback, row.how), row.fallback
+		}
+		if len(row.urlIdxs) != 0 {
+			m := cfg.urlMatches[row.urlIdxs[0]]
+			u := *ociPlatformURL(m.url, osArch)
+			u.Fragment, u.RawFragment = "", ""
+			urlPattern, ur = m.pattern, u.Redacted()
+			if i := len(row.urlIdxs) - 1; i != 0 {
+				ur += fmt.Sprintf(" (+%d)", i)
+			}
+			if h, d, err := hashes.ParseHashFragment(m.url.Fragment); err != nil {
+				digest = "invalid"
+			} else if h != 0 {
+				digest = fmt.Sprintf("%s-%x", hashes.HashName(h), d)
+			}
+		}
+		exePattern, exePath := "-", "-"
+		if row.exePathIdx != -1 {
+			exePattern, exePath = cfg.archiveExePathMatches[row.exePathIdx].pattern, row.exePath
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.osArch, fallback, urlPattern, ur, digest, exePattern, exePath)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(unreachable) != 0 {
+		if _, err := fmt.Fprintln(out, "\nunreachable matchers:"); err != nil {
+			return err
+		}
+		for _, u := range unreachable {
+			if _, err := fmt.Fprintf(out, "%s: %s\n", u.arg, u.reason); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func explainCommand(w *Wrun) *cobra.Command {
+	var urlArgs, exePathArgs, extraPathArgs, fallbackArgs, osArchs []string
+	var archiveExtract string
+	cmd := &cobra.Command{
+		Use:   "explain [flags] [FILE...]",
+		Short: "explain URL and archive exe path selection for OS/archs",
+		Long: `explain URL and archive exe path selection for OS/archs
+
+The URL and archive related flags are taken from the command line, or parsed from args files as with ` + argsFileEnvVar + `.
+For each OS/arch, the selected URL, its digest, and the archive exe path are printed along with the matchers that selected them.
+The number of mirrors of a URL is shown in parentheses after it.
+If no URL matches an OS/arch, --os-arch-fallback OS/archs are resolved as in runs,
+and the one used is shown along with how the system can run it.
+Emulation is detected only for this system, so fallbacks to other archs are shown only for its OS.
+
+By default, OS/archs known to Go are explained, along with their libc and microarchitecture level variants that resolve differently.
+--os-arch can be used to give the OS/archs to explain instead.
+
+Matchers never selected for any of the OS/archs are reported as unreachable,
+either because they are shadowed by earlier ones, or because they match none.`,
+		Run: func(_ *cobra.Command, args []string) {
+			type explainee struct {
+				name string
+				cfg  *rootCmdConfig
+			}
+			var explainees []explainee
+			if len(urlArgs) != 0 {
+				baseDir, err := os.Getwd()
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esError)
+				}
+				cfg := &rootCmdConfig{archiveExtract: archiveExtract, baseDir: baseDir}
+				if err = parseFlags(cfg, urlArgs, exePathArgs, extraPathArgs, fallbackArgs); err != nil {
+					w.LogError("%v", err)
+					os.Exit(esUsage)
+				}
+				explainees = append(explainees, explainee{"command line", cfg})
+			}
+			for _, argsFile := range args {
+				cfg, err := parseArgsFile(w, argsFile)
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esUsage)
+				}
+				explainees = append(explainees, explainee{argsFile, cfg})
+			}
+			if len(explainees) == 0 {
+				w.LogError("no URLs or args files given")
+				os.Exit(esUsage)
+			}
+
+			for i, e := range explainees {
+				rows, unreachable, err := explainOSArchs(e.cfg, osArchs)
+				if err != nil {
+					w.LogError("%s: %v", e.name, err)
+					os.Exit(esUsage)
+				}
+				if len(explainees) > 1 {
+					if i != 0 {
+						fmt.Println()
+					}
+					fmt.Printf("%s:\n", e.name)
+				}
+				if err = printExplanation(os.Stdout, e.cfg, rows, unreachable); err != nil {
+					w.LogError("%v", err)
+					os.Exit(esError)
+				}
+			}
+		},
+	}
+	fs := cmd.Flags()
+	fs.StringSliceVarP(&urlArgs, "url", "u", nil, "[OS/arch=]URL matcher")
+	fs.StringSliceVarP(&exePathArgs, "archive-exe-path", "p", nil, "[OS/arch=]path to executable within archive matcher")
+	fs.StringVar(&archiveExtract, "archive-extract", archiveExtractAll, "archive extraction mode")
+	fs.StringSliceVar(&extraPathArgs, "archive-extra-path", nil, "[OS/arch=]path to extract from archive in addition to executable")
+	fs.StringSliceVar(&fallbackArgs, "os-arch-fallback", nil, "[OS/arch=]OS/arch to fall back to if no URL matches")
+	fs.StringSliceVar(&osArchs, "os-arch", nil, "OS/archs to explain, default ones known to Go")
+
+	return cmd
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_explainOSArchs(t *testing.T) {
+	cfg := &rootCmdConfig{}
+	err := parseFlags(cfg,
+		[]string{
+			"linux/*=https://example.com/linux",
+			"linux/amd64=https://example.com/linux-amd64",
+			"windows/*=https://example.com/windows#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"windows/*=https://mirror.example.com/windows#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"plan9/*=https://example.com/plan9",
+		},
+		[]string{
+			"*/*=tool",
+			"windows/amd64=tool2",
+		},
+		nil, nil)
+	require.NoError(t, err)
+
+	rows, unreachable, err := explainOSArchs(cfg, []string{"linux/amd64", "windows/arm64", "darwin/arm64"})
+	require.NoError(t, err)
+	assert.Equal(t, []explainRow{
+		{osArch: "linux/amd64", urlIdxs: []int{0}, exePathIdx: 0, exePath: "tool"},
+		{osArch: "windows/arm64", urlIdxs: []int{2, 3}, exePathIdx: 0, exePath: "tool.exe"},
+		{osArch: "darwin/arm64", urlIdxs: nil, exePathIdx: 0, exePath: "tool"},
+	}, rows)
+	assert.Equal(t, []unreachableMatcher{
+		{flag: "url", idx: 1, arg: "--url=linux/amd64=https://example.com/linux-amd64", reason: "shadowed by earlier matchers"},
+		{flag: "url", idx: 4, arg: "--url=plan9/*=https://example.com/plan9", reason: "matches no OS/arch"},
+		{flag: "archive-exe-path", idx: 1, arg: "--archive-exe-path=windows/amd64=tool2", reason: "matches no OS/arch"},
+	}, unreachable)
+}
+
+func Test_explainOSArchs_variants(t *testing.T) {
+	cfg := &rootCmdConfig{}
+	err := parseFlags(cfg,
+		[]string{
+			"linux/amd64/musl=https://example.com/linux-amd64-musl",
+			"linux/amd64/v3/gnu=https://example.com/linux-amd64-v3-gnu",
+			"*/*=https://example.com/default",
+		},
+		nil, nil, nil)
+	require.NoError(t, err)
+
+	rows, unreachable, err := explainOSArchs(cfg, nil)
+	require.NoError(t, err)
+	assert.Empty(t, unreachable)
+	var osArchs []string
+	for _, row := range rows {
+		osArchs = append(osArchs, row.osArch)
+	}
+	assert.Contains(t, osArchs, "linux/amd64")
+	assert.Contains(t, osArchs, "linux/amd64/musl")
+	assert.Contains(t, osArchs, "linux/amd64/v3/gnu")
+	assert.Contains(t, osArchs, "linux/amd64/v4/gnu")
+	assert.NotContains(t, osArchs, "linux/amd64/gnu")
+	assert.NotContains(t, osArchs, "linux/amd64/v3")
+}
+
+func Test_explainOSArchs_fallbacks(t *testing.T) {
+	cfg := &rootCmdConfig{}
+	err := parseFlags(cfg,
+		[]string{"linux/amd64&!linux/amd64/v3=https://example.com/baseline"},
+		[]string{"linux/amd64/v2=tool-v2", "*/*=tool"},
+		nil,
+		[]string{"linux/amd64/v3=linux/amd64/v2", "linux/amd64/musl=linux/amd64/gnu"})
+	require.NoError(t, err)
+
+	rows, unreachable, err := explainOSArchs(cfg, []string{"linux/amd64/v3", "linux/amd64/v1/musl"})
+	require.NoError(t, err)
+	assert.Empty(t, unreachable)
+	assert.Equal(t, []explainRow{
+		{osArch: "linux/amd64/v3", fallback: "linux/amd64/v2", how: "native", urlIdxs: []int{0}, exePathIdx: 0, exePath: "tool-v2"},
+		{osArch: "linux/amd64/v1/musl", urlIdxs: []int{0}, exePathIdx: 1, exePath: "tool"},
+	}, rows)
+
+	var buf bytes.Buffer
+	require.NoError(t, printExplanation(&buf, cfg, rows, unreachable))
+	assert.Contains(t, buf.String(), "linux/amd64/v3       linux/amd64/v2 (native)  linux/amd64&!linux/amd64/v3")
+}
+
+func Test_printExplanation(t *testing.T) {
+	cfg := &rootCmdConfig{}
+	err := parseFlags(cfg,
+		[]string{
+			"linux/*=https://example.com/linux#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"linux/*=https://mirror.example.com/linux#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"linux/arm64=https://example.com/linux-arm64",
+		},
+		nil, nil, nil)
+	require.NoError(t, err)
+
+	rows, unreachable, err := explainOSArchs(cfg, []string{"linux/arm64", "darwin/arm64"})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, printExplanation(&buf, cfg, rows, unreachable))
+	assert.Equal(t, `OS/ARCH       VIA FALLBACK  URL MATCHER  URL                             DIGEST                                                                   EXE PATH MATCHER  EXE PATH
+linux/arm64   -             linux/*      https://example.com/linux (+1)  sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  -                 -
+darwin/arm64  -             -            -                               -                                                                        -                 -
+
+unreachable matchers:
+--url=linux/arm64=https://example.com/linux-arm64: shadowed by earlier matchers
+`, buf.String())
+}
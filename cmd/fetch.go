@@ -0,0 +1,323 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/scop/wrun/internal/hashes"
+	"github.com/scop/wrun/internal/policy"
+)
+
+const (
+	fetchStatusHit        = "hit"
+	fetchStatusDownloaded = "downloaded"
+	fetchStatusFailed     = "failed"
+
+	defaultFetchJobs = 4
+)
+
+// parseArgsFile parses the URL and archive related flags in an args file.
+// Other flags and arguments in it are ignored.
+// Relative local paths are resolved against the args file's directory.
+func parseArgsFile(w *Wrun, argsFile string) (*rootCmdConfig, error) {
+	args, err := readArgsFile(w, argsFile)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseArgsFileFlags(argsFile, args)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &rootCmdConfig{archiveExtract: f.archiveExtract, baseDir: f.baseDir}
+	if err = parseFlags(cfg, f.urlArgs, f.exePathArgs, f.extraPathArgs, f.fallbackArgs); err != nil {
+		return nil, fmt.Errorf("%s: %w", argsFile, err)
+	}
+
+	return cfg, nil
+}
+
+// argsFileFlags are the URL and archive related flags in an args file, not yet parsed further.
+type argsFileFlags struct {
+	baseDir                                           string
+	urlArgs, exePathArgs, extraPathArgs, fallbackArgs []string
+	archiveExtract                                    string
+}
+
+// parseArgsFileFlags parses the URL and archive related flags from args read from argsFile, ignoring others.
+func parseArgsFileFlags(argsFile string, args []string) (*argsFileFlags, error) {
+	baseDir, err := filepath.Abs(filepath.Dir(argsFile))
+	if err != nil {
+		return nil, err
+	}
+	f := &argsFileFlags{baseDir: baseDir}
+	fs := pflag.NewFlagSet(argsFile, pflag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	fs.StringSliceVarP(&f.urlArgs, "url", "u", nil, "")
+	fs.StringSliceVarP(&f.exePathArgs, "archive-exe-path", "p", nil, "")
+	fs.StringVar(&f.archiveExtract, "archive-extract", archiveExtractAll, "")
+	fs.StringSliceVar(&f.extraPathArgs, "archive-extra-path", nil, "")
+	fs.StringSliceVar(&f.fallbackArgs, "os-arch-fallback", nil, "")
+	if err = fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%s: %w", argsFile, err)
+	}
+
+	return f, nil
+}
+
+// fetchTarget is a cache entry to fetch for an args file and OS/archs.
+type fetchTarget struct {
+	argsFile string
+	osArchs  []string
+	spec     cacheEntrySpec
+}
+
+// osArchString gets a short description of the target's OS/archs.
+func (t fetchTarget) osArchString() string {
+	if len(t.osArchs) == 1 {
+		return t.osArchs[0]
+	}
+
+	return fmt.Sprintf("%s (+%d)", t.osArchs[0], len(t.osArchs)-1)
+}
+
+// fetchTargets resolves the cache entries to fetch for cfg from argsFile for osArchs.
+// OS/archs with no matching URL are skipped if skipUnmatched is true, and an error otherwise after trying fallbacks.
+// Entries are deduplicated across OS/archs.
+func fetchTargets(argsFile string, cfg *rootCmdConfig, osArchs []string, skipUnmatched bool, base cacheEntrySpec) ([]fetchTarget, error) {
+	var targets []fetchTarget
+	seen := make(map[string]int)
+	for _, osArch := range osArchs {
+		var urls []*url.URL
+		var err error
+		if skipUnmatched {
+			urls, err = selectURLs(osArch, cfg.urlMatches)
+		} else {
+			osArch, urls, _, err = selectURLsWithFallbacks(osArch, cfg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: select URL: %w", argsFile, err)
+		}
+		if len(urls) == 0 {
+			if skipUnmatched {
+				continue
+			}
+
+			return nil, fmt.Errorf("%s: no URL available for OS/architecture %s", argsFile, osArch)
+		}
+		archiveExePath, err := selectArchiveExePath(osArch, cfg.archiveExePathMatches)
+		if err != nil {
+			return nil, fmt.Errorf("%s: select archive exe path: %w", argsFile, err)
+		}
+		var extractPaths []string
+		if archiveExePath != "" && cfg.archiveExtract == archiveExtractExe {
+			extraPaths, err := selectArchiveExtraPaths(osArch, cfg.archiveExtraPathMatches)
+			if err != nil {
+				return nil, fmt.Errorf("%s: select archive extra paths: %w", argsFile, err)
+			}
+			extractPaths = append([]string{archiveExePath}, extraPaths...)
+		}
+		ur := urls[0]
+		var keyParts []string
+		for _, u := range urls {
+			keyParts = append(keyParts, u.String())
+		}
+		key := strings.Join(append(append(keyParts, archiveExePath), extractPaths...), "\x00")
+		if i, found := seen[key]; found {
+			targets[i].osArchs = append(targets[i].osArchs, osArch)
+
+			continue
+		}
+		seen[key] = len(targets)
+		h, digest, err := hashes.ParseHashFragment(ur.Fragment)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: parse hash fragment: %w", argsFile, ur, err)
+		}
+		spec := base
+		spec.url, spec.mirrors, spec.h, spec.digest = ur, urls[1:], h, digest
+		spec.archiveExePath, spec.extractPaths = archiveExePath, extractPaths
+		targets = append(targets, fetchTarget{argsFile, []string{osArch}, spec})
+	}
+
+	return targets, nil
+}
+
+// fetch sets up the cache entry for spec unless it is in the cache or a cache layer already,
+// and returns the fetch status.
+func fetch(w *Wrun, pol policy.Policy, spec cacheEntrySpec) (string, error) {
+	var err error
+	if spec.mirrors, err = checkDownloadURLs(w, pol, spec.proxyURL, spec.url, spec.mirrors); err != nil {
+		return fetchStatusFailed, err
+	}
+	if spec.h != 0 {
+		for _, layer := range resolveCacheLayers() {
+			if _, err := cacheLayerExePath(layer, spec.h, spec.digest, spec.archiveExePath, spec.extractPaths); err == nil {
+				return fetchStatusHit, nil
+			}
+		}
+	}
+	entryDir, urlEntryDir := spec.entryDirs()
+	if content, ok := cacheEntryContent(entryDir); ok {
+		if fi, err := os.Stat(entryExePath(entryDir, content, spec.archiveExePath)); err == nil && fi.Mode().IsRegular() {
+			if entryDir != urlEntryDir {
+				linkURLEntry(w, urlEntryDir, entryDir)
+			}
+
+			return fetchStatusHit, nil
+		}
+	}
+	if _, err := downloadCacheEntry(w, spec); err != nil {
+		return fetchStatusFailed, err
+	}
+
+	return fetchStatusDownloaded, nil
+}
+
+// fetchAll fetches targets using the given number of concurrent jobs, and returns the statuses in targets' order.
+func fetchAll(w *Wrun, pol policy.Policy, targets []fetchTarget, jobs int) []string {
+	statuses := make([]string, len(targets))
+	jobs = max(jobs, 1)
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				status, err := fetch(w, pol, targets[i].spec)
+				if err != nil {
+					w.LogError("fetch %s for %s: %v", targets[i].argsFile, targets[i].osArchString(), err)
+				}
+				statuses[i] = status
+			}
+		}()
+	}
+	for i := range targets {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	return statuses
+}
+
+// printFetchSummary writes a summary table of fetch results to out.
+func printFetchSummary(out io.Writer, targets []fetchTarget, statuses []string) error {
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tOS/ARCH\tSTATUS\tURL")
+	for i, t := range targets {
+		counts[statuses[i]]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.argsFile, t.osArchString(), statuses[i], t.spec.url)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d hits, %d downloaded, %d failed\n",
+		counts[fetchStatusHit], counts[fetchStatusDownloaded], counts[fetchStatusFailed])
+
+	return err
+}
+
+func fetchCommand(w *Wrun) *cobra.Command {
+	var allOSArch bool
+	var jobs int
+	cmd := &cobra.Command{
+		Use:   "fetch [flags] FILE...",
+		Short: "fetch executables in args files to the cache",
+		Long: `fetch executables in args files to the cache
+
+Args files are parsed for URL and archive related flags as with ` + argsFileEnvVar + `, and the matching executables are fetched to the cache concurrently.
+By default, the current OS/arch is matched, --all-os-arch fetches ones for all OS/archs known to Go, and their libc and microarchitecture level variants.
+
+A summary table of cache hits, downloads, and failures is printed at the end.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			pol, err := resolvePolicy()
+			if err != nil {
+				w.LogError("download policy: %v", err)
+				os.Exit(esUsage)
+			}
+			w.setPolicy(pol)
+			cacheHome, err := resolveCacheHome()
+			if err != nil {
+				w.LogError("cache setup: %v", err)
+				os.Exit(esError)
+			}
+			autoMigrateCache(w, cacheHome)
+			base := cacheEntrySpec{cacheDir: filepath.Join(cacheHome, cacheVersion)}
+			var errs []error
+			if base.remoteCache, err = resolveRemoteCache(); err != nil {
+				errs = append(errs, err)
+			}
+			if base.proxyURL, err = resolveProxyURL(); err != nil {
+				errs = append(errs, err)
+			}
+			if base.limits, err = resolveExtractLimits(); err != nil {
+				errs = append(errs, err)
+			}
+			if err = errors.Join(errs...); err != nil {
+				w.LogError("cache setup: %v", err)
+				os.Exit(esUsage)
+			}
+
+			osArchs := []string{resolveOSArch()}
+			if allOSArch {
+				osArchs = knownOSArchVariants()
+			}
+			var targets []fetchTarget
+			for _, argsFile := range args {
+				cfg, err := parseArgsFile(w, argsFile)
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esUsage)
+				}
+				ts, err := fetchTargets(argsFile, cfg, osArchs, allOSArch, base)
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esUsage)
+				}
+				targets = append(targets, ts...)
+			}
+
+			statuses := fetchAll(w, pol, targets, jobs)
+			if err = printFetchSummary(os.Stdout, targets, statuses); err != nil {
+				w.LogError("%v", err)
+			}
+			for _, status := range statuses {
+				if status == fetchStatusFailed {
+					os.Exit(esError)
+				}
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&allOSArch, "all-os-arch", false, "fetch for all OS/archs")
+	cmd.Flags().IntVarP(&jobs, "jobs", "j", defaultFetchJobs, "number of concurrent fetches")
+
+	return cmd
+}
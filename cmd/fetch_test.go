@@ -0,0 +1,135 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/policy"
+)
+
+func Test_fetch(t *testing.T) {
+	w := NewWrun("wrun-test")
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(rw, r)
+
+			return
+		}
+		_, _ = rw.Write([]byte("tool for " + r.URL.Path))
+	}))
+	defer srv.Close()
+	linuxDigest := sha256.Sum256([]byte("tool for /linux"))
+
+	argsFile := filepath.Join(t.TempDir(), "args")
+	require.NoError(t, os.WriteFile(argsFile, []byte(fmt.Sprintf(`# tool
+--url=linux/amd64=%[1]s/linux#sha256-%[2]x
+--url=linux/*=%[1]s/linux#sha256-%[2]x
+--url=darwin/*=%[1]s/darwin
+--url=windows/amd64=%[1]s/missing
+--unknown-flag
+`, srv.URL, linuxDigest)), 0o666))
+	cfg, err := parseArgsFile(w, argsFile)
+	require.NoError(t, err)
+
+	base := cacheEntrySpec{cacheDir: t.TempDir(), limits: archives.DefaultLimits}
+	targets, err := fetchTargets(argsFile, cfg, knownOSArchs(), true, base)
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+	for _, target := range targets {
+		if target.spec.url.Path == "/linux" {
+			assert.Greater(t, len(target.osArchs), 1, "linux ones deduplicated")
+		}
+	}
+
+	_, err = fetchTargets(argsFile, cfg, []string{"plan9/386"}, false, base)
+	require.Error(t, err)
+
+	statuses := fetchAll(w, policy.Policy{}, targets, 2)
+	assert.Equal(t, []string{fetchStatusDownloaded, fetchStatusFailed, fetchStatusDownloaded}, sortedByOSArch(targets, statuses))
+
+	statuses = fetchAll(w, policy.Policy{}, targets, 2)
+	assert.Equal(t, []string{fetchStatusHit, fetchStatusFailed, fetchStatusHit}, sortedByOSArch(targets, statuses))
+
+	var out bytes.Buffer
+	require.NoError(t, printFetchSummary(&out, targets, statuses))
+	assert.Contains(t, out.String(), "2 hits, 0 downloaded, 1 failed\n")
+}
+
+// sortedByOSArch gets statuses for darwin, windows, and linux targets, in that order.
+func sortedByOSArch(targets []fetchTarget, statuses []string) []string {
+	res := make([]string, 3)
+	for i, t := range targets {
+		switch t.spec.url.Path {
+		case "/darwin":
+			res[0] = statuses[i]
+		case "/missing":
+			res[1] = statuses[i]
+		case "/linux":
+			res[2] = statuses[i]
+		}
+	}
+
+	return res
+}
+
+func Test_fetch_extractPaths(t *testing.T) {
+	w := NewWrun("wrun-test")
+	archive := testTarGz(t, "bin/tool", "archived tool")
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write(archive)
+	}))
+	defer srv.Close()
+	digest := sha256.Sum256(archive)
+
+	full := cacheEntrySpec{
+		url:            mustParseURL(t, fmt.Sprintf("%s/tool.tar.gz#sha256-%x", srv.URL, digest)),
+		h:              crypto.SHA256,
+		digest:         digest[:],
+		archiveExePath: "bin/tool",
+		limits:         archives.DefaultLimits,
+		cacheDir:       t.TempDir(),
+	}
+	exeOnly := full
+	exeOnly.extractPaths = []string{"bin/tool"}
+	fullDir, _ := full.entryDirs()
+	exeOnlyDir, _ := exeOnly.entryDirs()
+	assert.NotEqual(t, fullDir, exeOnlyDir)
+
+	for _, spec := range []cacheEntrySpec{full, exeOnly} {
+		status, err := fetch(w, policy.Policy{}, spec)
+		require.NoError(t, err)
+		assert.Equal(t, fetchStatusDownloaded, status)
+	}
+	for _, spec := range []cacheEntrySpec{full, exeOnly} {
+		status, err := fetch(w, policy.Policy{}, spec)
+		require.NoError(t, err)
+		assert.Equal(t, fetchStatusHit, status, "entries for different extract paths replaced each other")
+	}
+}
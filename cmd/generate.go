@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"fmt"
 	"hash"
+	"io"
 	"net/url"
 	"path"
 	"slices"
@@ -31,6 +32,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/scop/wrun/internal/checksums"
+	"github.com/scop/wrun/internal/exeformat"
 	"github.com/scop/wrun/internal/files"
 )
 
@@ -51,68 +53,88 @@ func generateCommand(w *Wrun) *cobra.Command {
 	return genCmd
 }
 
-func processGenerateAsset(w *Wrun, ur, tool string, hsh hash.Hash, csums checksums.Checksums) (digest []byte, exePath string, err error) {
+// generatedAsset is the result of processing an asset for generation.
+type generatedAsset struct {
+	digest  []byte
+	exePath string
+	format  exeformat.Info // of the executable, the asset itself if not an archive
+}
+
+func processGenerateAsset(w *Wrun, ur, tool string, hsh hash.Hash, csums checksums.Checksums) (ga generatedAsset, err error) {
 	resp, err := w.HTTPGet(ur)
 	if err != nil {
-		return nil, "", err
+		return ga, err
 	}
 
 	tmpf, cleanUpTempFile, err := w.SetUpTempfile(ur, "")
 	if err != nil {
-		return nil, "", fmt.Errorf("set up tempfile: %w", err)
+		return ga, fmt.Errorf("set up tempfile: %w", err)
 	}
 
 	if err = w.Download(resp, tmpf, hsh, nil); err != nil {
 		cleanUpTempFile()
 
-		return nil, "", fmt.Errorf("download: %w", err)
+		return ga, fmt.Errorf("download: %w", err)
 	}
-	digest = hsh.Sum(nil)
+	ga.digest = hsh.Sum(nil)
 	hsh.Reset()
 
-	exePath, err = findToolInArchive(tmpf.Name(), tool)
-	cleanUpTempFile()
+	ga.exePath, ga.format, err = findToolInArchive(tmpf.Name(), tool)
 	if err != nil {
 		if !strings.Contains(err.Error(), "format unrecognized by filename") { // No better way as of archiver 3.5.1
 			w.LogError("find tool in archive: %v", err)
+		} else if ga.format, err = exeformat.Inspect(tmpf.Name()); err != nil {
+			w.LogWarn("inspect executable format of %q: %v", ur, err)
 		}
 	}
+	cleanUpTempFile()
 
 	if len(csums.Entries) != 0 {
 		u, err := url.Parse(ur)
 		if err != nil {
-			return nil, "", fmt.Errorf("parse download URL %q for digest verification: %w", ur, err)
+			return ga, fmt.Errorf("parse download URL %q for digest verification: %w", ur, err)
 		}
 		fn := path.Base(u.Path)
 		candidateFound := false
 		matchFound := false
 		if cs := csums.Get(fn); cs != nil {
 			for _, ce := range cs {
-				if len(ce.Digest) == len(digest) {
+				if len(ce.Digest) == len(ga.digest) {
 					candidateFound = true
-					if bytes.Equal(ce.Digest, digest) {
+					if bytes.Equal(ce.Digest, ga.digest) {
 						w.LogInfo("digest match for %q: %x", ur, ce.Digest)
 						matchFound = true
 
 						break
 					}
-					w.LogInfo("digest candidate for %q mismatch: expected %x, have %x", ur, ce.Digest, digest)
+					w.LogInfo("digest candidate for %q mismatch: expected %x, have %x", ur, ce.Digest, ga.digest)
 				} else {
-					w.LogInfo("digest candidate for %q skipped due to length mismatch: %x, have %x", ur, ce.Digest, digest)
+					w.LogInfo("digest candidate for %q skipped due to length mismatch: %x, have %x", ur, ce.Digest, ga.digest)
 				}
 			}
 		}
 		if !candidateFound {
 			w.LogWarn("no upstream digest for %q", ur)
 		} else if !matchFound {
-			return nil, "", fmt.Errorf("no digest match for %q", ur)
+			return ga, fmt.Errorf("no digest match for %q", ur)
 		}
 	}
 
-	return digest, exePath, nil
+	return ga, nil
 }
 
-func findToolInArchive(filename, toolExe string) (path string, err error) {
+// maxInspectSize is the maximum size of executables in archives to inspect the format of.
+const maxInspectSize = 256 << 20
+
+// warnExeFormat warns if an executable of the given format from ur is not for osArch.
+func warnExeFormat(w *Wrun, ur, osArch string, format exeformat.Info) {
+	if !exeFormatMatches(format, osArch) {
+		w.LogWarn("executable format %s in %q does not match OS/arch %s, asset may be mislabelled", format, ur, osArch)
+	}
+}
+
+// findToolInArchive finds toolExe in archive filename, and inspects its format.
+func findToolInArchive(filename, toolExe string) (path string, format exeformat.Info, err error) {
 	// TODO maybe if there's just one file in the archive, use it despite of tool name match?
 	err = archiver.Walk(filename, func(f archiver.File) error {
 		if !f.IsDir() && f.Name() == toolExe {
@@ -125,6 +147,16 @@ func findToolInArchive(filename, toolExe string) (path string, err error) {
 			default:
 				return fmt.Errorf("unsupported file header: %T", f.Header)
 			}
+			format = exeformat.Info{}
+			if f.Size() <= maxInspectSize {
+				data, err := io.ReadAll(f)
+				if err != nil {
+					return fmt.Errorf("read %s: %w", path, err)
+				}
+				if format, err = exeformat.InspectReader(bytes.NewReader(data)); err != nil {
+					format = exeformat.Info{}
+				}
+			}
 			// Prefer executables over others
 			if files.HasExecutablePerms(f) {
 				return archiver.ErrStopWalk
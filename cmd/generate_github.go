@@ -232,11 +232,12 @@ func runGenerateGitHubProject(w *Wrun, owner, project, tool, version string, osA
 	for osArch := range osArchAssets {
 		osArchs = append(osArchs, osArch)
 	}
-	slices.Sort(osArchs)
+	slices.SortFunc(osArchs, compareOSArchs)
 
 	exePaths := make(map[string]string, len(osArchs))
 
 	hsh := crypto.SHA256.New()
+	processed := make(map[string]generatedAsset, len(osArchs)) // same asset may be preferred for multiple OS/arch variants
 	for _, osArch := range osArchs {
 		asset := osArchAssets[osArch]
 		if asset.State != github.ReleaseAssetStateUploaded {
@@ -244,22 +245,25 @@ func runGenerateGitHubProject(w *Wrun, owner, project, tool, version string, osA
 			return fmt.Errorf("asset with download URL %q state %q, expected %q", asset.BrowserDownloadURL, asset.State, github.ReleaseAssetStateUploaded)
 		}
 
-		var digest []byte
-		var exePath string
-		var toolExe string
-		if strings.HasPrefix(osArch, "windows/") {
-			toolExe = tool + ".exe"
-		} else {
-			toolExe = tool
-		}
-		if digest, exePath, err = processGenerateAsset(w, asset.BrowserDownloadURL, toolExe, hsh, csums); err != nil {
-			return err
+		ga, found := processed[asset.BrowserDownloadURL]
+		if !found {
+			var toolExe string
+			if strings.HasPrefix(osArch, "windows/") {
+				toolExe = tool + ".exe"
+			} else {
+				toolExe = tool
+			}
+			if ga, err = processGenerateAsset(w, asset.BrowserDownloadURL, toolExe, hsh, csums); err != nil {
+				return err
+			}
+			processed[asset.BrowserDownloadURL] = ga
 		}
+		warnExeFormat(w, asset.BrowserDownloadURL, osArch, ga.format)
 
-		if exePath != "" {
-			exePaths[osArch] = exePath
+		if ga.exePath != "" {
+			exePaths[osArch] = ga.exePath
 		}
-		fmt.Printf("--url=%s=%s#sha256-%x\n", osArch, asset.BrowserDownloadURL, digest)
+		fmt.Printf("--url=%s=%s#sha256-%x\n", osArch, asset.BrowserDownloadURL, ga.digest)
 	}
 
 	for _, ep := range generateExePathArgs(exePaths) {
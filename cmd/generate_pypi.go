@@ -146,10 +146,11 @@ func runGeneratePyPIProject(w *Wrun, project, tool, version string) error {
 	for osArch := range osArchFiles {
 		osArchs = append(osArchs, osArch)
 	}
-	slices.Sort(osArchs)
+	slices.SortFunc(osArchs, compareOSArchs)
 
 	hshType := crypto.SHA256
 	hsh := hshType.New()
+	processed := make(map[string]generatedAsset, len(osArchs)) // same file may be preferred for multiple OS/archs
 	for _, osArch := range osArchs {
 		pf := osArchFiles[osArch]
 		if pf.URL == "" {
@@ -162,6 +163,15 @@ func runGeneratePyPIProject(w *Wrun, project, tool, version string) error {
 
 			continue
 		}
+		if ga, found := processed[pf.URL]; found {
+			if ga.exePath != "" {
+				exePaths[osArch] = ga.exePath
+			}
+			warnExeFormat(w, pf.URL, osArch, ga.format)
+			fmt.Printf("--url=%s=%s#sha256-%s\n", osArch, pf.URL, pf.Hashes.SHA256)
+
+			continue
+		}
 		expectedDigest, err := hex.DecodeString(pf.Hashes.SHA256)
 		if err != nil {
 			return fmt.Errorf("decode hex digest: %w", err)
@@ -186,7 +196,7 @@ func runGeneratePyPIProject(w *Wrun, project, tool, version string) error {
 		if strings.HasPrefix(osArch, "windows/") {
 			toolExe += ".exe"
 		}
-		exePath, err := findToolInArchive(tmpf.Name(), toolExe)
+		exePath, format, err := findToolInArchive(tmpf.Name(), toolExe)
 		cleanupTempfile()
 		if err != nil {
 			if !strings.Contains(err.Error(), "format unrecognized by filename") { // No better way as of archiver 3.5.1
@@ -195,6 +205,8 @@ func runGeneratePyPIProject(w *Wrun, project, tool, version string) error {
 		} else {
 			exePaths[osArch] = exePath
 		}
+		processed[pf.URL] = generatedAsset{exePath: exePath, format: format}
+		warnExeFormat(w, pf.URL, osArch, format)
 		hsh.Reset()
 
 		fmt.Printf("--url=%s=%s#sha256-%s\n", osArch, pf.URL, pf.Hashes.SHA256)
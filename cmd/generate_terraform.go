@@ -100,12 +100,13 @@ func runGenerateTerraform(w *Wrun, version string) error {
 	for osArch := range osArchEntries {
 		osArchs = append(osArchs, osArch)
 	}
-	slices.Sort(osArchs)
+	slices.SortFunc(osArchs, compareOSArchs)
 
 	exePaths := make(map[string]string, len(osArchs))
 
 	const tool = "terraform"
 	hsh := crypto.SHA256.New()
+	processed := make(map[string]generatedAsset, len(osArchs)) // same asset may be preferred for multiple OS/arch variants
 
 	for _, osArch := range osArchs {
 		var toolExe string
@@ -119,17 +120,20 @@ func runGenerateTerraform(w *Wrun, version string) error {
 		for _, e := range entries {
 			u := baseURL + "/" + url.PathEscape(e.Filename)
 
-			var digest []byte
-			var exePath string
-			var err error
-			if digest, exePath, err = processGenerateAsset(w, u, toolExe, hsh, csums); err != nil {
-				return err
+			ga, found := processed[u]
+			if !found {
+				var err error
+				if ga, err = processGenerateAsset(w, u, toolExe, hsh, csums); err != nil {
+					return err
+				}
+				processed[u] = ga
 			}
+			warnExeFormat(w, u, osArch, ga.format)
 
-			if exePath != "" {
-				exePaths[osArch] = exePath
+			if ga.exePath != "" {
+				exePaths[osArch] = ga.exePath
 			}
-			fmt.Printf("--url=%s=%s#sha256-%x\n", osArch, u, digest)
+			fmt.Printf("--url=%s=%s#sha256-%x\n", osArch, u, ga.digest)
 		}
 	}
 
@@ -0,0 +1,94 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"debug/elf"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/scop/wrun/internal/files"
+)
+
+// libcProbeExe is the executable whose dynamic loader is used to detect the system libc.
+// wrun itself is typically statically linked, so it cannot be used for this.
+const libcProbeExe = "/bin/sh"
+
+// detectLibc detects the libc in use on the system, or returns the empty string if unknown or not applicable.
+func detectLibc() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	if interp, err := elfInterpreter(libcProbeExe); err == nil {
+		if libc := libcFromLoader(interp); libc != "" {
+			return libc
+		}
+	}
+	// ldd exits non-zero on musl for --version, so look at the output only
+	out, _ := exec.Command("ldd", "--version").CombinedOutput()
+
+	return libcFromLddVersion(string(out))
+}
+
+// elfInterpreter gets the program interpreter, i.e. dynamic loader, of an ELF executable.
+func elfInterpreter(exe string) (string, error) {
+	f, err := elf.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err = prog.ReadAt(data, 0); err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(data), "\x00"), nil
+	}
+
+	return "", nil
+}
+
+// libcFromLoader gets the libc corresponding to a dynamic loader path, or the empty string if unknown.
+func libcFromLoader(loader string) string {
+	base := path.Base(loader)
+	switch {
+	case strings.HasPrefix(base, "ld-musl-"):
+		return files.LibcMusl
+	case strings.HasPrefix(base, "ld-linux"), strings.HasPrefix(base, "ld64.so."), strings.HasPrefix(base, "ld.so."):
+		return files.LibcGNU
+	}
+
+	return ""
+}
+
+// libcFromLddVersion gets the libc corresponding to `ldd --version` output, or the empty string if unknown.
+func libcFromLddVersion(out string) string {
+	switch lower := strings.ToLower(out); {
+	case strings.Contains(lower, "musl"):
+		return files.LibcMusl
+	case strings.Contains(lower, "gnu libc"), strings.Contains(lower, "glibc"):
+		return files.LibcGNU
+	}
+
+	return ""
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/scop/wrun/internal/files"
+)
+
+func Test_libcFromLoader(t *testing.T) {
+	tests := []struct {
+		loader string
+		want   string
+	}{
+		{"/lib/ld-musl-x86_64.so.1", files.LibcMusl},
+		{"/lib/ld-musl-aarch64.so.1", files.LibcMusl},
+		{"/lib64/ld-linux-x86-64.so.2", files.LibcGNU},
+		{"/lib/ld-linux-aarch64.so.1", files.LibcGNU},
+		{"/lib/ld-linux-armhf.so.3", files.LibcGNU},
+		{"/lib64/ld64.so.2", files.LibcGNU},
+		{"/system/bin/linker64", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.loader, func(t *testing.T) {
+			assert.Equal(t, tt.want, libcFromLoader(tt.loader))
+		})
+	}
+}
+
+func Test_libcFromLddVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{"glibc", "ldd (Debian GLIBC 2.36-9+deb12u4) 2.36\nCopyright (C) 2022 Free Software Foundation, Inc.\n", files.LibcGNU},
+		{"gnu libc", "ldd (GNU libc) 2.39\n", files.LibcGNU},
+		{"musl", "musl libc (x86_64)\nVersion 1.2.4\nDynamic Program Loader\n", files.LibcMusl},
+		{"unknown", "ldd: not found\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, libcFromLddVersion(tt.out))
+		})
+	}
+}
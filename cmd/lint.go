@@ -0,0 +1,361 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/hashes"
+)
+
+// Lint check names.
+const (
+	lintCheckArgs          = "args"
+	lintCheckMatcher       = "matcher"
+	lintCheckURL           = "url"
+	lintCheckDigest        = "digest"
+	lintCheckDigestLength  = "digest-length"
+	lintCheckDuplicate     = "duplicate"
+	lintCheckShadowed      = "shadowed"
+	lintCheckUnmatched     = "unmatched"
+	lintCheckMissingOSArch = "missing-os-arch"
+	lintCheckNonArchive    = "non-archive"
+
+	lintFormatText = "text"
+	lintFormatJSON = "json"
+)
+
+// commonOSArchs are the OS/archs lint expects URLs for by default.
+var commonOSArchs = []string{"darwin/amd64", "darwin/arm64", "linux/amd64", "linux/arm64", "windows/amd64"}
+
+// lintIssue is a problem found in URL and archive related flags.
+type lintIssue struct {
+	File    string `json:"file,omitempty"`
+	Check   string `json:"check"`
+	Arg     string `json:"arg,omitempty"`
+	Message string `json:"message"`
+}
+
+func (i lintIssue) String() string {
+	var sb strings.Builder
+	for _, s := range []string{i.File, i.Arg} {
+		if s != "" {
+			sb.WriteString(s)
+			sb.WriteString(": ")
+		}
+	}
+	fmt.Fprintf(&sb, "%s [%s]", i.Message, i.Check)
+
+	return sb.String()
+}
+
+// isArchiveURL tells if u is one wrun extracts as an archive.
+// OCI URLs are considered archives, as their layer formats are known only at download time.
+func isArchiveURL(u *url.URL) bool {
+	if u.Scheme == ociScheme {
+		return true
+	}
+	base := strings.ToLower(urlBase(u))
+
+	return strings.HasSuffix(base, ".whl") || archives.IsArchive(base)
+}
+
+// lintFlags checks URL and archive related flags for problems without downloading anything.
+// URLs, directly or through fallbacks, are expected to be available for osArchs.
+func lintFlags(f *argsFileFlags, osArchs []string) []lintIssue {
+	var issues []lintIssue
+	add := func(check, arg, format string, a ...any) {
+		issues = append(issues, lintIssue{Check: check, Arg: arg, Message: fmt.Sprintf(format, a...)})
+	}
+	seen := make(map[string]bool)
+	duplicate := func(key, arg string) bool {
+		if seen[key] {
+			add(lintCheckDuplicate, arg, "duplicate of an earlier argument")
+
+			return true
+		}
+		seen[key] = true
+
+		return false
+	}
+	validPattern := func(pattern, arg string) bool {
+		if err := validateOSArchPattern(pattern); err != nil {
+			add(lintCheckMatcher, arg, "%v", err)
+
+			return false
+		}
+
+		return true
+	}
+	splitPathArg := func(s string) (pattern, pth string) {
+		pattern, pth, found := strings.Cut(s, "=")
+		if !found {
+			return matchAll, pattern
+		} else if pattern == "" {
+			pattern = matchAll
+		}
+
+		return pattern, pth
+	}
+
+	// Only valid and distinct matchers are added to cfg, args records the argument for each.
+	cfg := &rootCmdConfig{archiveExtract: f.archiveExtract, baseDir: f.baseDir}
+	args := map[string][]string{}
+
+	for _, s := range f.urlArgs {
+		pattern, ur := splitURLArg(s)
+		if pattern == "" {
+			pattern = matchAll
+		}
+		arg := "--url=" + s
+		u, err := parseURLArg(ur, f.baseDir)
+		if err != nil {
+			validPattern(pattern, arg)
+			add(lintCheckURL, arg, "%v", err)
+
+			continue
+		}
+		if u.User != nil {
+			arg = "--url=" + strings.TrimSuffix(s, ur) + u.Redacted()
+		}
+		valid := validPattern(pattern, arg)
+		if h, digest, err := hashes.ParseHashFragment(u.Fragment); err != nil {
+			add(lintCheckDigest, arg, "invalid digest fragment: %v", err)
+		} else if h != 0 && len(digest) != h.Size() {
+			add(lintCheckDigestLength, arg, "%s digest is %d bytes, expected %d", hashes.HashName(h), len(digest), h.Size())
+		}
+		if duplicate("url="+pattern+"="+u.String(), arg) || !valid {
+			continue
+		}
+		cfg.urlMatches = append(cfg.urlMatches, urlMatch{pattern, u})
+		args["url"] = append(args["url"], arg)
+	}
+
+	for _, s := range f.exePathArgs {
+		pattern, pth := splitPathArg(s)
+		arg := "--archive-exe-path=" + s
+		if pth == "" {
+			add(lintCheckArgs, arg, "missing path")
+		}
+		if !validPattern(pattern, arg) || duplicate("archive-exe-path="+pattern+"="+pth, arg) || pth == "" {
+			continue
+		}
+		cfg.archiveExePathMatches = append(cfg.archiveExePathMatches, archiveExePathMatch{pattern, pth})
+		args["archive-exe-path"] = append(args["archive-exe-path"], arg)
+	}
+
+	for _, s := range f.extraPathArgs {
+		pattern, pth := splitPathArg(s)
+		arg := "--archive-extra-path=" + s
+		if pth == "" {
+			add(lintCheckArgs, arg, "missing path")
+		}
+		if validPattern(pattern, arg) && !duplicate("archive-extra-path="+pattern+"="+pth, arg) && pth != "" {
+			cfg.archiveExtraPathMatches = append(cfg.archiveExtraPathMatches, archiveExtraPathMatch{pattern, pth})
+		}
+	}
+
+	for _, s := range f.fallbackArgs {
+		pattern, osArch := splitPathArg(s)
+		arg := "--os-arch-fallback=" + s
+		if !strings.Contains(osArch, "/") {
+			add(lintCheckArgs, arg, "invalid fallback OS/arch %q", osArch)
+		} else if validPattern(pattern, arg) && !duplicate("os-arch-fallback="+pattern+"="+osArch, arg) {
+			cfg.osArchFallbackMatches = append(cfg.osArchFallbackMatches, osArchFallbackMatch{pattern, osArch})
+		}
+	}
+
+	switch f.archiveExtract {
+	case "", archiveExtractAll, archiveExtractExe:
+	default:
+		add(lintCheckArgs, "--archive-extract="+f.archiveExtract, "invalid archive extract mode, use %s or %s", archiveExtractAll, archiveExtractExe)
+	}
+
+	rows, unreachable, err := explainOSArchs(cfg, nil)
+	if err != nil {
+		add(lintCheckMatcher, "", "%v", err)
+
+		return issues
+	}
+	for _, u := range unreachable {
+		check := lintCheckShadowed
+		if u.reason == unreachableUnmatched {
+			check = lintCheckUnmatched
+		}
+		add(check, args[u.flag][u.idx], "%s", u.reason)
+	}
+
+	nonArchive := make(map[int]bool)
+	for _, row := range rows {
+		if row.exePathIdx == -1 {
+			continue
+		}
+		for _, i := range row.urlIdxs {
+			if !nonArchive[i] && !isArchiveURL(cfg.urlMatches[i].url) {
+				nonArchive[i] = true
+				add(lintCheckNonArchive, args["url"][i], "archive exe path %q selected for %s, but URL is not an archive",
+					row.exePath, row.osArch)
+			}
+		}
+	}
+
+	if len(cfg.urlMatches) != 0 {
+	osArchs:
+		for _, osArch := range osArchs {
+			fallbacks, err := selectOSArchFallbacks(osArch, cfg.osArchFallbackMatches)
+			if err != nil {
+				add(lintCheckMatcher, "", "%v", err)
+
+				continue
+			}
+			for _, s := range append([]string{osArch}, fallbacks...) {
+				if idxs, err := selectURLMatches(s, cfg.urlMatches); err == nil && len(idxs) != 0 {
+					continue osArchs
+				}
+			}
+			add(lintCheckMissingOSArch, "", "no URL for %s", osArch)
+		}
+	}
+
+	return issues
+}
+
+// printLintIssues writes issues to out in the given format.
+func printLintIssues(out io.Writer, issues []lintIssue, format string) error {
+	if format == lintFormatJSON {
+		if issues == nil {
+			issues = []lintIssue{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(issues)
+	}
+	for _, issue := range issues {
+		if _, err := fmt.Fprintln(out, issue); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func lintCommand(w *Wrun) *cobra.Command {
+	var urlArgs, exePathArgs, extraPathArgs, fallbackArgs []string
+	var archiveExtract, format string
+	osArchs := commonOSArchs
+	cmd := &cobra.Command{
+		Use:   "lint [flags] [FILE...]",
+		Short: "check URL and archive related flags for problems",
+		Long: `check URL and archive related flags for problems
+
+The URL and archive related flags are taken from the command line, or parsed from args files as with ` + argsFileEnvVar + `.
+Nothing is downloaded, the checks are static:
+
+- ` + lintCheckArgs + `: malformed arguments
+- ` + lintCheckMatcher + `: invalid OS/arch matchers
+- ` + lintCheckURL + `: invalid URLs
+- ` + lintCheckDigest + `: invalid digest fragments
+- ` + lintCheckDigestLength + `: digests of wrong length for their algorithm
+- ` + lintCheckDuplicate + `: duplicate arguments
+- ` + lintCheckShadowed + `: matchers shadowed by earlier ones for all OS/archs
+- ` + lintCheckUnmatched + `: matchers matching no OS/arch known to Go
+- ` + lintCheckMissingOSArch + `: no URL, directly or through fallbacks, for an OS/arch given with --os-arch
+- ` + lintCheckNonArchive + `: archive exe path selected for a URL that is not an archive
+
+Exit status is 1 if problems are found.`,
+		Run: func(_ *cobra.Command, args []string) {
+			switch format {
+			case lintFormatText, lintFormatJSON:
+			default:
+				w.LogError("invalid format %q, use %s or %s", format, lintFormatText, lintFormatJSON)
+				os.Exit(esUsage)
+			}
+			type lintee struct {
+				name  string
+				flags *argsFileFlags
+			}
+			var lintees []lintee
+			if len(urlArgs) != 0 || len(exePathArgs) != 0 || len(extraPathArgs) != 0 || len(fallbackArgs) != 0 {
+				baseDir, err := os.Getwd()
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esError)
+				}
+				lintees = append(lintees, lintee{"", &argsFileFlags{
+					baseDir:        baseDir,
+					urlArgs:        urlArgs,
+					exePathArgs:    exePathArgs,
+					extraPathArgs:  extraPathArgs,
+					fallbackArgs:   fallbackArgs,
+					archiveExtract: archiveExtract,
+				}})
+			}
+			var issues []lintIssue
+			for _, argsFile := range args {
+				fileArgs, err := readArgsFile(w, argsFile)
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esError)
+				}
+				f, err := parseArgsFileFlags(argsFile, fileArgs)
+				if err != nil {
+					issues = append(issues, lintIssue{File: argsFile, Check: lintCheckArgs, Message: err.Error()})
+
+					continue
+				}
+				lintees = append(lintees, lintee{argsFile, f})
+			}
+			if len(lintees) == 0 && len(issues) == 0 {
+				w.LogError("no URLs or args files given")
+				os.Exit(esUsage)
+			}
+
+			for _, l := range lintees {
+				for _, issue := range lintFlags(l.flags, osArchs) {
+					issue.File = l.name
+					issues = append(issues, issue)
+				}
+			}
+			if err := printLintIssues(os.Stdout, issues, format); err != nil {
+				w.LogError("%v", err)
+				os.Exit(esError)
+			}
+			if len(issues) != 0 {
+				os.Exit(esError)
+			}
+		},
+	}
+	fs := cmd.Flags()
+	fs.StringSliceVarP(&urlArgs, "url", "u", nil, "[OS/arch=]URL matcher")
+	fs.StringSliceVarP(&exePathArgs, "archive-exe-path", "p", nil, "[OS/arch=]path to executable within archive matcher")
+	fs.StringVar(&archiveExtract, "archive-extract", archiveExtractAll, "archive extraction mode")
+	fs.StringSliceVar(&extraPathArgs, "archive-extra-path", nil, "[OS/arch=]path to extract from archive in addition to executable")
+	fs.StringSliceVar(&fallbackArgs, "os-arch-fallback", nil, "[OS/arch=]OS/arch to fall back to if no URL matches")
+	fs.StringSliceVar(&osArchs, "os-arch", osArchs, "OS/archs to expect URLs for")
+	fs.StringVar(&format, "format", lintFormatText, "output format, "+lintFormatText+" or "+lintFormatJSON)
+
+	return cmd
+}
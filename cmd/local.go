@@ -0,0 +1,81 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var errFileURL = errors.New("file URL must be absolute, with empty or localhost host")
+
+// parseURLArg parses a URL argument.
+// Ones without a scheme are local paths, relative ones are resolved against baseDir.
+func parseURLArg(s, baseDir string) (*url.URL, error) {
+	pth, fragment, _ := strings.Cut(s, "#")
+	if !filepath.IsAbs(pth) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(u.Scheme, "file") {
+			if u.Opaque != "" || !strings.HasPrefix(u.Path, "/") || (u.Host != "" && !strings.EqualFold(u.Host, "localhost")) {
+				return nil, fmt.Errorf("%w: %s", errFileURL, s)
+			}
+		}
+		if u.Scheme == ociScheme {
+			if _, err = parseOCIRef(u); err != nil {
+				return nil, err
+			}
+		}
+		if u.Scheme != "" {
+			return u, nil
+		}
+		pth = filepath.Join(baseDir, filepath.FromSlash(u.Path))
+	}
+
+	return &url.URL{Path: filepath.ToSlash(pth), Fragment: fragment}, nil
+}
+
+// isLocalURL tells if u refers to a local path, i.e. is a file URL or has neither scheme nor host.
+func isLocalURL(u *url.URL) bool {
+	return strings.EqualFold(u.Scheme, "file") || (u.Scheme == "" && u.Host == "")
+}
+
+// localURLPath gets the filesystem path for a local URL.
+func localURLPath(u *url.URL) string {
+	pth := u.Path
+	if runtime.GOOS == "windows" && strings.HasPrefix(pth, "/") && filepath.VolumeName(pth[1:]) != "" {
+		pth = pth[1:] // file:///C:/...
+	}
+
+	return filepath.FromSlash(pth)
+}
+
+// resolveArgsBaseDir gets the directory to resolve relative local paths in arguments against.
+func resolveArgsBaseDir() (string, error) {
+	if argsFile := os.Getenv(argsFileEnvVar); argsFile != "" {
+		return filepath.Abs(filepath.Dir(argsFile))
+	}
+
+	return os.Getwd()
+}
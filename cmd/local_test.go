@@ -0,0 +1,111 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/hashes"
+)
+
+func Test_parseURLArg(t *testing.T) {
+	baseDir := t.TempDir()
+	absPath := filepath.ToSlash(filepath.Join(baseDir, "abs", "tool"))
+	tests := []struct {
+		arg          string
+		wantLocal    bool
+		wantPath     string
+		wantFragment string
+	}{
+		{"https://example.com/tool#sha256-00ff", false, "/tool", "sha256-00ff"},
+		{"vendor/tool#sha256-00ff", true, filepath.ToSlash(filepath.Join(baseDir, "vendor", "tool")), "sha256-00ff"},
+		{"../tool", true, filepath.ToSlash(filepath.Join(filepath.Dir(baseDir), "tool")), ""},
+		{filepath.FromSlash(absPath) + "#sha256-00ff", true, absPath, "sha256-00ff"},
+		{"file:///abs/tool#sha256-00ff", true, "/abs/tool", "sha256-00ff"},
+		{"file://localhost/abs/tool", true, "/abs/tool", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			u, err := parseURLArg(tt.arg, baseDir)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantLocal, isLocalURL(u))
+			assert.Equal(t, tt.wantPath, u.Path)
+			assert.Equal(t, tt.wantFragment, u.Fragment)
+		})
+	}
+}
+
+func Test_parseURLArg_invalidFile(t *testing.T) {
+	for _, s := range []string{"file:tool", "file://example.com/tool", "file://"} {
+		_, err := parseURLArg(s, t.TempDir())
+		require.ErrorIs(t, err, errFileURL, s)
+	}
+}
+
+func Test_downloadCacheEntry_local(t *testing.T) {
+	w := NewWrun("wrun-test")
+	dir := t.TempDir()
+	archive := testTarGz(t, "bin/tool", "archived tool")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tool.tar.gz"), archive, 0o666))
+	digest := sha256.Sum256(archive)
+	fileURL := &url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(dir, "tool.tar.gz")), Fragment: digestKey(crypto.SHA256, digest[:])}
+	if !strings.HasPrefix(fileURL.Path, "/") {
+		fileURL.Path = "/" + fileURL.Path // Windows
+	}
+
+	for _, arg := range []string{"tool.tar.gz", fileURL.String()} {
+		t.Run(arg, func(t *testing.T) {
+			u, err := parseURLArg(arg, dir)
+			require.NoError(t, err)
+			h, d, err := hashes.ParseHashFragment(u.Fragment)
+			require.NoError(t, err)
+			spec := cacheEntrySpec{
+				url:            u,
+				h:              h,
+				digest:         d,
+				archiveExePath: "bin/tool",
+				limits:         archives.DefaultLimits,
+				cacheDir:       t.TempDir(),
+				remoteCache:    "http://localhost:1", // Not used for local URLs
+				proxyURL:       "http://localhost:1",
+			}
+			exePath, err := downloadCacheEntry(w, spec)
+			require.NoError(t, err)
+			data, err := os.ReadFile(exePath)
+			require.NoError(t, err)
+			assert.Equal(t, "archived tool", string(data))
+			_, urlEntryDir := spec.entryDirs()
+			assert.True(t, cacheEntryComplete(urlEntryDir))
+		})
+	}
+
+	u, err := parseURLArg("tool.tar.gz#"+digestKey(crypto.SHA256, make([]byte, sha256.Size)), dir)
+	require.NoError(t, err)
+	spec := cacheEntrySpec{url: u, h: crypto.SHA256, digest: make([]byte, sha256.Size), cacheDir: t.TempDir()}
+	_, err = downloadCacheEntry(w, spec)
+	require.ErrorContains(t, err, "digest mismatch")
+}
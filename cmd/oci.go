@@ -0,0 +1,426 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/hashes"
+)
+
+const (
+	ociScheme = "oci"
+
+	ociPlatformQueryKey = "platform"
+	ociLayerQueryKey    = "layer"
+	ociAnnotationTitle  = "org.opencontainers.image.title"
+	ociMaxManifestSize  = 4 << 20
+)
+
+// ociManifestMediaTypes are the accepted manifest media types, image indexes first.
+var ociManifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var errOCIRef = errors.New("invalid OCI reference, use oci://registry/repository@hashAlgo:hexDigest")
+
+// ociRef is a digest pinned OCI registry reference.
+type ociRef struct {
+	registry string
+	repo     string
+	digest   string
+}
+
+// parseOCIRef parses an oci://registry/repository@hashAlgo:hexDigest URL.
+func parseOCIRef(u *url.URL) (ociRef, error) {
+	repo, dgst, found := strings.Cut(strings.TrimPrefix(u.Path, "/"), "@")
+	if u.Host == "" || repo == "" || !found {
+		return ociRef{}, fmt.Errorf("%w: %s", errOCIRef, u.Redacted())
+	}
+	if _, _, err := parseOCIDigest(dgst); err != nil {
+		return ociRef{}, fmt.Errorf("%w: %s: %w", errOCIRef, u.Redacted(), err)
+	}
+
+	return ociRef{registry: u.Host, repo: repo, digest: dgst}, nil
+}
+
+// parseOCIDigest parses a hashAlgo:hexDigest OCI digest.
+func parseOCIDigest(s string) (crypto.Hash, []byte, error) {
+	h, digest, err := hashes.ParseHashFragment(strings.Replace(s, ":", "-", 1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if (h != crypto.SHA256 && h != crypto.SHA512) || len(digest) != h.Size() {
+		return 0, nil, fmt.Errorf("unsupported OCI digest: %q", s)
+	}
+
+	return h, digest, nil
+}
+
+// ociPlatformURL returns u with its platform query parameter set to osArch if it is an OCI URL without one.
+// Qualifiers in osArch are not included in the platform.
+func ociPlatformURL(u *url.URL, osArch string) *url.URL {
+	if u.Scheme != ociScheme || u.Query().Has(ociPlatformQueryKey) {
+		return u
+	}
+	pu := *u
+	q := pu.Query()
+	q.Set(ociPlatformQueryKey, osArchBase(osArch))
+	pu.RawQuery = q.Encode()
+
+	return &pu
+}
+
+// urlBase gets the base name of a URL's path, without the digest for OCI URLs.
+func urlBase(u *url.URL) string {
+	_, base := path.Split(u.Path)
+	if u.Scheme == ociScheme {
+		base, _, _ = strings.Cut(base, "@")
+	}
+
+	return base
+}
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an image index or manifest, the former having Manifests and the latter Layers.
+type ociManifest struct {
+	MediaType string          `json:"mediaType,omitempty"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+}
+
+// ociClient is a registry API client for a repository.
+type ociClient struct {
+	w        *Wrun
+	registry string
+	repo     string
+	token    string
+}
+
+func newOCIClient(w *Wrun, ref ociRef) (*ociClient, error) {
+	token, err := resolveOCIToken(ref.registry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ociClient{w: w, registry: ref.registry, repo: ref.repo, token: token}, nil
+}
+
+// resolveOCIToken gets the bearer token configured for registry, empty if none.
+// Tokens are configured as comma separated registry=token pairs, so that they are not sent to other registries.
+func resolveOCIToken(registry string) (string, error) {
+	for _, pair := range strings.Split(os.Getenv(ociTokenEnvVar), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		host, token, ok := strings.Cut(pair, "=")
+		if !ok || host == "" || token == "" {
+			return "", fmt.Errorf("%s: expected registry=token pairs", ociTokenEnvVar) // not showing, may contain tokens
+		}
+		if strings.EqualFold(host, registry) {
+			return token, nil
+		}
+	}
+
+	return "", nil
+}
+
+// get sends a GET request to a registry API path within the repository.
+// If no token is set, an anonymous one is requested on authentication challenges.
+func (c *ociClient) get(pth string, headers ...string) (*http.Response, error) {
+	u := "https://" + c.registry + "/v2/" + c.repo + pth
+	for {
+		hdrs := headers
+		if c.token != "" {
+			hdrs = append(hdrs[:len(hdrs):len(hdrs)], "Authorization:Bearer "+c.token)
+		}
+		resp, err := c.w.HTTPGet(u, hdrs...)
+		var statusErr *HTTPStatusError
+		if err == nil || c.token != "" || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		if c.token, err = c.anonymousToken(statusErr.Header.Get("Www-Authenticate")); err != nil {
+			return nil, fmt.Errorf("%w: anonymous token: %w", statusErr, err)
+		}
+	}
+}
+
+// anonymousToken gets an anonymous pull token for the repository, as instructed by a bearer authentication challenge.
+func (c *ociClient) anonymousToken(challenge string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	if !strings.EqualFold(scheme, "Bearer") || params["realm"] == "" {
+		return "", fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	if realm.Scheme != "https" && realm.Scheme != "http" {
+		return "", fmt.Errorf("unsupported token realm URL scheme: %q", realm.Scheme)
+	}
+	if err = c.w.policy.CheckLocation(realm); err != nil {
+		return "", fmt.Errorf("token realm: %w", err)
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repo + ":pull"
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	resp, err := c.w.HTTPGet(realm.String(), "Accept:application/json")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			c.w.LogWarn("close HTTP response: %v", err)
+		}
+	}()
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, ociMaxManifestSize)).Decode(&tr); err != nil {
+		return "", fmt.Errorf("decode token response: %w", err)
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return "", errors.New("no token in token response")
+	}
+
+	return tr.Token, nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header value with a single challenge.
+// Parameter names are lowercased.
+func parseAuthChallenge(s string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	params = make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, after, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		var value string
+		if quoted, ok := strings.CutPrefix(after, `"`); ok {
+			value, rest, _ = strings.Cut(quoted, `"`)
+		} else {
+			value, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	return scheme, params
+}
+
+// manifest gets the image index or manifest with the given digest, and checks it against it.
+func (c *ociClient) manifest(dgst string) (*ociManifest, error) {
+	h, digest, err := parseOCIDigest(dgst)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.get("/manifests/"+dgst, "Accept:"+strings.Join(ociManifestMediaTypes, ","))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ociMaxManifestSize+1))
+	if cErr := resp.Body.Close(); cErr != nil {
+		c.w.LogWarn("close HTTP response: %v", cErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	if len(data) > ociMaxManifestSize {
+		return nil, fmt.Errorf("manifest %s too large", dgst)
+	}
+	hsh := h.New()
+	_, _ = hsh.Write(data)
+	if got := hsh.Sum(nil); !bytes.Equal(got, digest) {
+		return nil, fmt.Errorf("manifest digest mismatch: expected %x, got %x", digest, got)
+	}
+	var m ociManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", dgst, err)
+	}
+
+	return &m, nil
+}
+
+// downloadBlob downloads the blob for desc to dest, checks it against its digest, and closes dest.
+func (c *ociClient) downloadBlob(desc ociDescriptor, dest *os.File) error {
+	h, digest, err := parseOCIDigest(desc.Digest)
+	if err != nil {
+		return err
+	}
+	resp, err := c.get("/blobs/" + desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	return c.w.Download(resp, dest, h.New(), digest)
+}
+
+// selectOCIPlatform selects the manifest for an os/arch[/variant] platform from an image index.
+// Without a variant, the first manifest for os/arch is selected.
+func selectOCIPlatform(manifests []ociDescriptor, platform string) (ociDescriptor, error) {
+	goos, rest, _ := strings.Cut(platform, "/")
+	goarch, variant, _ := strings.Cut(rest, "/")
+	for _, m := range manifests {
+		p := m.Platform
+		if p != nil && p.OS == goos && p.Architecture == goarch && (variant == "" || p.Variant == variant) {
+			return m, nil
+		}
+	}
+
+	return ociDescriptor{}, fmt.Errorf("no manifest for platform %s in image index", platform)
+}
+
+// ociLayerName gets a file name for a layer, from its title annotation or the repository name,
+// with a filename extension for archive layer media types.
+func ociLayerName(desc ociDescriptor, ref ociRef) string {
+	name := desc.Annotations[ociAnnotationTitle]
+	if name == "" || !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) {
+		name = path.Base(ref.repo)
+	}
+	var ext string
+	switch mt := desc.MediaType; {
+	case strings.HasSuffix(mt, ".tar+gzip"), strings.HasSuffix(mt, ".tar.gzip"):
+		ext = ".tar.gz"
+	case strings.HasSuffix(mt, ".tar+zstd"):
+		ext = ".tar.zst"
+	case strings.HasSuffix(mt, ".tar"):
+		ext = ".tar"
+	}
+	if ext != "" && !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+
+	return name
+}
+
+// ociDownload resolves the blob for an OCI URL, downloads it to a file in dir checking it against its digest,
+// and returns the path to the file and a name for it.
+//
+// Image indexes are resolved to manifests using the platform query parameter.
+// The layer query parameter, if given, selects image manifest layers by title annotation or digest.
+// If archiveExePath is set, the topmost layer containing it is used, otherwise exactly one layer must remain.
+func ociDownload(w *Wrun, u *url.URL, archiveExePath, dir string) (pth, name string, err error) {
+	ref, err := parseOCIRef(u)
+	if err != nil {
+		return "", "", err
+	}
+	c, err := newOCIClient(w, ref)
+	if err != nil {
+		return "", "", err
+	}
+	m, err := c.manifest(ref.digest)
+	if err != nil {
+		return "", "", err
+	}
+	if len(m.Manifests) != 0 {
+		desc, err := selectOCIPlatform(m.Manifests, u.Query().Get(ociPlatformQueryKey))
+		if err != nil {
+			return "", "", err
+		}
+		if m, err = c.manifest(desc.Digest); err != nil {
+			return "", "", err
+		}
+		if len(m.Manifests) != 0 {
+			return "", "", fmt.Errorf("nested image index %s not supported", desc.Digest)
+		}
+	}
+
+	layers := m.Layers
+	if sel := u.Query().Get(ociLayerQueryKey); sel != "" {
+		layers = nil
+		for _, l := range m.Layers {
+			if l.Annotations[ociAnnotationTitle] == sel || l.Digest == sel {
+				layers = append(layers, l)
+			}
+		}
+	}
+	switch {
+	case len(layers) == 0:
+		return "", "", errors.New("no matching layers in image manifest")
+	case archiveExePath == "" && len(layers) != 1:
+		return "", "", fmt.Errorf("%d matching layers in image manifest, select one with the %s query parameter", len(layers), ociLayerQueryKey)
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		name = ociLayerName(layers[i], ref)
+		f, cleanUp, err := w.SetUpTempfile(name, dir)
+		if err != nil {
+			return "", "", err
+		}
+		if err = c.downloadBlob(layers[i], f); err != nil {
+			cleanUp()
+
+			return "", "", fmt.Errorf("layer %s: %w", layers[i].Digest, err)
+		}
+		if archiveExePath == "" {
+			return f.Name(), name, nil
+		}
+		found, err := archives.Contains(f.Name(), archiveExePath)
+		if err != nil {
+			cleanUp()
+
+			return "", "", fmt.Errorf("layer %s: %w", layers[i].Digest, err)
+		}
+		if found {
+			return f.Name(), name, nil
+		}
+		w.LogInfo("layer %s does not contain %s", layers[i].Digest, archiveExePath)
+		cleanUp()
+	}
+
+	return "", "", fmt.Errorf("%w: %s", archives.ErrNotFound, archiveExePath)
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/policy"
+)
+
+// testRegistry is an in-process OCI registry serving content addressed blobs and manifests of a repository.
+// Requests require an anonymous bearer token.
+type testRegistry struct {
+	*httptest.Server
+	repo      string
+	content   map[string][]byte
+	tokenHits atomic.Int32
+}
+
+func newTestRegistry(t *testing.T, repo string) *testRegistry {
+	t.Helper()
+	reg := &testRegistry{repo: repo, content: make(map[string][]byte)}
+	reg.Server = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			reg.tokenHits.Add(1)
+			assert.Equal(t, "repository:"+repo+":pull", r.URL.Query().Get("scope"))
+			_, _ = rw.Write([]byte(`{"token":"anonymous"}`))
+
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			rw.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, reg.URL))
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+		prefix := "/v2/" + repo + "/"
+		kind, dgst, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		data, found := reg.content[dgst]
+		if !strings.HasPrefix(r.URL.Path, prefix) || (kind != "manifests" && kind != "blobs") || !found {
+			http.NotFound(rw, r)
+
+			return
+		}
+		_, _ = rw.Write(data)
+	}))
+	t.Cleanup(reg.Close)
+
+	return reg
+}
+
+// add adds content to the registry, and returns a descriptor for it.
+func (reg *testRegistry) add(mediaType string, data []byte) ociDescriptor {
+	dgst := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	reg.content[dgst] = data
+
+	return ociDescriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func (reg *testRegistry) addManifest(t *testing.T, m ociManifest) ociDescriptor {
+	t.Helper()
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	return reg.add(m.MediaType, data)
+}
+
+func Test_ociDownload(t *testing.T) {
+	const repo = "org/tool"
+	reg := newTestRegistry(t, repo)
+	w := NewWrun("wrun-test")
+	w.httpClient = reg.Client()
+
+	lower := reg.add("application/vnd.oci.image.layer.v1.tar+gzip", testTarGz(t, "bin/tool", "linux tool"))
+	upper := reg.add("application/vnd.oci.image.layer.v1.tar+gzip", testTarGz(t, "etc/config", "config"))
+	linux := reg.addManifest(t, ociManifest{MediaType: "application/vnd.oci.image.manifest.v1+json", Layers: []ociDescriptor{lower, upper}})
+	linux.Platform = &ociPlatform{OS: "linux", Architecture: "amd64"}
+	blob := reg.add("application/vnd.example.tool", []byte("darwin tool"))
+	blob.Annotations = map[string]string{ociAnnotationTitle: "tool"}
+	darwin := reg.addManifest(t, ociManifest{MediaType: "application/vnd.oci.image.manifest.v1+json", Layers: []ociDescriptor{blob}})
+	darwin.Platform = &ociPlatform{OS: "darwin", Architecture: "arm64"}
+	index := reg.addManifest(t, ociManifest{MediaType: "application/vnd.oci.image.index.v1+json", Manifests: []ociDescriptor{linux, darwin}})
+
+	u, err := parseURLArg(fmt.Sprintf("oci://%s/%s@%s", reg.Listener.Addr(), repo, index.Digest), "")
+	require.NoError(t, err)
+	cacheDir := t.TempDir()
+	for _, tt := range []struct {
+		osArch, archiveExePath, want string
+	}{
+		{"linux/amd64", "bin/tool", "linux tool"},
+		{"darwin/arm64", "", "darwin tool"},
+	} {
+		t.Run(tt.osArch, func(t *testing.T) {
+			spec := cacheEntrySpec{
+				url:            ociPlatformURL(u, tt.osArch),
+				archiveExePath: tt.archiveExePath,
+				limits:         archives.DefaultLimits,
+				cacheDir:       cacheDir,
+			}
+			exePath, err := downloadCacheEntry(w, spec)
+			require.NoError(t, err)
+			data, err := os.ReadFile(exePath)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(data))
+			entryDir, _ := spec.entryDirs()
+			des, err := os.ReadDir(entryDir)
+			require.NoError(t, err)
+			for _, de := range des {
+				assert.False(t, strings.HasPrefix(de.Name(), "wrun"), "leftover download %s", de.Name())
+			}
+		})
+	}
+	assert.Equal(t, int32(2), reg.tokenHits.Load(), "one anonymous token per download")
+
+	spec := cacheEntrySpec{url: ociPlatformURL(u, "windows/amd64"), cacheDir: cacheDir}
+	_, err = downloadCacheEntry(w, spec)
+	require.ErrorContains(t, err, "no manifest for platform windows/amd64")
+
+	spec = cacheEntrySpec{url: ociPlatformURL(u, "linux/amd64"), archiveExePath: "bin/missing", limits: archives.DefaultLimits, cacheDir: cacheDir}
+	_, err = downloadCacheEntry(w, spec)
+	require.ErrorIs(t, err, archives.ErrNotFound)
+}
+
+func Test_ociClient_anonymousToken_policy(t *testing.T) {
+	const repo = "org/tool"
+	reg := newTestRegistry(t, repo)
+	w := NewWrun("wrun-test")
+	w.httpClient = reg.Client()
+	c := &ociClient{w: w, registry: reg.Listener.Addr().String(), repo: repo}
+	challenge := func(realm string) string {
+		return fmt.Sprintf(`Bearer realm="%s",service="test"`, realm)
+	}
+
+	w.setPolicy(policy.Policy{HTTPSOnly: true})
+	_, err := c.anonymousToken(challenge(strings.Replace(reg.URL, "https:", "http:", 1) + "/token"))
+	require.ErrorIs(t, err, policy.ErrInsecureScheme)
+
+	w.setPolicy(policy.Policy{AllowedHosts: []string{"registry.example.com"}})
+	_, err = c.anonymousToken(challenge(reg.URL + "/token"))
+	require.ErrorIs(t, err, policy.ErrHostNotAllowed)
+	assert.Zero(t, reg.tokenHits.Load())
+
+	w.setPolicy(policy.Policy{HTTPSOnly: true, AllowedHosts: []string{"127.0.0.1"}})
+	token, err := c.anonymousToken(challenge(reg.URL + "/token"))
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", token)
+}
+
+func Test_parseOCIRef_invalid(t *testing.T) {
+	for _, s := range []string{
+		"oci://example.com/tool",
+		"oci:///tool@sha256:" + strings.Repeat("00", sha256.Size),
+		"oci://example.com/@sha256:" + strings.Repeat("00", sha256.Size),
+		"oci://example.com/tool@sha256:00",
+		"oci://example.com/tool@md5:" + strings.Repeat("00", 16),
+	} {
+		_, err := parseURLArg(s, "")
+		require.ErrorIs(t, err, errOCIRef, s)
+	}
+}
+
+func Test_resolveOCIToken(t *testing.T) {
+	for _, tt := range []struct {
+		env, registry, want string
+		wantErr             bool
+	}{
+		{"", "ghcr.io", "", false},
+		{"ghcr.io=secret", "ghcr.io", "secret", false},
+		{"ghcr.io=secret", "evil.example.com", "", false},
+		{"ghcr.io=secret", "ghcr.io:8443", "", false},
+		{"ghcr.io=one, registry.example.com:5000=two", "registry.example.com:5000", "two", false},
+		{"GHCR.io=secret", "ghcr.io", "secret", false},
+		{"secret", "ghcr.io", "", true},
+		{"ghcr.io=", "ghcr.io", "", true},
+	} {
+		t.Run(tt.env+"/"+tt.registry, func(t *testing.T) {
+			t.Setenv(ociTokenEnvVar, tt.env)
+			got, err := resolveOCIToken(tt.registry)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.NotContains(t, err.Error(), "secret")
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",Scope="repository:org/tool:pull,push", error=invalid_token`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:org/tool:pull,push",
+		"error":   "invalid_token",
+	}, params)
+}
+
+func Test_ociPlatformURL(t *testing.T) {
+	for _, tt := range []struct {
+		url, want string
+	}{
+		{"oci://example.com/tool@sha256:00", "oci://example.com/tool@sha256:00?platform=linux%2Famd64"},
+		{"oci://example.com/tool@sha256:00?platform=linux/arm/v7", "oci://example.com/tool@sha256:00?platform=linux/arm/v7"},
+		{"https://example.com/tool", "https://example.com/tool"},
+	} {
+		assert.Equal(t, tt.want, ociPlatformURL(mustParseURL(t, tt.url), "linux/amd64").String())
+	}
+}
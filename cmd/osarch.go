@@ -0,0 +1,256 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"cmp"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/scop/wrun/internal/cpulevel"
+	"github.com/scop/wrun/internal/files"
+)
+
+// osArchListData is the output of `go tool dist list`.
+// Regenerate with `go generate`, CI checks that it is up to date.
+//
+//go:generate sh -c "go tool dist list >osarch_list.txt"
+//go:embed osarch_list.txt
+var osArchListData string
+
+// knownOSArchs gets the OS/arch combinations known to Go.
+func knownOSArchs() []string {
+	return strings.Fields(osArchListData)
+}
+
+// archLevels has the known microarchitecture levels for archs, in increasing order.
+var archLevels = map[string][]string{
+	"amd64": {"v1", "v2", "v3", "v4"},
+	"arm":   {"v5", "v6", "v7"},
+}
+
+// knownOSArchVariants gets the OS/arch combinations known to Go,
+// along with their libc qualified variants for Linux, microarchitecture level qualified ones,
+// and ones qualified with both.
+func knownOSArchVariants() []string {
+	var osArchs []string
+	for _, osArch := range knownOSArchs() {
+		libcs := []string{""}
+		if strings.HasPrefix(osArch, "linux/") {
+			libcs = append(libcs, "/"+files.LibcGNU, "/"+files.LibcMusl)
+		}
+		_, arch, _ := strings.Cut(osArch, "/")
+		for _, level := range append([]string{""}, archLevels[arch]...) {
+			if level != "" {
+				level = "/" + level
+			}
+			for _, libc := range libcs {
+				osArchs = append(osArchs, osArch+level+libc)
+			}
+		}
+	}
+
+	return osArchs
+}
+
+// resolveOSArch gets the OS/arch to match against, from the environment or the one wrun was built for.
+// In the latter case, the detected microarchitecture level and libc, if any, are appended as qualifiers.
+func resolveOSArch() string {
+	osArch := os.Getenv(osArchEnvVar)
+	if osArch == "" {
+		osArch = runtime.GOOS + "/" + runtime.GOARCH
+		if level := cpulevel.Detect(); level != "" {
+			osArch += "/" + level
+		}
+		if libc := detectLibc(); libc != "" {
+			osArch += "/" + libc
+		}
+	}
+
+	return osArch
+}
+
+// osArchBase gets the OS/arch part of an OS/arch string, without qualifiers.
+func osArchBase(osArch string) string {
+	base, _, _ := strings.Cut(osArch, "/")
+	if len(base) == len(osArch) {
+		return osArch
+	}
+	arch, _, _ := strings.Cut(osArch[len(base)+1:], "/")
+
+	return base + "/" + arch
+}
+
+// parseLevel parses a microarchitecture level qualifier, such as v3, to its number.
+func parseLevel(q string) (int, bool) {
+	s, found := strings.CutPrefix(q, "v")
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// matchQualifier matches an OS/arch qualifier pattern against a qualifier.
+// Microarchitecture levels match ones greater or equal to them, others are matched with filepath.Match.
+func matchQualifier(pattern, q string) (bool, error) {
+	if pl, ok := parseLevel(pattern); ok {
+		if ql, ok := parseLevel(q); ok {
+			return pl <= ql, nil
+		}
+	}
+
+	return filepath.Match(pattern, q)
+}
+
+// matchOSArch matches an OS/arch matcher against an OS/arch string.
+// A matcher consists of one or more terms separated by &, all of which must match.
+// Terms prefixed with ! are negated. Terms prefixed with ~, after a possible !,
+// are regular expressions, others are globs, see matchOSArchGlob.
+// Regular expressions match if they match the OS/arch string either without or with its qualifiers,
+// so that ones anchored at the end match qualified variants, and ones addressing qualifiers can still match them.
+func matchOSArch(pattern, osArch string) (bool, error) {
+	for _, term := range strings.Split(pattern, "&") {
+		term, negate := strings.CutPrefix(term, "!")
+		var match bool
+		if expr, found := strings.CutPrefix(term, "~"); found {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return false, err
+			}
+			match = re.MatchString(osArchBase(osArch)) || re.MatchString(osArch)
+		} else {
+			var err error
+			if match, err = matchOSArchGlob(term, osArch); err != nil {
+				return false, err
+			}
+		}
+		if match == negate {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// validateOSArchPattern checks that an OS/arch matcher is syntactically valid, see matchOSArch.
+func validateOSArchPattern(pattern string) error {
+	for _, term := range strings.Split(pattern, "&") {
+		term, _ = strings.CutPrefix(term, "!")
+		var err error
+		if expr, found := strings.CutPrefix(term, "~"); found {
+			if expr == "" {
+				err = errors.New("empty regular expression")
+			} else {
+				_, err = regexp.Compile(expr)
+			}
+		} else if term == "" {
+			err = errors.New("empty term")
+		} else {
+			for _, part := range strings.Split(term, "/") {
+				if _, err = filepath.Match(part, ""); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid OS/arch matcher %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matchOSArchGlob matches an OS/arch glob against an OS/arch string, both possibly with qualifiers, such as libc.
+// OS and arch are matched with filepath.Match, and each qualifier in the glob must match one in osArch, see matchQualifier.
+// Globs without qualifiers thus match all qualified variants of their OS/arch.
+func matchOSArchGlob(pattern, osArch string) (bool, error) {
+	patternParts := strings.Split(pattern, "/")
+	osArchParts := strings.Split(osArch, "/")
+	if len(patternParts) < 2 || len(osArchParts) < 2 {
+		return filepath.Match(pattern, osArch)
+	}
+	match, err := filepath.Match(strings.Join(patternParts[:2], "/"), strings.Join(osArchParts[:2], "/"))
+	if err != nil || !match {
+		return false, err
+	}
+	for _, pq := range patternParts[2:] {
+		match = false
+		for _, q := range osArchParts[2:] {
+			if match, err = matchQualifier(pq, q); err != nil {
+				return false, err
+			} else if match {
+				break
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// compareOSArchs compares OS/arch strings for sorting, ordering qualified variants before the unqualified one of the same OS/arch,
+// and ones with more qualifiers before ones with fewer, so that the most specific compatible one is chosen when matched in that order.
+// Qualifiers in the same position are ordered with compareQualifiers.
+func compareOSArchs(a, b string) int {
+	if c := strings.Compare(osArchBase(a), osArchBase(b)); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(strings.Count(b, "/"), strings.Count(a, "/")); c != 0 {
+		return c
+	}
+	aParts, bParts := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 2; i < len(aParts); i++ {
+		if c := compareQualifiers(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// compareQualifiers compares OS/arch qualifiers for sorting, ordering libcs before microarchitecture levels,
+// and higher levels before lower ones.
+// Libc qualified variants come first, because running with an unsuitable libc fails,
+// while variants for lower levels than the system's, including unqualified ones, only run slower.
+func compareQualifiers(a, b string) int {
+	al, aok := parseLevel(a)
+	bl, bok := parseLevel(b)
+	switch {
+	case aok && bok:
+		return cmp.Compare(bl, al)
+	case aok:
+		return 1
+	case bok:
+		return -1
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_matchOSArch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		osArch  string
+		want    bool
+	}{
+		{"linux/amd64", "linux/amd64", true},
+		{"linux/amd64", "linux/amd64/musl", true},
+		{"linux/amd64/musl", "linux/amd64/musl", true},
+		{"linux/amd64/musl", "linux/amd64/gnu", false},
+		{"linux/amd64/musl", "linux/amd64", false},
+		{"linux/*/gnu", "linux/arm64/gnu", true},
+		{"linux/*/*", "linux/arm64/gnu", true},
+		{"*/*", "linux/arm64/gnu", true},
+		{"*/*", "linux/arm64", true},
+		{"*", "linux/arm64", false},
+		{"darwin/*", "linux/arm64/gnu", false},
+		{"linux/amd64/v2", "linux/amd64/v3/gnu", true},
+		{"linux/amd64/v3", "linux/amd64/v3/gnu", true},
+		{"linux/amd64/v4", "linux/amd64/v3/gnu", false},
+		{"linux/amd64/v3/gnu", "linux/amd64/v3/gnu", true},
+		{"linux/amd64/v3/musl", "linux/amd64/v3/gnu", false},
+		{"linux/amd64/v2", "linux/amd64", false},
+		{"linux/arm/v6", "linux/arm/v7", true},
+		{"linux/arm/v7", "linux/arm/v6", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"~"+tt.osArch, func(t *testing.T) {
+			got, err := matchOSArch(tt.pattern, tt.osArch)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_matchOSArch_expressions(t *testing.T) {
+	tests := []struct {
+		pattern string
+		osArch  string
+		want    bool
+	}{
+		{"!linux/*", "linux/amd64", false},
+		{"!linux/*", "darwin/amd64", true},
+		{"linux/*&!linux/arm*", "linux/amd64/gnu", true},
+		{"linux/*&!linux/arm*", "linux/arm64", false},
+		{"linux/*&!linux/arm*", "darwin/amd64", false},
+		{"~bsd/", "openbsd/arm64", true},
+		{"~^(free|net)bsd/", "openbsd/arm64", false},
+		{"!~bsd/", "openbsd/arm64", false},
+		{"~^linux/amd64/.*musl", "linux/amd64/v3/musl", true},
+		{"~^linux/amd64$", "linux/amd64/v3/gnu", true},
+		{"!~^linux/amd64$", "linux/amd64/v3/gnu", false},
+		{"~/musl$", "linux/amd64/musl", true},
+		{"!~musl", "linux/amd64/v3/musl", false},
+		{"!~musl", "linux/amd64/v3/gnu", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"~"+tt.osArch, func(t *testing.T) {
+			got, err := matchOSArch(tt.pattern, tt.osArch)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_knownOSArchVariants(t *testing.T) {
+	variants := knownOSArchVariants()
+	for _, osArch := range []string{"linux/amd64", "linux/amd64/musl", "linux/amd64/v3", "linux/amd64/v3/gnu", "linux/arm/v7/musl", "darwin/amd64/v2"} {
+		assert.Contains(t, variants, osArch)
+	}
+	assert.NotContains(t, variants, "darwin/amd64/gnu")
+	assert.Less(t, slices.Index(variants, "linux/amd64"), slices.Index(variants, "linux/amd64/v3/gnu"), "unqualified first")
+}
+
+func Test_osArchBase(t *testing.T) {
+	assert.Equal(t, "linux/amd64", osArchBase("linux/amd64/musl"))
+	assert.Equal(t, "linux/amd64", osArchBase("linux/amd64"))
+	assert.Equal(t, "linux", osArchBase("linux"))
+}
+
+func Test_compareOSArchs(t *testing.T) {
+	want := []string{
+		"darwin/arm64",
+		"linux/amd64/v3/gnu", "linux/amd64/v2/musl", "linux/amd64/gnu", "linux/amd64/musl", "linux/amd64/v10", "linux/amd64/v3", "linux/amd64",
+		"linux/arm64",
+	}
+	for _, osArchs := range [][]string{
+		{"linux/arm64", "linux/amd64", "linux/amd64/musl", "darwin/arm64", "linux/amd64/gnu", "linux/amd64/v3", "linux/amd64/v10", "linux/amd64/v2/musl", "linux/amd64/v3/gnu"},
+		{"linux/amd64/v3", "linux/amd64/v10", "linux/amd64/gnu", "linux/amd64/musl", "linux/amd64/v3/gnu", "linux/amd64/v2/musl", "linux/amd64", "linux/arm64", "darwin/arm64"},
+	} {
+		slices.SortFunc(osArchs, compareOSArchs)
+		assert.Equal(t, want, osArchs)
+	}
+
+	// First match in sorted order is the libc qualified one, also when a level qualified one matches
+	osArchs := []string{"linux/amd64", "linux/amd64/v3", "linux/amd64/gnu", "linux/amd64/musl"}
+	slices.SortFunc(osArchs, compareOSArchs)
+	for _, osArch := range osArchs {
+		match, err := matchOSArch(osArch, "linux/amd64/v3/gnu")
+		require.NoError(t, err)
+		if match {
+			assert.Equal(t, "linux/amd64/gnu", osArch)
+
+			break
+		}
+	}
+}
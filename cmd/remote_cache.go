@@ -0,0 +1,123 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var errRemoteCacheMiss = errors.New("remote cache miss")
+
+// resolveRemoteCache gets the base URL of the remote HTTP cache, empty if not configured.
+func resolveRemoteCache() (string, error) {
+	base := os.Getenv(remoteCacheEnvVar)
+	if base == "" {
+		return "", nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid URL", remoteCacheEnvVar) // not wrapping, may contain credentials
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s: unsupported URL scheme: %q", remoteCacheEnvVar, u.Scheme)
+	}
+
+	return base, nil
+}
+
+// remoteCacheURL gets the URL of the entry for digest in the remote cache at base.
+// base may contain credentials, so the URL should be logged and included in errors only redacted.
+func remoteCacheURL(base string, h crypto.Hash, digest []byte) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid URL", remoteCacheEnvVar) // not wrapping, may contain credentials
+	}
+
+	return u.JoinPath(digestKey(h, digest)), nil
+}
+
+// remoteCacheGet downloads the entry for digest from the remote cache at base to f, and verifies it against digest.
+// f is not closed, and on failure it is truncated so that it can be reused for downloading from elsewhere.
+// errRemoteCacheMiss is returned if the remote cache does not have the entry.
+func remoteCacheGet(w *Wrun, base string, h crypto.Hash, digest []byte, f *os.File) error {
+	u, err := remoteCacheURL(base, h, digest)
+	if err != nil {
+		return err
+	}
+	resp, err := w.HTTPGetURL(u)
+	if err != nil {
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return errRemoteCacheMiss
+		}
+
+		return err
+	}
+	if err = w.Download(resp, struct{ io.Writer }{f}, h.New(), digest); err != nil { // Hide Close from Download
+		return errors.Join(err, resetFile(f))
+	}
+
+	return nil
+}
+
+// remoteCachePut uploads the file at pth to the remote cache at base as the entry for digest.
+// The file is expected to have been verified against digest.
+func remoteCachePut(w *Wrun, base string, h crypto.Hash, digest []byte, pth string) error {
+	u, err := remoteCacheURL(base, h, digest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const method = http.MethodPut
+	redacted := u.Redacted()
+	w.LogInfo("%s %s", method, redacted)
+	req, err := http.NewRequest(method, u.String(), f)
+	if err != nil {
+		return fmt.Errorf("%s %s new request: %w", method, redacted, err)
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("User-Agent", w.ProgName+"/"+version)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, redacted, err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if err = resp.Body.Close(); err != nil {
+		w.LogWarn("close HTTP response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPStatusError{Method: method, URL: redacted, Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRemoteCache sets up a GET/PUT HTTP server storing entries in memory.
+func newTestRemoteCache(t *testing.T) (*httptest.Server, map[string][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	entries := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			data, found := entries[r.URL.Path]
+			if !found {
+				http.NotFound(rw, r)
+
+				return
+			}
+			_, _ = rw.Write(data)
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+
+				return
+			}
+			entries[r.URL.Path] = data
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, entries
+}
+
+func Test_remoteCache(t *testing.T) {
+	w := NewWrun("wrun-test")
+	srv, entries := newTestRemoteCache(t)
+	base := srv.URL + "/cache"
+	digest := sha256.Sum256([]byte("content"))
+	key := "/cache/" + digestKey(crypto.SHA256, digest[:])
+	dir := t.TempDir()
+
+	f, err := os.Create(filepath.Join(dir, "dl"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.ErrorIs(t, remoteCacheGet(w, base, crypto.SHA256, digest[:], f), errRemoteCacheMiss)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.WriteFile(src, []byte("content"), 0o666))
+	require.NoError(t, remoteCachePut(w, base, crypto.SHA256, digest[:], src))
+	assert.Equal(t, []byte("content"), entries[key])
+
+	require.NoError(t, remoteCacheGet(w, base, crypto.SHA256, digest[:], f))
+	data, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	// Mismatching remote content is rejected, and the file is left reusable
+	entries[key] = []byte("tampered")
+	require.NoError(t, f.Truncate(0))
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	err = remoteCacheGet(w, base, crypto.SHA256, digest[:], f)
+	require.ErrorContains(t, err, "digest mismatch")
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	assert.Zero(t, fi.Size())
+}
+
+func Test_remoteCache_failure(t *testing.T) {
+	w := NewWrun("wrun-test")
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	digest := sha256.Sum256([]byte("content"))
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "dl"))
+	require.NoError(t, err)
+	defer f.Close()
+	err = remoteCacheGet(w, srv.URL, crypto.SHA256, digest[:], f)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errRemoteCacheMiss)
+
+	var statusErr *HTTPStatusError
+	err = remoteCachePut(w, srv.URL, crypto.SHA256, digest[:], f.Name())
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+}
+
+func Test_remoteCache_credentialsRedacted(t *testing.T) {
+	const password = "s3cr3t"
+	w := NewWrun("wrun-test")
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	digest := sha256.Sum256([]byte("content"))
+	f, err := os.Create(filepath.Join(t.TempDir(), "dl"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, base := range []string{srv.URL, closed.URL} {
+		u := mustParseURL(t, base)
+		u.User = url.UserPassword("user", password)
+		base = u.String()
+		for _, err := range []error{
+			remoteCacheGet(w, base, crypto.SHA256, digest[:], f),
+			remoteCachePut(w, base, crypto.SHA256, digest[:], f.Name()),
+		} {
+			require.Error(t, err)
+			assert.NotContains(t, err.Error(), password)
+		}
+	}
+
+	t.Setenv(remoteCacheEnvVar, "http://user:"+password+"@[::1")
+	_, err = resolveRemoteCache()
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), password)
+}
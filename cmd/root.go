@@ -18,29 +18,31 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
 	"crypto"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/mholt/archiver/v3"
 	"github.com/spf13/cobra"
 
+	"github.com/scop/wrun/internal/archives"
 	"github.com/scop/wrun/internal/files"
 	"github.com/scop/wrun/internal/hashes"
+	"github.com/scop/wrun/internal/policy"
 )
 
 var (
@@ -107,13 +109,27 @@ type exitStatus = int
 
 const (
 	cacheHomeEnvVar           = "WRUN_CACHE_HOME"
+	cacheLayersEnvVar         = "WRUN_CACHE_LAYERS"
+	remoteCacheEnvVar         = "WRUN_REMOTE_CACHE"
+	proxyURLEnvVar            = "WRUN_PROXY_URL"
+	ociTokenEnvVar            = "WRUN_OCI_TOKEN"
 	verboseEnvVar             = "WRUN_VERBOSE"
 	osArchEnvVar              = "WRUN_OS_ARCH"
 	argsFileEnvVar            = "WRUN_ARGS_FILE"
-	cacheVersion              = "v2"
+	requireDigestEnvVar       = "WRUN_REQUIRE_DIGEST"
+	httpsOnlyEnvVar           = "WRUN_HTTPS_ONLY"
+	allowedHostsEnvVar        = "WRUN_ALLOWED_HOSTS"
+	minHashEnvVar             = "WRUN_MIN_HASH"
+	extractMaxSizeEnvVar      = "WRUN_EXTRACT_MAX_SIZE"
+	extractMaxEntriesEnvVar   = "WRUN_EXTRACT_MAX_ENTRIES"
+	extractMaxRatioEnvVar     = "WRUN_EXTRACT_MAX_RATIO"
+	cacheVersion              = "v3"
 	cacheDirDigestPlaceholder = "_"
 	defaultHTTPTimeout        = 5 * time.Minute
 
+	archiveExtractAll = "all"
+	archiveExtractExe = "exe"
+
 	esSuccess exitStatus = 0
 	esError   exitStatus = 1
 	esUsage   exitStatus = 2
@@ -123,14 +139,18 @@ const (
 func urlDir(u *url.URL, h crypto.Hash, digest []byte) string {
 	segs := make([]string, 0, strings.Count(u.Path, "/")+3)
 	segs = append(segs, strings.ReplaceAll(u.Host, ":", "_"))
-	segs = append(segs, strings.Split(u.Path, "/")...) // Note: filepath.Join later ignores possible empty segments
+	pth := u.Path
+	if u.Scheme == ociScheme {
+		pth = strings.ReplaceAll(pth, ":", "_") // in digest
+	}
+	segs = append(segs, strings.Split(pth, "/")...) // Note: filepath.Join later ignores possible empty segments
 	if u.RawQuery != "" {
 		segs[len(segs)-1] = segs[len(segs)-1] + url.PathEscape("?"+u.RawQuery)
 	}
 	if h == 0 {
 		segs = append(segs, cacheDirDigestPlaceholder)
 	} else {
-		segs = append(segs, hashes.HashName(h)+"-"+hex.EncodeToString(digest))
+		segs = append(segs, digestKey(h, digest))
 	}
 
 	return filepath.Join(segs...)
@@ -146,28 +166,72 @@ type archiveExePathMatch struct {
 	exePath string
 }
 
+type archiveExtraPathMatch struct {
+	pattern string
+	path    string
+}
+
+type osArchFallbackMatch struct {
+	pattern string
+	osArch  string
+}
+
 type rootCmdConfig struct {
-	urlMatches            []urlMatch
-	archiveExePathMatches []archiveExePathMatch
-	dryRun                bool
+	urlMatches              []urlMatch
+	archiveExePathMatches   []archiveExePathMatch
+	archiveExtraPathMatches []archiveExtraPathMatch
+	osArchFallbackMatches   []osArchFallbackMatch
+	env                     []envVar
+	pathPrependMatches      []pathPrependMatch
+	archiveExtract          string
+	dryRun                  bool
+	spawn                   bool
+	printPath               bool
+	baseDir                 string // for resolving relative local paths
+}
+
+const matchAll = "*/*"
+
+// splitURLArg splits a URL matcher argument to its pattern and URL parts.
+// Pattern is empty if the argument has none.
+func splitURLArg(s string) (pattern, ur string) {
+	pattern, ur, found := strings.Cut(s, "=")
+	if !found || strings.Contains(pattern, "://") {
+		return "", s
+	}
+
+	return pattern, ur
+}
+
+// parseMatchArg parses a [OS/arch=]value matcher argument, what describes the value in errors.
+// Pattern defaults to matching all.
+func parseMatchArg(s, what string) (pattern, value string, err error) {
+	pattern, value, found := strings.Cut(s, "=")
+	if !found {
+		pattern, value = matchAll, pattern
+	} else if pattern == "" {
+		pattern = matchAll
+	}
+	if value == "" {
+		return "", "", fmt.Errorf("missing %s in %q", what, s)
+	}
+	if err = validateOSArchPattern(pattern); err != nil {
+		return "", "", err
+	}
+
+	return pattern, value, nil
 }
 
-func parseFlags(cfg *rootCmdConfig, urlArgs, exePathArgs []string) error {
-	const matchAll = "*/*"
+func parseFlags(cfg *rootCmdConfig, urlArgs, exePathArgs, extraPathArgs, fallbackArgs []string) error {
 	for _, s := range urlArgs {
-		pattern, ur, found := strings.Cut(s, "=")
-		if found {
-			if strings.Contains(pattern, "://") {
-				ur = s
-				pattern = matchAll
-			} else if pattern == "" {
-				pattern = matchAll
-			}
-		} else {
-			ur = pattern
+		pattern, ur := splitURLArg(s)
+		if pattern == "" {
 			pattern = matchAll
 		}
-		u, err := url.Parse(ur)
+		if err := validateOSArchPattern(pattern); err != nil {
+			return err
+		}
+		u, err := parseURLArg(ur, cfg.baseDir)
 		if err != nil {
 			return err
 		}
@@ -175,26 +239,43 @@ func parseFlags(cfg *rootCmdConfig, urlArgs, exePathArgs []string) error {
 	}
 
 	for _, s := range exePathArgs {
-		pattern, pth, found := strings.Cut(s, "=")
-		if found {
-			if pattern == "" {
-				pattern = matchAll
-			}
-			if pth == "" {
-				return fmt.Errorf("missing path in %q", s)
-			}
-		} else {
-			pth = pattern
-			pattern = matchAll
+		pattern, pth, err := parseMatchArg(s, "path")
+		if err != nil {
+			return err
 		}
 		cfg.archiveExePathMatches = append(cfg.archiveExePathMatches, archiveExePathMatch{pattern, pth})
 	}
 
+	for _, s := range extraPathArgs {
+		pattern, pth, err := parseMatchArg(s, "path")
+		if err != nil {
+			return err
+		}
+		cfg.archiveExtraPathMatches = append(cfg.archiveExtraPathMatches, archiveExtraPathMatch{pattern, pth})
+	}
+
+	for _, s := range fallbackArgs {
+		pattern, osArch, err := parseMatchArg(s, "OS/arch")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(osArch, "/") {
+			return fmt.Errorf("invalid fallback OS/arch in %q", s)
+		}
+		cfg.osArchFallbackMatches = append(cfg.osArchFallbackMatches, osArchFallbackMatch{pattern, osArch})
+	}
+
+	switch cfg.archiveExtract {
+	case "", archiveExtractAll, archiveExtractExe:
+	default:
+		return fmt.Errorf("invalid archive extract mode %q, use %s or %s", cfg.archiveExtract, archiveExtractAll, archiveExtractExe)
+	}
+
 	return nil
 }
 
 func Execute() {
-	var urlArgs, exePathArgs []string
+	var urlArgs, exePathArgs, extraPathArgs, fallbackArgs, envArgs, pathPrependArgs []string
 	var httpTimeout time.Duration
 	w := NewWrun(filepath.Base(os.Args[0]))
 	cfg := &rootCmdConfig{}
@@ -209,22 +290,70 @@ OS and architecture matcher arguments for URLs to download and (if applicable) e
 
 The OS and architecture wrun was built for are matched against the given matchers.
 OS and architecture parts of the matcher may be globs.
+Matchers prefixed with ~ are regular expressions matched against the OS/arch string without and with qualifiers, either sufficing,
+ones prefixed with ! are negated,
+and & combines ones that must all match, for example linux/*&!linux/arm* or ~bsd/.
+On Linux, the libc detected from the dynamic loader or ldd is matched as an optional qualifier, for example linux/amd64/musl or linux/amd64/gnu.
+Similarly, the detected CPU microarchitecture level is matched as an optional qualifier, for example linux/amd64/v3 or linux/arm/v7,
+and level qualifiers match the given and higher levels.
+Matchers without a qualifier match all variants.
 Order of the matcher arguments is significant: the first match of each is chosen.
+Later matching URLs with the same digest as the chosen one are mirrors, tried in order if download fails or does not match the digest.
+If no URL matches, --os-arch-fallback OS/archs are tried in order, if the system can run them natively or under emulation.
 
 As a special case, a matcher argument with no matcher part is treated as if it was given with the matcher */*.
 On Windows, .exe is automatically appended to any archive exe path resulting from a */ prefixed match.
 
+By default, archives are extracted in full.
+With --archive-extract=exe, only the executable and matching --archive-extra-path ones are extracted, along with targets of symlinks among them.
+Downloaded archives are kept after extraction only if they have digests, for cache export.
+
+file:// URLs and ones without a scheme are local paths, relative ones are resolved against the directory of %s if set, the current directory otherwise.
+
 URL fragments, if present, are treated as hashAlgo-hexDigest strings, and downloads are checked against them.
 
+Download policy environment variables can be used to reject URLs before download.
+Policy violations cause exit status 2.
+
 The first non-flag argument or -- terminates %s arguments.
 Remaining ones are passed to the downloaded executable.
 
+By default, wrun replaces itself with the executable.
+With --spawn, it is run as a child process instead, and wrun waits for it to exit, forwarding signals to it.
+The exit status of the executable is propagated, 128+n if it was terminated by signal n,
+and the last use time of the cache entry is updated after it exits.
+
+--env sets environment variables and --path-prepend prepends dirs to PATH for the executable.
+In them, {archive-root} expands to the dir the archive was extracted to, and {exe-dir} to the dir containing the executable.
+Relative --path-prepend dirs are resolved against the archive root.
+With --archive-extract=exe, dirs in archives need to be extracted using --archive-extra-path.
+
 Environment variables:
 - %s: path to file containing command line arguments to prepend, one per line
 - %s: cache location, defaults to wrun subdir in the user's cache dir
+- %s: read-only cache locations to consult before the cache for downloads with digests, separated by %q
+- %s: base URL of remote HTTP cache to consult before download URLs with digests, and to upload downloads to
+- %s: base URL of wrun serve proxy to download through
+- %s: comma separated registry=token bearer tokens for OCI registries, anonymous tokens are requested for others
 - %s: override OS/arch for matching
 - %s: output verbosity, false decreases, true increases
-`, w.ProgName, w.ProgName, argsFileEnvVar, cacheHomeEnvVar, osArchEnvVar, verboseEnvVar),
+
+Download policy environment variables:
+- %s: if true, require URLs to have a digest fragment
+- %s: if true, allow only https URLs, also on redirects
+- %s: comma separated host globs to allow downloads from, also on redirects
+- %s: weakest digest algorithm to allow, for example sha256
+
+Archive extraction limit environment variables, 0 disables:
+- %s: maximum total uncompressed size in bytes, default %d
+- %s: maximum number of entries, default %d
+- %s: maximum ratio of uncompressed size to archive size, default %g
+`, w.ProgName, argsFileEnvVar, w.ProgName, argsFileEnvVar, cacheHomeEnvVar, cacheLayersEnvVar, string(filepath.ListSeparator), remoteCacheEnvVar,
+			proxyURLEnvVar, ociTokenEnvVar, osArchEnvVar, verboseEnvVar,
+			requireDigestEnvVar, httpsOnlyEnvVar, allowedHostsEnvVar, minHashEnvVar,
+			extractMaxSizeEnvVar, archives.DefaultLimits.MaxSize,
+			extractMaxEntriesEnvVar, archives.DefaultLimits.MaxEntries,
+			extractMaxRatioEnvVar, archives.DefaultLimits.MaxRatio),
 		Args:    cobra.ArbitraryArgs,
 		Version: versionString,
 		PersistentPreRun: func(_ *cobra.Command, _ []string) {
@@ -233,7 +362,16 @@ Environment variables:
 			}
 		},
 		PreRunE: func(_ *cobra.Command, _ []string) error {
-			return parseFlags(cfg, urlArgs, exePathArgs)
+			var err error
+			if cfg.baseDir, err = resolveArgsBaseDir(); err != nil {
+				return err
+			}
+
+			if err = parseFlags(cfg, urlArgs, exePathArgs, extraPathArgs, fallbackArgs); err != nil {
+				return err
+			}
+
+			return parseExecFlags(cfg, envArgs, pathPrependArgs)
 		},
 		Run: func(_ *cobra.Command, args []string) {
 			rc = runRoot(w, cfg, args)
@@ -248,18 +386,25 @@ Environment variables:
 
 	fs := rootCmd.Flags()
 	fs.BoolVarP(&cfg.dryRun, "dry-run", "n", false, "dry run, skip execution (but do download/set up cache)")
+	fs.BoolVar(&cfg.printPath, "print-path", false, "print absolute path to executable instead of running it (but do download/set up cache)")
+	fs.BoolVar(&cfg.spawn, "spawn", false, "run executable as a child process and wait for it instead of replacing wrun with it")
 	fs.StringSliceVarP(&urlArgs, "url", "u", nil, "[OS/arch=]URL matcher (at least one required)")
 	if err := rootCmd.MarkFlagRequired("url"); err != nil {
 		w.LogBug("mark flag required: %v", err)
 	}
 	fs.StringSliceVarP(&exePathArgs, "archive-exe-path", "p", nil, "[OS/arch=]path to executable within archive matcher (separator always /, implies archive processing)")
+	fs.StringVar(&cfg.archiveExtract, "archive-extract", archiveExtractAll, "archive extraction mode: "+archiveExtractAll+" for everything, "+archiveExtractExe+" for executable and extra paths only")
+	fs.StringSliceVar(&extraPathArgs, "archive-extra-path", nil, "[OS/arch=]path to extract from archive in addition to executable in "+archiveExtractExe+" extraction mode (separator always /, all matching ones apply)")
+	fs.StringArrayVar(&envArgs, "env", nil, "KEY=VALUE environment variable to set for executable, "+archiveRootPlaceholder+" and "+exeDirPlaceholder+" in VALUE are expanded")
+	fs.StringSliceVar(&pathPrependArgs, "path-prepend", nil, "[OS/arch=]dir to prepend to PATH for executable, relative ones are resolved against archive root, "+archiveRootPlaceholder+" and "+exeDirPlaceholder+" are expanded (all matching ones apply, in order)")
+	fs.StringSliceVar(&fallbackArgs, "os-arch-fallback", nil, "[OS/arch=]OS/arch to fall back to if no URL matches, used only if the system can run it (all matching ones are tried in order)")
 	pfs := rootCmd.PersistentFlags()
 	pfs.DurationVarP(&httpTimeout, "http-timeout", "t", defaultHTTPTimeout, "HTTP client timeout")
 	if err := rootCmd.RegisterFlagCompletionFunc("http-timeout", cobra.NoFileCompletions); err != nil {
 		w.LogBug("register --http-timeout completion: %v", err)
 	}
 
-	rootCmd.AddCommand(generateCommand(w))
+	rootCmd.AddCommand(cacheCommand(w), explainCommand(w), fetchCommand(w), generateCommand(w), lintCommand(w), serveCommand(w), shellenvCommand(w), vendorCommand(w))
 
 	if rootCmd.Execute() != nil { // assuming error already printed by cobra
 		rc = esUsage
@@ -267,27 +412,70 @@ Environment variables:
 	os.Exit(rc)
 }
 
-// selectURL selects a URL for a system from the given matches.
-func selectURL(s string, matches []urlMatch) (*url.URL, error) {
-	for _, m := range matches {
-		match, err := filepath.Match(m.pattern, s)
+// selectURLs selects URLs for a system from the given matches:
+// the first matching one, followed by its mirrors, i.e. later matching distinct ones with the same digest.
+// URLs without digests have no mirrors.
+func selectURLs(s string, matches []urlMatch) ([]*url.URL, error) {
+	idxs, err := selectURLMatches(s, matches)
+	if err != nil {
+		return nil, err
+	}
+	var urls []*url.URL
+	for _, i := range idxs {
+		urls = append(urls, ociPlatformURL(matches[i].url, s))
+	}
+
+	return urls, nil
+}
+
+// selectURLMatches selects URL matches for a system like selectURLs, and returns their indices in matches.
+func selectURLMatches(s string, matches []urlMatch) ([]int, error) {
+	var idxs []int
+	var urls []string
+	var h crypto.Hash
+	var digest []byte
+	for i, m := range matches {
+		match, err := matchOSArch(m.pattern, s)
 		if err != nil {
 			return nil, err
 		}
-		if match {
-			return m.url, nil
+		if !match {
+			continue
+		}
+		if idxs == nil {
+			idxs = append(idxs, i)
+			urls = append(urls, ociPlatformURL(m.url, s).String())
+			if h, digest, err = hashes.ParseHashFragment(m.url.Fragment); err != nil || h == 0 {
+				break
+			}
+
+			continue
+		}
+		mirror := ociPlatformURL(m.url, s).String()
+		if mh, md, err := hashes.ParseHashFragment(m.url.Fragment); err == nil && mh == h && bytes.Equal(md, digest) &&
+			!slices.Contains(urls, mirror) {
+			idxs = append(idxs, i)
+			urls = append(urls, mirror)
 		}
 	}
 
-	return nil, nil
+	return idxs, nil
 }
 
 // selectArchiveExePath selects an archive exe path for a system from the given matches.
 func selectArchiveExePath(s string, matches []archiveExePathMatch) (string, error) {
-	for _, m := range matches {
-		match, err := filepath.Match(m.pattern, s)
+	_, exePath, err := selectArchiveExePathMatch(s, matches)
+
+	return exePath, err
+}
+
+// selectArchiveExePathMatch selects an archive exe path for a system like selectArchiveExePath,
+// and returns also the index of the match in matches, -1 if none.
+func selectArchiveExePathMatch(s string, matches []archiveExePathMatch) (int, string, error) {
+	for i, m := range matches {
+		match, err := matchOSArch(m.pattern, s)
 		if err != nil {
-			return "", err
+			return -1, "", err
 		}
 		if match {
 			exePath := m.exePath
@@ -296,57 +484,196 @@ func selectArchiveExePath(s string, matches []archiveExePathMatch) (string, erro
 				exePath += ".exe"
 			}
 
-			return exePath, nil
+			return i, exePath, nil
+		}
+	}
+
+	return -1, "", nil
+}
+
+// resolvePolicy sets up download policy from the environment.
+func resolvePolicy() (policy.Policy, error) {
+	var pol policy.Policy
+	for _, b := range []struct {
+		envVar string
+		dest   *bool
+	}{
+		{requireDigestEnvVar, &pol.RequireDigest},
+		{httpsOnlyEnvVar, &pol.HTTPSOnly},
+	} {
+		if s := os.Getenv(b.envVar); s != "" {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return pol, fmt.Errorf("%s: %w", b.envVar, err)
+			}
+			*b.dest = v
+		}
+	}
+	for _, host := range strings.Split(os.Getenv(allowedHostsEnvVar), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			if _, err := path.Match(host, ""); err != nil {
+				return pol, fmt.Errorf("%s: %q: %w", allowedHostsEnvVar, host, err)
+			}
+			pol.AllowedHosts = append(pol.AllowedHosts, host)
+		}
+	}
+	if s := os.Getenv(minHashEnvVar); s != "" {
+		h, err := hashes.HashByName(s)
+		if err != nil {
+			return pol, fmt.Errorf("%s: %w", minHashEnvVar, err)
+		}
+		pol.MinHash = h
+	}
+
+	return pol, nil
+}
+
+// resolveExtractLimits sets up archive extraction limits from the environment.
+func resolveExtractLimits() (archives.Limits, error) {
+	limits := archives.DefaultLimits
+	if s := os.Getenv(extractMaxSizeEnvVar); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", extractMaxSizeEnvVar, err)
 		}
+		limits.MaxSize = v
+	}
+	if s := os.Getenv(extractMaxEntriesEnvVar); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", extractMaxEntriesEnvVar, err)
+		}
+		limits.MaxEntries = v
+	}
+	if s := os.Getenv(extractMaxRatioEnvVar); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", extractMaxRatioEnvVar, err)
+		}
+		limits.MaxRatio = v
 	}
 
-	return "", nil
+	return limits, nil
 }
 
-func resolveCacheDir() (string, error) {
-	cacheDir := os.Getenv(cacheHomeEnvVar)
-	if cacheDir == "" {
+// selectArchiveExtraPaths selects all archive extra paths for a system from the given matches.
+func selectArchiveExtraPaths(s string, matches []archiveExtraPathMatch) ([]string, error) {
+	var paths []string
+	for _, m := range matches {
+		match, err := matchOSArch(m.pattern, s)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			paths = append(paths, m.path)
+		}
+	}
+
+	return paths, nil
+}
+
+// resolveCacheHome gets the cache home dir, containing cache layout version dirs.
+func resolveCacheHome() (string, error) {
+	cacheHome := os.Getenv(cacheHomeEnvVar)
+	if cacheHome == "" {
 		var err error
-		cacheDir, err = os.UserCacheDir()
+		cacheHome, err = os.UserCacheDir()
 		if err != nil {
 			return "", fmt.Errorf("cache dir: %w", err)
 		}
-		cacheDir = filepath.Join(cacheDir, "wrun")
+		cacheHome = filepath.Join(cacheHome, "wrun")
 	}
-	cacheDir = filepath.Join(cacheDir, cacheVersion)
 
-	return cacheDir, nil
+	return cacheHome, nil
 }
 
 func runRoot(w *Wrun, cfg *rootCmdConfig, args []string) exitStatus {
+	exePath, rc := runRootExe(w, cfg, args)
+	if cfg.printPath && rc == esSuccess {
+		if _, err := fmt.Println(exePath); err != nil {
+			w.LogError("print path: %v", err)
+
+			return esError
+		}
+	}
+
+	return rc
+}
+
+// runRootExe sets up and runs the executable for cfg with args.
+// In dry-run, print path, and spawn modes, the absolute path to the executable is returned along with the exit status.
+func runRootExe(w *Wrun, cfg *rootCmdConfig, args []string) (string, exitStatus) {
 	w.LogInfo("%s", versionString)
 
 	// Figure out download URL and exe path in archive
 
-	osArch := os.Getenv(osArchEnvVar)
-	if osArch == "" {
-		osArch = runtime.GOOS + "/" + runtime.GOARCH
-	}
+	osArch := resolveOSArch()
 	w.LogInfo("OS/arch: %s", osArch)
 
-	ur, err := selectURL(osArch, cfg.urlMatches)
+	selectedOSArch, urls, how, err := selectURLsWithFallbacks(osArch, cfg)
 	if err != nil {
 		w.LogError("select URL: %v", err)
 
-		return esUsage // bad pattern
+		return "", esUsage // bad pattern
 	}
-	if ur == nil {
+	if len(urls) == 0 {
 		w.LogError("no URL available for OS/architecture %s", osArch)
 
-		return esError
+		return "", esError
 	}
+	systemOSArch := osArch
+	if selectedOSArch != osArch {
+		w.LogWarn("no URL available for OS/architecture %s, falling back to %s (%s)", osArch, selectedOSArch, how)
+		osArch = selectedOSArch
+	}
+	ur := urls[0]
 	w.LogInfo("URL: %s", ur)
+	for _, mirror := range urls[1:] {
+		w.LogInfo("mirror URL: %s", mirror)
+	}
+
+	pol, err := resolvePolicy()
+	if err != nil {
+		w.LogError("download policy: %v", err)
+
+		return "", esUsage
+	}
+	proxyBase, err := resolveProxyURL()
+	if err != nil {
+		w.LogError("cache setup: %v", err)
+
+		return "", esUsage
+	}
+	mirrors, err := checkDownloadURLs(w, pol, proxyBase, ur, urls[1:])
+	if err != nil {
+		w.LogError("download policy: %v", err)
+
+		return "", esUsage
+	}
+	w.setPolicy(pol)
 
 	archiveExePath, err := selectArchiveExePath(osArch, cfg.archiveExePathMatches)
 	if err != nil {
 		w.LogError("select archive exe path: %v", err)
 
-		return esUsage // bad pattern
+		return "", esUsage // bad pattern
+	}
+	var extractPaths []string
+	if archiveExePath != "" && cfg.archiveExtract == archiveExtractExe {
+		extraPaths, err := selectArchiveExtraPaths(osArch, cfg.archiveExtraPathMatches)
+		if err != nil {
+			w.LogError("select archive extra paths: %v", err)
+
+			return "", esUsage // bad pattern
+		}
+		extractPaths = append([]string{archiveExePath}, extraPaths...)
+		w.LogInfo("paths to extract: %v", extractPaths)
+	}
+	pathDirs, err := selectPathPrepends(osArch, cfg.pathPrependMatches)
+	if err != nil {
+		w.LogError("select PATH prepends: %v", err)
+
+		return "", esUsage // bad pattern
 	}
 
 	// Set up hashing
@@ -355,119 +682,337 @@ func runRoot(w *Wrun, cfg *rootCmdConfig, args []string) exitStatus {
 	if err != nil {
 		w.LogError("parse hash fragment: %v", err)
 
-		return esError
+		return "", esError
 	}
 
 	// Set up cache
 
-	var cacheDir string
-	cacheDir, err = resolveCacheDir()
+	cacheHome, err := resolveCacheHome()
 	if err != nil {
 		w.LogError("cache setup: %v", err)
 
-		return esError
+		return "", esError
 	}
-	// Here's hoping we don't hit path too long errors with this implementation anywhere
-	ps := make([]string, 0, strings.Count(archiveExePath, "/")+3)
-	_, dlBase := path.Split(ur.Path)
-	ps = append(ps, cacheDir, urlDir(ur, hshType, expectedDigest), dlBase)
-	dlPath := filepath.Join(ps...)
-	ps = append(ps, strings.Split(archiveExePath, "/")...)
-	exePath := filepath.Join(ps...)
-	err = os.MkdirAll(filepath.Dir(exePath), 0o777)
+	autoMigrateCache(w, cacheHome)
+	remoteCache, err := resolveRemoteCache()
 	if err != nil {
 		w.LogError("cache setup: %v", err)
 
-		return esError
+		return "", esUsage
+	}
+	var limits archives.Limits
+	if archiveExePath != "" {
+		if limits, err = resolveExtractLimits(); err != nil {
+			w.LogError("extract: %v", err)
+
+			return "", esUsage
+		}
 	}
+	spec := cacheEntrySpec{
+		url:            ur,
+		mirrors:        mirrors,
+		h:              hshType,
+		digest:         expectedDigest,
+		archiveExePath: archiveExePath,
+		extractPaths:   extractPaths,
+		limits:         limits,
+		cacheDir:       filepath.Join(cacheHome, cacheVersion),
+		remoteCache:    remoteCache,
+		proxyURL:       proxyBase,
+	}
+	entryDir, urlEntryDir := spec.entryDirs()
+	dlBase := urlBase(ur)
+	content := dlBase
+	entryContent, entryComplete := cacheEntryContent(entryDir)
+	if entryContent != "" {
+		content = entryContent // May differ from dlBase if set up from another URL with the same digest
+	}
+	exePath := entryExePath(entryDir, content, archiveExePath)
 	w.LogInfo("path to executable: %s", exePath)
 
 	// exec from cache
 
+	noExec := cfg.dryRun || cfg.printPath
+	childRC := esSuccess // of spawned executable
+	ranExe := ""         // absolute path of the executable run or located
 	exec := func(exe string) error {
 		exeArgs := make([]string, len(args)+1)
 		exeArgs[0] = exe
 		copy(exeArgs[1:], args)
-		if cfg.dryRun {
-			w.LogInfo("exec (...not, but stat due to dry-run): %v", exeArgs)
+		if noExec {
+			w.LogInfo("exec (...not, but stat due to dry-run or print path): %v", exeArgs)
 			if fi, statErr := os.Stat(exe); statErr != nil {
 				return statErr
 			} else if !fi.Mode().IsRegular() {
 				return fmt.Errorf("not a regular file: %v", exe)
 			}
+		}
+		if err := checkExeFormat(w, exe, systemOSArch, osArch); err != nil {
+			return err
+		}
+		if noExec || cfg.spawn {
+			abs, err := filepath.Abs(exe)
+			if err != nil {
+				return err
+			}
+			ranExe = abs
+		}
+		if noExec {
+			return nil
+		}
+		env, set := exeEnv(os.Environ(), cfg.env, pathDirs, exe, archiveExePath)
+		for _, kv := range set {
+			w.LogInfo("environment: %s", kv)
+		}
+		if cfg.spawn {
+			w.LogInfo("spawn: %v", exeArgs)
+			start := time.Now()
+			var err error
+			if childRC, err = spawn(exe, exeArgs, env); err != nil {
+				return err
+			}
+			w.LogInfo("exit status %d after %v", childRC, time.Since(start).Round(time.Millisecond))
 
 			return nil
 		}
 		w.LogInfo("exec cached: %v", exeArgs)
 
-		return syscall.Exec(exe, exeArgs, os.Environ())
+		return syscall.Exec(exe, exeArgs, env)
 	}
 
-	if err = exec(exePath); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			w.LogInfo("exec cached: %v", err)
-		} else {
-			w.LogWarn("exec cached: %v", err)
+	// formatMismatch reports err if it is an executable format mismatch, likely due to a wrong matcher.
+	formatMismatch := func(err error) bool {
+		var fe *exeFormatError
+		if !errors.As(err, &fe) {
+			return false
 		}
-	} else if cfg.dryRun {
-		return esSuccess
-	} else {
-		w.LogBug("unreachable; successful non-dry-run cache exec")
+		pattern := matchAll
+		if idxs, _ := selectURLMatches(osArch, cfg.urlMatches); len(idxs) != 0 {
+			pattern = cfg.urlMatches[idxs[0]].pattern
+		}
+		w.LogError("%v, check matcher %q for URL %s", err, pattern, ur)
+
+		return true
 	}
 
-	// Set up tempfile for download
+	if hshType != 0 {
+		for _, layer := range resolveCacheLayers() {
+			layerExePath, err := cacheLayerExePath(layer, hshType, expectedDigest, archiveExePath, extractPaths)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					w.LogInfo("cache layer %s: %v", layer, err)
+				} else {
+					w.LogWarn("cache layer %s: %v", layer, err)
+				}
 
-	tmpf, cleanUpTempFile, err := w.SetUpTempfile(filepath.Base(dlPath), filepath.Dir(dlPath))
-	if err != nil {
-		w.LogError("set up tempfile: %v", err)
+				continue
+			}
+			w.LogInfo("cache layer %s: path to executable: %s", layer, layerExePath)
+			if err = exec(layerExePath); formatMismatch(err) {
+				return "", esError
+			} else if err != nil {
+				w.LogWarn("exec cached: %v", err)
+			} else if noExec || cfg.spawn {
+				return ranExe, childRC
+			} else {
+				w.LogBug("unreachable; successful non-dry-run cache exec")
+			}
+		}
+	}
 
-		return esError
+	if entryComplete {
+		if entryDir != urlEntryDir {
+			linkURLEntry(w, urlEntryDir, entryDir)
+		}
+		touchCacheEntry(w, entryDir)
+		if err = exec(exePath); formatMismatch(err) {
+			return "", esError
+		} else if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				w.LogInfo("exec cached: %v", err)
+			} else {
+				w.LogWarn("exec cached: %v", err)
+			}
+		} else if noExec {
+			return ranExe, esSuccess
+		} else if cfg.spawn {
+			touchCacheEntry(w, entryDir) // last use is at exit of long running ones
+
+			return ranExe, childRC
+		} else {
+			w.LogBug("unreachable; successful non-dry-run cache exec")
+		}
+	} else if _, err = os.Lstat(entryDir); err == nil {
+		w.LogWarn("incomplete cache entry, repairing: %s", entryDir)
 	}
-	defer cleanUpTempFile() // Note: defer does not happen if we exec successfully
 
-	// Download and check digest
+	// Download and set up cache entry
 
-	resp, err := w.HTTPGet(ur.String())
+	exePath, err = downloadCacheEntry(w, spec)
 	if err != nil {
-		w.LogError("download: %v", err)
+		w.LogError("%v", err)
+		if policy.IsViolation(err) {
+			return "", esUsage
+		}
 
-		return esError
+		return "", esError
 	}
 
-	meta := make(map[string]string)
-	for _, key := range []string{"ETag", "Last-Modified"} {
-		meta[key] = resp.Header.Get(key)
-	}
+	// Execute
 
-	var hsh hash.Hash
-	if hshType != 0 {
-		hsh = hshType.New()
+	if err = exec(exePath); formatMismatch(err) {
+		return "", esError
+	} else if err != nil {
+		w.LogError("exec: %v", err)
+
+		return "", esError
+	} else if cfg.spawn {
+		touchCacheEntry(w, entryDir)
+
+		return ranExe, childRC
+	} else if !noExec {
+		w.LogBug("unreachable; successful non-dry-run exec")
 	}
-	if err = w.Download(resp, tmpf, hsh, expectedDigest); err != nil {
-		w.LogError("download: %v", err)
 
-		return esError
+	return ranExe, esSuccess
+}
+
+// cacheEntrySpec describes a download and the cache entry to set up for it.
+type cacheEntrySpec struct {
+	url            *url.URL
+	mirrors        []*url.URL // with the same digest as url, to fall back to in order
+	h              crypto.Hash
+	digest         []byte
+	archiveExePath string
+	extractPaths   []string
+	limits         archives.Limits
+	cacheDir       string
+	remoteCache    string
+	proxyURL       string
+}
+
+// urls gets the URL followed by its mirrors.
+func (spec cacheEntrySpec) urls() []*url.URL {
+	return append([]*url.URL{spec.url}, spec.mirrors...)
+}
+
+// entryDirs gets the cache entry dir for the download, and the URL keyed one.
+// They are the same for downloads without digests.
+// Both are keyed by the paths to extract as well if only some are extracted from the archive.
+func (spec cacheEntrySpec) entryDirs() (entryDir, urlEntryDir string) {
+	suffix := extractKey(spec.extractPaths)
+	urlEntryDir = filepath.Join(spec.cacheDir, cacheURLDir, urlDir(spec.url, spec.h, spec.digest)+suffix)
+	entryDir = urlEntryDir
+	if spec.h != 0 {
+		entryDir = filepath.Join(spec.cacheDir, cacheCASDir, digestKey(spec.h, spec.digest)+suffix)
 	}
 
-	// Move to final location, make executable
+	return entryDir, urlEntryDir
+}
 
-	if archiveExePath == "" {
-		if err = os.Rename(tmpf.Name(), exePath); err != nil {
-			w.LogError("rename tempfile: %v", err)
+// downloadCacheEntry downloads and sets up the cache entry for spec, and returns the path to the executable in it.
+func downloadCacheEntry(w *Wrun, spec cacheEntrySpec) (string, error) {
+	ur, archiveExePath := spec.url, spec.archiveExePath
+	entryDir, urlEntryDir := spec.entryDirs()
+	dlBase := urlBase(ur)
 
-			return esError
+	// Set up staging dir and tempfile for download
+
+	staging, err := newCacheStaging(entryDir)
+	if err != nil {
+		return "", fmt.Errorf("cache setup: %w", err)
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(staging); rmErr != nil {
+			w.LogWarn("remove staging dir: %v", rmErr)
 		}
-	} else {
-		if err = archiver.Unarchive(tmpf.Name(), dlPath); err != nil {
-			w.LogError("unarchive: %v", err)
+	}()
+	tmpf, cleanUpTempFile, err := w.SetUpTempfile(dlBase, staging)
+	if err != nil {
+		return "", err
+	}
+	defer cleanUpTempFile()
+	dlFile := tmpf.Name()
+
+	// Download and check digest, from remote cache if available, falling back to mirrors in order
+
+	meta := map[string]string{metadataURLKey: ur.String()}
+	fromRemoteCache := false
+	if spec.remoteCache != "" && spec.h != 0 && !isLocalURL(ur) && ur.Scheme != ociScheme {
+		if err = remoteCacheGet(w, spec.remoteCache, spec.h, spec.digest, tmpf); err == nil {
+			fromRemoteCache = true
+		} else if errors.Is(err, errRemoteCacheMiss) {
+			w.LogInfo("remote cache: %v", err)
+		} else {
+			w.LogWarn("remote cache: %v", err)
+		}
+	}
 
-			return esError
+	var srcURL *url.URL
+	if !fromRemoteCache {
+		urls := spec.urls()
+		var errs []error
+		for i, u := range urls {
+			srcFile, srcBase, err := fetchSource(w, spec, u, tmpf, staging, meta)
+			if err == nil {
+				srcURL = u
+				meta[metadataURLKey] = u.String()
+				if srcFile != "" {
+					dlFile, dlBase = srcFile, srcBase
+				}
+
+				break
+			}
+			if len(urls) != 1 {
+				w.LogWarn("%s: %v", u.Redacted(), err)
+			}
+			errs = append(errs, err)
+			if i == len(urls)-1 {
+				return "", errors.Join(errs...)
+			}
+			if err = resetFile(tmpf); err != nil {
+				return "", fmt.Errorf("reset tempfile: %w", err)
+			}
+		}
+		if srcURL != ur {
+			w.LogWarn("downloaded from mirror: %s", srcURL.Redacted())
+		} else {
+			w.LogInfo("downloaded from: %s", srcURL.Redacted())
+		}
+	}
+	if err = tmpf.Close(); err != nil {
+		return "", fmt.Errorf("close tempfile: %w", err)
+	}
+	if srcURL != nil && spec.remoteCache != "" && spec.h != 0 && !isLocalURL(srcURL) && srcURL.Scheme != ociScheme {
+		if err = remoteCachePut(w, spec.remoteCache, spec.h, spec.digest, tmpf.Name()); err != nil {
+			w.LogWarn("remote cache: %v", err)
 		}
 	}
-	if err = files.MakeExecutable(exePath); err != nil {
-		w.LogError("make executable: %v", err)
 
-		return esError
+	// Move to final location in staging dir, make executable
+
+	dlPath := filepath.Join(staging, dlBase)
+	stagedExePath := entryExePath(staging, dlBase, archiveExePath)
+	if archiveExePath == "" {
+		if err = os.Rename(dlFile, stagedExePath); err != nil {
+			return "", fmt.Errorf("rename tempfile: %w", err)
+		}
+	} else if err = archives.Extract(dlFile, dlPath, spec.limits, spec.extractPaths...); err != nil {
+		return "", fmt.Errorf("extract: %w", err)
+	}
+	if archiveExePath != "" && spec.h != 0 {
+		if err = os.Rename(dlFile, filepath.Join(staging, cacheEntryArchive)); err != nil {
+			w.LogWarn("keep archive: %v", err)
+		}
+	}
+	cleanUpTempFile()
+	if dlFile != tmpf.Name() {
+		if err = os.Remove(dlFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			w.LogWarn("remove download: %v", err)
+		}
+	}
+	if err = files.MakeExecutable(stagedExePath); err != nil {
+		return "", fmt.Errorf("make executable: %w", err)
 	}
 
 	// Write metadata
@@ -475,51 +1020,134 @@ func runRoot(w *Wrun, cfg *rootCmdConfig, args []string) exitStatus {
 	data, err := json.Marshal(meta)
 	if err != nil {
 		w.LogWarn("encode metadata: %v", err)
-	} else if err = os.WriteFile(dlPath+"-metadata.json", data, 0o666); err != nil {
+	} else if err = os.WriteFile(dlPath+metadataSuffix, data, 0o666); err != nil {
 		w.LogWarn("write metadata: %v", err)
 	}
 
-	// Execute
+	// Install staged entry to cache
 
-	cleanUpTempFile() // Note: deferred cleanup does not happen if we exec successfully
-	if err = exec(exePath); err != nil {
-		w.LogError("exec: %v", err)
+	dedupFiles(w, filepath.Join(spec.cacheDir, cacheObjectsDir), dlPath)
+	if err = installCacheEntry(w, staging, entryDir, dlBase); err != nil {
+		return "", fmt.Errorf("install cache entry: %w", err)
+	}
+	if entryDir != urlEntryDir {
+		linkURLEntry(w, urlEntryDir, entryDir)
+	}
+	content, _ := cacheEntryContent(entryDir)
+	if content == "" { // Concurrently installed one may differ from ours
+		content = dlBase
+	}
 
-		return esError
-	} else if !cfg.dryRun {
-		w.LogBug("unreachable; successful non-dry-run exec")
+	return entryExePath(entryDir, content, archiveExePath), nil
+}
+
+// fetchSource downloads u to tmpf, checking it against spec's digest, and stores response metadata to meta.
+// tmpf is not closed.
+// For OCI URLs, the download is to a separate file in staging instead, and its path and content name are returned.
+func fetchSource(w *Wrun, spec cacheEntrySpec, u *url.URL, tmpf *os.File, staging string, meta map[string]string) (dlFile, dlBase string, err error) {
+	var hsh hash.Hash
+	if spec.h != 0 {
+		hsh = spec.h.New()
 	}
+	dest := struct{ io.Writer }{tmpf} // Hide Close from Copy and Download
 
-	return esSuccess
+	switch {
+	case isLocalURL(u):
+		f, err := os.Open(localURLPath(u))
+		if err != nil {
+			return "", "", fmt.Errorf("copy: %w", err)
+		}
+		if err = w.Copy(f, dest, hsh, spec.digest); err != nil {
+			return "", "", fmt.Errorf("copy: %w", err)
+		}
+	case u.Scheme == ociScheme:
+		if dlFile, dlBase, err = ociDownload(w, u, spec.archiveExePath, staging); err != nil {
+			return "", "", fmt.Errorf("download: %w", err)
+		}
+		if spec.h != 0 {
+			got, err := fileDigest(dlFile, spec.h)
+			if err == nil && !bytes.Equal(got, spec.digest) {
+				err = fmt.Errorf("digest mismatch: expected %x, got %x", spec.digest, got)
+			}
+			if err != nil {
+				if rmErr := os.Remove(dlFile); rmErr != nil {
+					w.LogWarn("remove download: %v", rmErr)
+				}
+
+				return "", "", fmt.Errorf("download: %w", err)
+			}
+		}
+	default:
+		dlURL := u
+		if spec.proxyURL != "" {
+			if dlURL, err = proxyURL(spec.proxyURL, u); err != nil {
+				return "", "", fmt.Errorf("%s: %w", proxyURLEnvVar, err)
+			}
+		}
+		resp, err := w.HTTPGet(dlURL.String())
+		if err != nil {
+			return "", "", fmt.Errorf("download: %w", err)
+		}
+		if err = w.Download(resp, dest, hsh, spec.digest); err != nil {
+			return "", "", fmt.Errorf("download: %w", err)
+		}
+		for _, key := range []string{"ETag", "Last-Modified"} {
+			meta[key] = resp.Header.Get(key)
+		}
+	}
+
+	return dlFile, dlBase, nil
+}
+
+// resetFile truncates f and seeks to its start.
+func resetFile(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return f.Truncate(0)
 }
 
 // prepareArgs preprocesses command line arguments, prepending args from WRUN_ARGS_FILE to them.
 func prepareArgs(w *Wrun) error {
 	if os.Getenv(argsFileEnvVar) != "" {
-		if f, err := os.Open(os.Getenv(argsFileEnvVar)); err == nil {
-			defer func() {
-				if err = f.Close(); err != nil {
-					w.LogWarn("close %s: %v", f.Name, err)
-				}
-			}()
-			// Prepend args instead of appending,
-			// usual use case being having --url and --archive-exe-paths in the file,
-			// generated using the generate sub command.
-			// If we appended, would have to do it before a --, if any.
-			args := make([]string, 0, len(os.Args)+30)
-			args = append(args, os.Args[0])
-			s := bufio.NewScanner(bufio.NewReader(f))
-			for s.Scan() {
-				if arg := strings.TrimSpace(s.Text()); arg != "" && !strings.HasPrefix(arg, "#") {
-					args = append(args, arg)
-				}
-			}
-			args = append(args, os.Args[1:]...)
-			os.Args = args
-		} else {
+		fileArgs, err := readArgsFile(w, os.Getenv(argsFileEnvVar))
+		if err != nil {
 			return err
 		}
+		// Prepend args instead of appending,
+		// usual use case being having --url and --archive-exe-paths in the file,
+		// generated using the generate sub command.
+		// If we appended, would have to do it before a --, if any.
+		args := make([]string, 0, len(os.Args)+len(fileArgs))
+		args = append(args, os.Args[0])
+		args = append(args, fileArgs...)
+		args = append(args, os.Args[1:]...)
+		os.Args = args
 	}
 
 	return nil
 }
+
+// readArgsFile reads command line arguments from an args file, one per line.
+// Empty lines and ones starting with # are skipped.
+func readArgsFile(w *Wrun, pth string) ([]string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err = f.Close(); err != nil {
+			w.LogWarn("close %s: %v", f.Name(), err)
+		}
+	}()
+	var args []string
+	s := bufio.NewScanner(bufio.NewReader(f))
+	for s.Scan() {
+		if arg := strings.TrimSpace(s.Text()); arg != "" && !strings.HasPrefix(arg, "#") {
+			args = append(args, arg)
+		}
+	}
+
+	return args, s.Err()
+}
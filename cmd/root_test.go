@@ -18,7 +18,11 @@ package cmd
 
 import (
 	"crypto"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -63,11 +67,66 @@ func Test_parseFlags(t *testing.T) {
 		archiveExePathMatches: nil,
 	}
 	cfg := &rootCmdConfig{}
-	err := parseFlags(cfg, urlArgs, exePathArgs)
+	err := parseFlags(cfg, urlArgs, exePathArgs, nil, nil)
 	require.NoError(t, err)
 	assert.Equal(t, want, cfg)
 }
 
+func Test_parseFlags_invalidPatterns(t *testing.T) {
+	parsers := map[string]func(arg string) error{
+		"url": func(arg string) error {
+			return parseFlags(&rootCmdConfig{}, []string{arg + "=https://example.com/"}, nil, nil, nil)
+		},
+		"archive-exe-path": func(arg string) error {
+			return parseFlags(&rootCmdConfig{}, nil, []string{arg + "=tool"}, nil, nil)
+		},
+		"archive-extra-path": func(arg string) error {
+			return parseFlags(&rootCmdConfig{}, nil, nil, []string{arg + "=LICENSE"}, nil)
+		},
+		"os-arch-fallback": func(arg string) error {
+			return parseFlags(&rootCmdConfig{}, nil, nil, nil, []string{arg + "=linux/amd64"})
+		},
+	}
+	for _, pattern := range []string{"linux/[", "~linux/(", "~", "linux/*&", "!", "&linux/*"} {
+		for name, parse := range parsers {
+			t.Run(name+" "+pattern, func(t *testing.T) {
+				err := parse(pattern)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "invalid OS/arch matcher")
+			})
+		}
+	}
+}
+
+func Test_parseFlags_invalidFallbacks(t *testing.T) {
+	for _, arg := range []string{"", "linux/arm64=", "linux/arm64=amd64"} {
+		assert.Error(t, parseFlags(&rootCmdConfig{}, nil, nil, nil, []string{arg}), arg)
+	}
+}
+
+func Test_parseMatchArg(t *testing.T) {
+	for _, tt := range []struct {
+		arg, wantPattern, wantValue, wantErr string
+	}{
+		{"bin/tool", "*/*", "bin/tool", ""},
+		{"=bin/tool", "*/*", "bin/tool", ""},
+		{"linux/*=bin/tool", "linux/*", "bin/tool", ""},
+		{"linux/*=", "", "", "missing path"},
+		{"", "", "", "missing path"},
+		{"linux/[=bin/tool", "", "", "invalid OS/arch matcher"},
+	} {
+		pattern, value, err := parseMatchArg(tt.arg, "path")
+		if tt.wantErr != "" {
+			assert.ErrorContains(t, err, tt.wantErr, tt.arg)
+
+			continue
+		}
+		require.NoError(t, err, tt.arg)
+		assert.Equal(t, tt.wantPattern, pattern, tt.arg)
+		assert.Equal(t, tt.wantValue, value, tt.arg)
+	}
+}
+
 func Test_selectURL(t *testing.T) {
 	const base = "https://example.com/"
 	urlMatches := []urlMatch{
@@ -91,6 +150,18 @@ func Test_selectURL(t *testing.T) {
 			pattern: "linux/*",
 			url:     mustParseURL(t, base+"linux"),
 		},
+		{
+			pattern: "~^openbsd/amd64$",
+			url:     mustParseURL(t, base+"openbsd-amd64"),
+		},
+		{
+			pattern: "~bsd/",
+			url:     mustParseURL(t, base+"bsd"),
+		},
+		{
+			pattern: "*/arm&!windows/*",
+			url:     mustParseURL(t, base+"arm-not-windows"),
+		},
 		{
 			pattern: "*/386",
 			url:     mustParseURL(t, base+"386"),
@@ -129,16 +200,191 @@ func Test_selectURL(t *testing.T) {
 			osArch: "unknown/unknown",
 			want:   base + "generic",
 		},
+		{
+			osArch: "freebsd/amd64",
+			want:   base + "bsd",
+		},
+		{
+			osArch: "netbsd/386",
+			want:   base + "bsd",
+		},
+		{
+			osArch: "plan9/arm",
+			want:   base + "arm-not-windows",
+		},
+		{
+			osArch: "windows/arm",
+			want:   base + "generic",
+		},
+		{
+			osArch: "linux/amd64/v3/gnu",
+			want:   base + "linux-amd64",
+		},
+		{
+			osArch: "openbsd/amd64/v2",
+			want:   base + "openbsd-amd64",
+		},
+		{
+			osArch: "freebsd/amd64/v3",
+			want:   base + "bsd",
+		},
+		{
+			osArch: "plan9/arm/v7",
+			want:   base + "arm-not-windows",
+		},
+		{
+			osArch: "windows/arm/v7",
+			want:   base + "generic",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osArch, func(t *testing.T) {
+			urls, err := selectURLs(tt.osArch, urlMatches)
+			require.NoError(t, err)
+			require.Len(t, urls, 1)
+			assert.Equal(t, tt.want, urls[0].String())
+		})
+	}
+}
+
+func Test_selectURL_libc(t *testing.T) {
+	const base = "https://example.com/"
+	urlMatches := []urlMatch{
+		{pattern: "linux/amd64/musl", url: mustParseURL(t, base+"linux-amd64-musl")},
+		{pattern: "linux/amd64/gnu", url: mustParseURL(t, base+"linux-amd64-gnu")},
+		{pattern: "linux/amd64", url: mustParseURL(t, base+"linux-amd64")},
+		{pattern: "linux/*/musl", url: mustParseURL(t, base+"linux-musl")},
+		{pattern: "*/*", url: mustParseURL(t, base+"generic")},
+	}
+
+	tests := []struct {
+		osArch string
+		want   string
+	}{
+		{"linux/amd64/musl", base + "linux-amd64-musl"},
+		{"linux/amd64/gnu", base + "linux-amd64-gnu"},
+		{"linux/amd64", base + "linux-amd64"},
+		{"linux/amd64/unknown", base + "linux-amd64"},
+		{"linux/arm64/musl", base + "linux-musl"},
+		{"linux/arm64/gnu", base + "generic"},
+		{"linux/arm64", base + "generic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osArch, func(t *testing.T) {
+			urls, err := selectURLs(tt.osArch, urlMatches)
+			require.NoError(t, err)
+			require.Len(t, urls, 1)
+			assert.Equal(t, tt.want, urls[0].String())
+		})
+	}
+}
+
+func Test_selectURL_levels(t *testing.T) {
+	const base = "https://example.com/"
+	urlMatches := []urlMatch{
+		{pattern: "linux/amd64/v4", url: mustParseURL(t, base+"linux-amd64-v4")},
+		{pattern: "linux/amd64/v3", url: mustParseURL(t, base+"linux-amd64-v3")},
+		{pattern: "linux/amd64", url: mustParseURL(t, base+"linux-amd64")},
+		{pattern: "linux/arm/v7", url: mustParseURL(t, base+"linux-armv7")},
+		{pattern: "linux/arm/v6", url: mustParseURL(t, base+"linux-armv6")},
+	}
+
+	tests := []struct {
+		osArch string
+		want   string
+	}{
+		{"linux/amd64/v4", base + "linux-amd64-v4"},
+		{"linux/amd64/v3/gnu", base + "linux-amd64-v3"},
+		{"linux/amd64/v2", base + "linux-amd64"},
+		{"linux/amd64", base + "linux-amd64"},
+		{"linux/arm/v7", base + "linux-armv7"},
+		{"linux/arm/v6/musl", base + "linux-armv6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osArch, func(t *testing.T) {
+			urls, err := selectURLs(tt.osArch, urlMatches)
+			require.NoError(t, err)
+			require.Len(t, urls, 1)
+			assert.Equal(t, tt.want, urls[0].String())
+		})
+	}
+}
+
+func Test_selectURLs_mirrors(t *testing.T) {
+	const fragment = "#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	urlMatches := []urlMatch{
+		{pattern: "linux/amd64", url: mustParseURL(t, "https://example.com/linux-amd64"+fragment)},
+		{pattern: "linux/*", url: mustParseURL(t, "https://example.com/linux-amd64"+fragment)},
+		{pattern: "linux/*", url: mustParseURL(t, "https://example.com/other"+fragment[:len(fragment)-1]+"5")},
+		{pattern: "linux/*", url: mustParseURL(t, "https://mirror.example.com/linux-amd64"+fragment)},
+		{pattern: "darwin/*", url: mustParseURL(t, "https://mirror.example.com/darwin"+fragment)},
+		{pattern: "*/*", url: mustParseURL(t, "https://example.com/generic")},
+		{pattern: "*/*", url: mustParseURL(t, "https://mirror.example.com/generic")},
+	}
+
+	tests := []struct {
+		osArch string
+		want   []string
+	}{
+		{"linux/amd64", []string{"https://example.com/linux-amd64" + fragment, "https://mirror.example.com/linux-amd64" + fragment}},
+		{"darwin/arm64", []string{"https://mirror.example.com/darwin" + fragment}},
+		{"windows/amd64", []string{"https://example.com/generic"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.osArch, func(t *testing.T) {
-			ur, err := selectURL(tt.osArch, urlMatches)
+			urls, err := selectURLs(tt.osArch, urlMatches)
 			require.NoError(t, err)
-			assert.Equal(t, tt.want, ur.String())
+			got := make([]string, 0, len(urls))
+			for _, u := range urls {
+				got = append(got, u.String())
+			}
+			assert.Equal(t, tt.want, got)
 		})
 	}
 }
 
+func Test_downloadCacheEntry_mirrors(t *testing.T) {
+	w := NewWrun("wrun-test")
+	content := []byte("tool")
+	digest := sha256.Sum256(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down/tool":
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		case "/bad/tool":
+			_, _ = rw.Write([]byte("tampered"))
+		default:
+			_, _ = rw.Write(content)
+		}
+	}))
+	defer srv.Close()
+	fragment := "#" + digestKey(crypto.SHA256, digest[:])
+
+	spec := cacheEntrySpec{
+		url:      mustParseURL(t, srv.URL+"/down/tool"+fragment),
+		mirrors:  []*url.URL{mustParseURL(t, srv.URL+"/bad/tool"+fragment), mustParseURL(t, srv.URL+"/good/tool"+fragment)},
+		h:        crypto.SHA256,
+		digest:   digest[:],
+		cacheDir: t.TempDir(),
+	}
+	exePath, err := downloadCacheEntry(w, spec)
+	require.NoError(t, err)
+	data, err := os.ReadFile(exePath)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	entryDir, _ := spec.entryDirs()
+	cont, _ := cacheEntryContent(entryDir)
+	srcURL, err := entryURL(entryDir, cont)
+	require.NoError(t, err)
+	assert.Equal(t, spec.mirrors[1].String(), srcURL.String(), "metadata records the mirror used")
+
+	spec.mirrors = spec.mirrors[:1]
+	spec.cacheDir = t.TempDir()
+	_, err = downloadCacheEntry(w, spec)
+	require.ErrorContains(t, err, "503")
+	require.ErrorContains(t, err, "digest mismatch")
+}
+
 func Test_selectArchiveExePath(t *testing.T) {
 	matches := []archiveExePathMatch{
 		{
@@ -297,3 +543,45 @@ func Test_prepareHash(t *testing.T) {
 		})
 	}
 }
+
+func Test_selectArchiveExtraPaths(t *testing.T) {
+	matches := []archiveExtraPathMatch{
+		{
+			pattern: "linux/*",
+			path:    "lib/linux",
+		},
+		{
+			pattern: "*/amd64",
+			path:    "lib/amd64",
+		},
+		{
+			pattern: "*/*",
+			path:    "share",
+		},
+	}
+
+	tests := []struct {
+		osArch string
+		want   []string
+	}{
+		{
+			osArch: "linux/amd64",
+			want:   []string{"lib/linux", "lib/amd64", "share"},
+		},
+		{
+			osArch: "linux/arm64",
+			want:   []string{"lib/linux", "share"},
+		},
+		{
+			osArch: "darwin/arm64",
+			want:   []string{"share"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.osArch, func(t *testing.T) {
+			paths, err := selectArchiveExtraPaths(tt.osArch, matches)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, paths)
+		})
+	}
+}
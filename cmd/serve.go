@@ -0,0 +1,437 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/hashes"
+	"github.com/scop/wrun/internal/policy"
+)
+
+const (
+	cacheProxyDir             = "proxy" // downloads served by wrun serve, keyed by URL
+	defaultServeListen        = "localhost:8080"
+	defaultServeUndigestedTTL = 24 * time.Hour
+	proxyContentName          = "download" // name for proxied downloads whose URL has no usable basename
+)
+
+var errProxyPath = errors.New("invalid proxy path, use [/hashAlgo-hexDigest]/scheme/host/path")
+
+// resolveProxyURL gets the base URL of the wrun serve proxy to download through, empty if not configured.
+func resolveProxyURL() (string, error) {
+	base := os.Getenv(proxyURLEnvVar)
+	if base == "" {
+		return "", nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", proxyURLEnvVar, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s: unsupported URL scheme: %q", proxyURLEnvVar, u.Scheme)
+	}
+
+	return base, nil
+}
+
+// checkDownloadURL checks u against the download policy,
+// and if it would be downloaded through the wrun serve proxy at proxyBase, the URL it is downloaded from as well.
+func checkDownloadURL(pol policy.Policy, proxyBase string, u *url.URL) error {
+	if err := pol.CheckURL(u); err != nil {
+		return err
+	}
+	if proxyBase == "" || isLocalURL(u) || u.Scheme == ociScheme {
+		return nil
+	}
+	pu, err := proxyURL(proxyBase, u)
+	if err != nil {
+		return err
+	}
+
+	return pol.CheckURL(pu)
+}
+
+// checkDownloadURLs checks u and its mirrors using checkDownloadURL, and returns the allowed mirrors.
+// Disallowed mirrors are skipped with a warning, only u being disallowed is an error.
+func checkDownloadURLs(w *Wrun, pol policy.Policy, proxyBase string, u *url.URL, mirrors []*url.URL) ([]*url.URL, error) {
+	if err := checkDownloadURL(pol, proxyBase, u); err != nil {
+		return nil, err
+	}
+	var allowed []*url.URL
+	for _, mirror := range mirrors {
+		if err := checkDownloadURL(pol, proxyBase, mirror); err != nil {
+			w.LogWarn("download policy: skipping mirror %s: %v", mirror.Redacted(), err)
+
+			continue
+		}
+		allowed = append(allowed, mirror)
+	}
+
+	return allowed, nil
+}
+
+// proxyURL rewrites u to be downloaded through the wrun serve proxy at base.
+// The digest in u's fragment, if any, is passed to the proxy in the path, and kept as the fragment.
+func proxyURL(base string, u *url.URL) (*url.URL, error) {
+	segs := make([]string, 0, 4)
+	if u.Fragment != "" {
+		segs = append(segs, u.Fragment)
+	}
+	segs = append(segs, u.Scheme, u.Host, u.Path)
+	pu, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	pu = pu.JoinPath(segs...)
+	pu.RawQuery = u.RawQuery
+	pu.Fragment = u.Fragment
+
+	return pu, nil
+}
+
+// parseProxyPath parses a wrun serve proxy request path to the upstream URL and expected digest.
+// It is the inverse of proxyURL.
+func parseProxyPath(u *url.URL) (*url.URL, crypto.Hash, []byte, error) {
+	p := strings.TrimPrefix(u.Path, "/")
+	var h crypto.Hash
+	digest := []byte{}
+	if first, rest, found := strings.Cut(p, "/"); found && first != "http" && first != "https" {
+		var err error
+		if h, digest, err = hashes.ParseHashFragment(first); err != nil {
+			return nil, 0, nil, fmt.Errorf("%w: %w", errProxyPath, err)
+		}
+		p = rest
+	}
+	segs := strings.SplitN(p, "/", 3)
+	if len(segs) != 3 || (segs[0] != "http" && segs[0] != "https") {
+		return nil, 0, nil, errProxyPath
+	}
+	// Host and path segments become cache dir path components, reject ones that would not stay within it
+	for _, seg := range append([]string{segs[1]}, strings.Split(segs[2], "/")...) {
+		if seg == "" || seg == "." || seg == ".." || strings.Contains(seg, `\`) {
+			return nil, 0, nil, errProxyPath
+		}
+	}
+	ur := &url.URL{
+		Scheme:   segs[0],
+		Host:     segs[1],
+		Path:     "/" + segs[2],
+		RawQuery: u.RawQuery,
+	}
+	if h != 0 {
+		ur.Fragment = digestKey(h, digest)
+	}
+
+	return ur, h, digest, nil
+}
+
+// isLoopbackListen tells if the listen address addr is on a loopback interface only.
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// proxyFetch is an in-flight fetch of an upstream URL, shared by concurrent requests for it.
+type proxyFetch struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// proxyServer is the wrun serve HTTP handler.
+type proxyServer struct {
+	w         *Wrun
+	cacheDir  string
+	policy    policy.Policy
+	accessLog io.Writer
+	// undigestedTTL is how long downloads requested without digests are served from the cache,
+	// as their content may change upstream
+	undigestedTTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*proxyFetch
+}
+
+func newProxyServer(w *Wrun, cacheDir string, pol policy.Policy, accessLog io.Writer, undigestedTTL time.Duration) *proxyServer {
+	return &proxyServer{
+		w:             w,
+		cacheDir:      cacheDir,
+		policy:        pol,
+		accessLog:     accessLog,
+		undigestedTTL: undigestedTTL,
+		inflight:      make(map[string]*proxyFetch),
+	}
+}
+
+// cached gets the name of the content in the proxy cache entry entryDir, if it is complete and not expired.
+func (s *proxyServer) cached(entryDir string, h crypto.Hash) (string, bool) {
+	content, ok := cacheEntryContent(entryDir)
+	if ok && h == 0 {
+		fi, err := os.Stat(filepath.Join(entryDir, cacheEntryCompleteMarker))
+		ok = err == nil && time.Since(fi.ModTime()) < s.undigestedTTL
+	}
+
+	return content, ok
+}
+
+// accessLogResponseWriter records response status and size for access logging.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (lrw *accessLogResponseWriter) WriteHeader(status int) {
+	lrw.status = status
+	lrw.ResponseWriter.WriteHeader(status)
+}
+
+func (lrw *accessLogResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.size += int64(n)
+
+	return n, err
+}
+
+func (s *proxyServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lrw := &accessLogResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+	cacheStatus := "-"
+	defer func() {
+		fmt.Fprintf(s.accessLog, "%s %s %s %s %d %d %s %s\n",
+			start.Format(time.RFC3339), r.RemoteAddr, r.Method, r.URL.RequestURI(),
+			lrw.status, lrw.size, cacheStatus, time.Since(start).Round(time.Millisecond))
+	}()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		lrw.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(lrw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+
+		return
+	}
+	ur, h, digest, err := parseProxyPath(r.URL)
+	if err != nil {
+		http.Error(lrw, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if err = s.policy.CheckURL(ur); err != nil {
+		http.Error(lrw, err.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	pth, hit, err := s.fetch(ur, h, digest)
+	if err != nil {
+		s.w.LogWarn("serve %s: %v", ur, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errProxyPath) {
+			status = http.StatusBadRequest
+		}
+		http.Error(lrw, err.Error(), status)
+
+		return
+	}
+	cacheStatus = "miss"
+	if hit {
+		cacheStatus = "hit"
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		s.w.LogWarn("serve %s: %v", ur, err)
+		http.Error(lrw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		s.w.LogWarn("serve %s: %v", ur, err)
+		http.Error(lrw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+		return
+	}
+	lrw.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(lrw, r, "", fi.ModTime(), f)
+}
+
+// fetch gets the path to the cached download of ur, downloading it first if necessary.
+// hit tells whether it was in the cache already.
+// Concurrent fetches of the same URL share one download.
+func (s *proxyServer) fetch(ur *url.URL, h crypto.Hash, digest []byte) (pth string, hit bool, err error) {
+	entryRel := urlDir(ur, h, digest)
+	if !filepath.IsLocal(entryRel) {
+		return "", false, fmt.Errorf("%w: cache entry outside proxy dir: %s", errProxyPath, entryRel)
+	}
+	entryDir := filepath.Join(s.cacheDir, cacheProxyDir, entryRel)
+	if content, ok := s.cached(entryDir, h); ok {
+		return filepath.Join(entryDir, content), true, nil
+	}
+
+	s.mu.Lock()
+	if f, found := s.inflight[entryDir]; found {
+		s.mu.Unlock()
+		<-f.done
+
+		return f.path, false, f.err
+	}
+	f := &proxyFetch{done: make(chan struct{})}
+	s.inflight[entryDir] = f
+	s.mu.Unlock()
+
+	f.path, f.err = s.download(ur, h, digest, entryDir)
+
+	s.mu.Lock()
+	delete(s.inflight, entryDir)
+	s.mu.Unlock()
+	close(f.done)
+
+	return f.path, false, f.err
+}
+
+// download downloads ur and installs it to the proxy cache entry entryDir.
+func (s *proxyServer) download(ur *url.URL, h crypto.Hash, digest []byte, entryDir string) (string, error) {
+	if content, ok := s.cached(entryDir, h); ok { // Completed while we were waiting
+		return filepath.Join(entryDir, content), nil
+	}
+
+	content := path.Base(ur.Path)
+	if content == "/" || content == "." || content == ".." || strings.HasPrefix(content, ".wrun-") {
+		content = proxyContentName
+	}
+
+	staging, err := newCacheStaging(entryDir)
+	if err != nil {
+		return "", fmt.Errorf("cache setup: %w", err)
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(staging); rmErr != nil {
+			s.w.LogWarn("remove staging dir: %v", rmErr)
+		}
+	}()
+	tmpf, cleanUpTempFile, err := s.w.SetUpTempfile(content, staging)
+	if err != nil {
+		return "", err
+	}
+	defer cleanUpTempFile()
+
+	resp, err := s.w.HTTPGet(ur.String())
+	if err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	var hsh hash.Hash
+	if h != 0 {
+		hsh = h.New()
+	}
+	if err = s.w.Download(resp, tmpf, hsh, digest); err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	if err = os.Rename(tmpf.Name(), filepath.Join(staging, content)); err != nil {
+		return "", fmt.Errorf("rename tempfile: %w", err)
+	}
+	if err = installCacheEntry(s.w, staging, entryDir, content); err != nil {
+		return "", fmt.Errorf("install cache entry: %w", err)
+	}
+	if content, _ = cacheEntryContent(entryDir); content == "" { // Concurrently installed one may differ from ours
+		return "", fmt.Errorf("cache entry vanished: %s", entryDir)
+	}
+
+	return filepath.Join(entryDir, content), nil
+}
+
+func serveCommand(w *Wrun) *cobra.Command {
+	var listen string
+	var undigestedTTL time.Duration
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "serve downloads through a caching HTTP proxy",
+		Long: fmt.Sprintf(`serve downloads through a caching HTTP proxy
+
+Upstream URLs are fetched on demand, stored in the cache, and served locally on repeat requests.
+Request paths are of the form [/hashAlgo-hexDigest]/scheme/host/path, for example
+/sha256-2cf2.../https/example.com/tool.tar.gz for https://example.com/tool.tar.gz#sha256-2cf2....
+Downloads are verified against digests given in request paths.
+Ones requested without digests are served from the cache only for --undigested-ttl, as their content may change upstream.
+
+Clients can be pointed at the proxy with the %s environment variable.
+The download policy environment variables apply to upstream URLs.
+
+The proxy fetches from any host unless %s is set, and it listens only on loopback by default.
+When listening on other addresses, set %s to the hosts to allow,
+as the proxy would otherwise relay requests to any host reachable from it, including internal ones.
+
+An access log line is written to standard output for each request.`, proxyURLEnvVar, allowedHostsEnvVar, allowedHostsEnvVar),
+		ValidArgsFunction: cobra.NoFileCompletions,
+		Args:              cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			pol, err := resolvePolicy()
+			if err != nil {
+				w.LogError("download policy: %v", err)
+				os.Exit(esUsage)
+			}
+			w.setPolicy(pol)
+			if len(pol.AllowedHosts) == 0 && !isLoopbackListen(listen) {
+				w.LogWarn("listening on %s without %s, proxying requests to any host", listen, allowedHostsEnvVar)
+			}
+			cacheHome, err := resolveCacheHome()
+			if err != nil {
+				w.LogError("cache setup: %v", err)
+				os.Exit(esError)
+			}
+			autoMigrateCache(w, cacheHome)
+
+			srv := &http.Server{
+				Addr:              listen,
+				Handler:           newProxyServer(w, filepath.Join(cacheHome, cacheVersion), pol, os.Stdout, undigestedTTL),
+				ReadHeaderTimeout: 30 * time.Second,
+			}
+			w.LogInfo("serving on %s", listen)
+			if err = srv.ListenAndServe(); err != nil {
+				w.LogError("serve: %v", err)
+				os.Exit(esError)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&listen, "listen", "l", defaultServeListen, "address to listen on")
+	cmd.Flags().DurationVar(&undigestedTTL, "undigested-ttl", defaultServeUndigestedTTL, "time to serve downloads requested without digests from the cache, 0 disables caching them")
+
+	return cmd
+}
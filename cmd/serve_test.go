@@ -0,0 +1,275 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/policy"
+)
+
+func Test_proxyURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://example.com/dl/tool.tar.gz", "http://proxy:8080/wrun/https/example.com/dl/tool.tar.gz"},
+		{"http://example.com:8000/tool?x=y", "http://proxy:8080/wrun/http/example.com:8000/tool?x=y"},
+		{"https://example.com/tool#sha256-00ff", "http://proxy:8080/wrun/sha256-00ff/https/example.com/tool#sha256-00ff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			pu, err := proxyURL("http://proxy:8080/wrun", u)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, pu.String())
+
+			pu.Path = strings.TrimPrefix(pu.Path, "/wrun")
+			ur, _, _, err := parseProxyPath(pu)
+			require.NoError(t, err)
+			assert.Equal(t, tt.url, ur.String())
+		})
+	}
+}
+
+func Test_parseProxyPath_invalid(t *testing.T) {
+	for _, p := range []string{
+		"/", "/https", "/https/example.com", "/https/example.com/", "/ftp/example.com/x", "/foo-00/https/example.com/x",
+		"/https/example.com/../../../../tmp/x", "/https/../..", "/https/./x", "/https/example.com/a//b", "/https/example.com/a/./b",
+		`/https/example.com/a\..\..\b`,
+	} {
+		_, _, _, err := parseProxyPath(&url.URL{Path: p})
+		require.ErrorIs(t, err, errProxyPath, p)
+	}
+}
+
+func Test_proxyServer(t *testing.T) {
+	content := []byte("tool content")
+	digest := sha256.Sum256(content)
+	var upstreamHits atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		if r.URL.Path == "/bad" {
+			_, _ = rw.Write([]byte("tampered"))
+
+			return
+		}
+		_, _ = rw.Write(content)
+	}))
+	defer upstream.Close()
+	uu, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	accessLog := &lockedBuffer{}
+	srv := httptest.NewServer(newProxyServer(NewWrun("wrun-test"), t.TempDir(), policy.Policy{}, accessLog, defaultServeUndigestedTTL))
+	defer srv.Close()
+
+	get := func(t *testing.T, upstreamPath string) (int, []byte) {
+		t.Helper()
+		u := &url.URL{Scheme: "http", Host: uu.Host, Path: upstreamPath, Fragment: digestKey(crypto.SHA256, digest[:])}
+		pu, err := proxyURL(srv.URL, u)
+		require.NoError(t, err)
+		resp, err := http.Get(pu.String())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp.StatusCode, body
+	}
+
+	// Concurrent requests share one upstream fetch
+	const n = 5
+	var wg sync.WaitGroup
+	statuses := make([]int, n)
+	bodies := make([][]byte, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], bodies[i] = get(t, "/tool")
+		}()
+	}
+	<-started
+	close(release)
+	wg.Wait()
+	for i := range n {
+		assert.Equal(t, http.StatusOK, statuses[i])
+		assert.Equal(t, content, bodies[i])
+	}
+	assert.Equal(t, int32(1), upstreamHits.Load())
+
+	// Repeat requests are served from cache
+	status, body := get(t, "/tool")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, content, body)
+	assert.Equal(t, int32(1), upstreamHits.Load())
+
+	// Digest mismatches are not served
+	status, _ = get(t, "/bad")
+	assert.Equal(t, http.StatusBadGateway, status)
+
+	// Invalid paths are rejected
+	resp, err := http.Get(srv.URL + "/ftp/example.com/tool")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	srv.Close() // Waits for access log writes
+	assert.Contains(t, accessLog.String(), " 200 12 hit ")
+	assert.Contains(t, accessLog.String(), " 502 ")
+}
+
+func Test_proxyServer_traversal(t *testing.T) {
+	parent := t.TempDir()
+	cacheDir := filepath.Join(parent, "cache")
+	s := newProxyServer(NewWrun("wrun-test"), cacheDir, policy.Policy{}, io.Discard, defaultServeUndigestedTTL)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, p := range []string{"/https/example.com/../../../../x", "/https/../..", "/https/example.com/%2e%2e/%2e%2e/%2e%2e/x", "/http/%2e%2e/x"} {
+		resp, err := http.Get(srv.URL + p)
+		require.NoError(t, err, p)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, p)
+	}
+	_, _, err := s.fetch(&url.URL{Scheme: "https", Host: "..", Path: "/../../x"}, 0, nil)
+	require.ErrorIs(t, err, errProxyPath)
+	des, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Empty(t, des, "nothing written outside the cache")
+}
+
+func Test_isLoopbackListen(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"localhost:8080":  true,
+		"127.0.0.1:8080":  true,
+		"[::1]:8080":      true,
+		":8080":           false,
+		"0.0.0.0:8080":    false,
+		"192.0.2.1:8080":  false,
+		"proxy.lan:8080":  false,
+		"invalid address": false,
+	} {
+		assert.Equal(t, want, isLoopbackListen(addr), addr)
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(b []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	return lb.buf.Write(b)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	return lb.buf.String()
+}
+
+func Test_proxyServer_undigestedTTL(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		upstreamHits.Add(1)
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer upstream.Close()
+	digest := sha256.Sum256([]byte("content"))
+
+	for _, tt := range []struct {
+		ttl      time.Duration
+		fragment string
+		wantHits int32
+	}{
+		{time.Hour, "", 1},
+		{0, "", 2},
+		{0, digestKey(crypto.SHA256, digest[:]), 1},
+	} {
+		upstreamHits.Store(0)
+		srv := httptest.NewServer(newProxyServer(NewWrun("wrun-test"), t.TempDir(), policy.Policy{}, io.Discard, tt.ttl))
+		u := mustParseURL(t, upstream.URL+"/tool")
+		u.Fragment = tt.fragment
+		pu, err := proxyURL(srv.URL, u)
+		require.NoError(t, err)
+		for range 2 {
+			resp, err := http.Get(pu.String())
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+		srv.Close()
+		assert.Equal(t, tt.wantHits, upstreamHits.Load(), "TTL %v, fragment %q", tt.ttl, tt.fragment)
+	}
+}
+
+func Test_checkDownloadURL(t *testing.T) {
+	pol := policy.Policy{HTTPSOnly: true}
+	u := mustParseURL(t, "https://example.com/tool")
+	require.NoError(t, checkDownloadURL(pol, "", u))
+	require.NoError(t, checkDownloadURL(pol, "https://proxy.example.com", u))
+	require.ErrorIs(t, checkDownloadURL(pol, "http://proxy.example.com", u), policy.ErrInsecureScheme)
+	require.NoError(t, checkDownloadURL(pol, "http://proxy.example.com", mustParseURL(t, "/vendor/tool")))
+
+	pol = policy.Policy{AllowedHosts: []string{"example.com"}}
+	require.ErrorIs(t, checkDownloadURL(pol, "https://proxy.example.net", u), policy.ErrHostNotAllowed)
+}
+
+func Test_checkDownloadURLs(t *testing.T) {
+	w := NewWrun("wrun-test")
+	pol := policy.Policy{HTTPSOnly: true}
+	u := mustParseURL(t, "https://example.com/tool")
+	mirrors := []*url.URL{
+		mustParseURL(t, "http://mirror.example.com/tool"),
+		mustParseURL(t, "https://mirror.example.net/tool"),
+	}
+	allowed, err := checkDownloadURLs(w, pol, "", u, mirrors)
+	require.NoError(t, err)
+	assert.Equal(t, mirrors[1:], allowed)
+
+	_, err = checkDownloadURLs(w, pol, "", mirrors[0], mirrors[1:])
+	require.ErrorIs(t, err, policy.ErrInsecureScheme)
+}
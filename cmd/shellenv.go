@@ -0,0 +1,216 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Shells supported by shellenv.
+const (
+	shellBash = "bash"
+	shellZsh  = "zsh"
+	shellFish = "fish"
+)
+
+// detectShell gets the shell to emit shellenv output for based on $SHELL, defaulting to bash.
+func detectShell() string {
+	switch shell := filepath.Base(os.Getenv("SHELL")); shell {
+	case shellZsh, shellFish:
+		return shell
+	}
+
+	return shellBash
+}
+
+// posixQuote quotes s for POSIX shells.
+func posixQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// writeShellEnv writes shell code to out for the given shell that puts dirs first on PATH, in order.
+func writeShellEnv(out io.Writer, shell string, dirs []string) error {
+	var err error
+	switch shell {
+	case shellBash, shellZsh:
+		_, err = fmt.Fprintf(out, "export PATH=%s\"${PATH:+:$PATH}\"\n", posixQuote(strings.Join(dirs, ":")))
+	case shellFish:
+		quoted := make([]string, len(dirs))
+		for i, dir := range dirs {
+			quoted[i] = fishQuote(dir)
+		}
+		_, err = fmt.Fprintf(out, "set -gx PATH %s $PATH\n", strings.Join(quoted, " "))
+	default:
+		err = fmt.Errorf("unsupported shell %q, use %s, %s, or %s", shell, shellBash, shellZsh, shellFish)
+	}
+
+	return err
+}
+
+// shellEnvDirs resolves, downloads, and verifies the executables in argsFiles like --print-path,
+// and returns their distinct directories in order.
+// Executables not extracted from archives are named after their URLs in the cache,
+// so symlinks to them named after their args files are set up in a bin dir, see shellEnvBinDir.
+// It is placed on PATH where the first of them would be.
+func shellEnvDirs(w *Wrun, argsFiles []string) ([]string, exitStatus) {
+	var dirs []string
+	binDirIdx := -1
+	links := make(map[string]string)
+	for _, argsFile := range argsFiles {
+		cfg, err := parseArgsFile(w, argsFile)
+		if err != nil {
+			w.LogError("%v", err)
+
+			return nil, esUsage
+		}
+		cfg.printPath = true
+		exePath, rc := runRootExe(w, cfg, nil)
+		if rc != esSuccess {
+			w.LogError("%s: failed to set up executable", argsFile)
+
+			return nil, rc
+		}
+		dir := filepath.Dir(exePath)
+		if content, ok := cacheEntryContent(dir); !ok || content != filepath.Base(exePath) {
+			if !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(argsFile), filepath.Ext(argsFile))
+		if strings.EqualFold(filepath.Ext(exePath), ".exe") {
+			name += filepath.Ext(exePath)
+		}
+		if target, found := links[name]; found {
+			if target != exePath {
+				w.LogWarn("%s: %s already set up from an earlier args file, skipping", argsFile, name)
+			}
+
+			continue
+		}
+		links[name] = exePath
+		if binDirIdx == -1 {
+			binDirIdx = len(dirs)
+			dirs = append(dirs, "")
+		}
+	}
+	if binDirIdx != -1 {
+		cacheHome, err := resolveCacheHome()
+		if err == nil {
+			dirs[binDirIdx], err = shellEnvBinDir(w, filepath.Join(cacheHome, cacheVersion), links)
+		}
+		if err != nil {
+			w.LogError("set up bin dir: %v", err)
+
+			return nil, esError
+		}
+	}
+
+	return dirs, esSuccess
+}
+
+// shellEnvBinDir sets up a dir in the cache at cacheDir with symlinks named after the keys of links to their values,
+// and returns its path.
+// The dir is keyed by the links, so it is shared by invocations with the same executables, and never modified once set up.
+func shellEnvBinDir(w *Wrun, cacheDir string, links map[string]string) (string, error) {
+	names := slices.Sorted(maps.Keys(links))
+	hsh := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hsh, "%s\x00%s\x00", name, links[name])
+	}
+	binDir := filepath.Join(cacheDir, cacheBinDir, hex.EncodeToString(hsh.Sum(nil)[:16]))
+	if _, err := os.Stat(binDir); err == nil {
+		return binDir, nil
+	}
+	staging, err := newCacheStaging(binDir)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			w.LogWarn("remove staging dir: %v", err)
+		}
+	}()
+	for _, name := range names {
+		if err = os.Symlink(links[name], filepath.Join(staging, name)); err != nil {
+			return "", err
+		}
+	}
+	if err = os.Rename(staging, binDir); err != nil {
+		if _, statErr := os.Stat(binDir); statErr != nil { // Not set up concurrently
+			return "", err
+		}
+	}
+
+	return binDir, nil
+}
+
+func shellenvCommand(w *Wrun) *cobra.Command {
+	var shell string
+	cmd := &cobra.Command{
+		Use:   "shellenv [flags] FILE...",
+		Short: "output shell code to put executables in args files first on PATH",
+		Long: `output shell code to put executables in args files first on PATH
+
+Args files are parsed for URL and archive related flags as with ` + argsFileEnvVar + `,
+and the executables in them are set up in the cache as with --print-path.
+Shell code that puts their directories first on PATH, in order, is output.
+Executables that are not extracted from archives are named after their URLs in the cache,
+so a dir of symlinks to them named after their args files without extensions is put on PATH instead,
+for example tool for .wrun/tool.args.
+The shell defaults to one detected from $SHELL, and to bash if it is not supported.`,
+		Example: `eval "$(wrun shellenv .wrun/*.args)"
+wrun shellenv --shell fish .wrun/*.args | source`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			if shell == "" {
+				shell = detectShell()
+			}
+			if err := writeShellEnv(io.Discard, shell, nil); err != nil {
+				w.LogError("%v", err)
+				os.Exit(esUsage)
+			}
+			dirs, rc := shellEnvDirs(w, args)
+			if rc != esSuccess {
+				os.Exit(rc)
+			}
+			if err := writeShellEnv(os.Stdout, shell, dirs); err != nil {
+				w.LogError("%v", err)
+				os.Exit(esError)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&shell, "shell", "", "shell to output code for: "+shellBash+", "+shellZsh+", or "+shellFish)
+
+	return cmd
+}
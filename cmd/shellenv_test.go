@@ -0,0 +1,106 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeShellEnv(t *testing.T) {
+	dirs := []string{"/cache/a", "/cache/it's"}
+	for _, tt := range []struct {
+		shell string
+		want  string
+	}{
+		{shellBash, `export PATH='/cache/a:/cache/it'\''s'"${PATH:+:$PATH}"` + "\n"},
+		{shellZsh, `export PATH='/cache/a:/cache/it'\''s'"${PATH:+:$PATH}"` + "\n"},
+		{shellFish, `set -gx PATH '/cache/a' '/cache/it\'s' $PATH` + "\n"},
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, writeShellEnv(&buf, tt.shell, dirs), tt.shell)
+		assert.Equal(t, tt.want, buf.String(), tt.shell)
+	}
+	assert.Error(t, writeShellEnv(&bytes.Buffer{}, "tcsh", dirs))
+}
+
+func Test_detectShell(t *testing.T) {
+	for shell, want := range map[string]string{
+		"/usr/bin/fish": shellFish,
+		"/bin/zsh":      shellZsh,
+		"/bin/bash":     shellBash,
+		"/bin/tcsh":     shellBash,
+		"":              shellBash,
+	} {
+		t.Setenv("SHELL", shell)
+		assert.Equal(t, want, detectShell(), shell)
+	}
+}
+
+func Test_shellEnvDirs(t *testing.T) {
+	w := NewWrun("wrun-test")
+	cacheHome := t.TempDir()
+	t.Setenv(cacheHomeEnvVar, cacheHome)
+	t.Setenv(osArchEnvVar, "")
+	dir := t.TempDir()
+	writeArgsFile := func(name, args string) string {
+		argsFile := filepath.Join(dir, name+".args")
+		require.NoError(t, os.WriteFile(argsFile, []byte(args), 0o666))
+
+		return argsFile
+	}
+	nonArchive := func(name string) string {
+		exe := name + "-1.2.3-linux-amd64"
+		require.NoError(t, os.WriteFile(filepath.Join(dir, exe), []byte("#!/bin/sh\n"), 0o755))
+
+		return writeArgsFile(name, "--url\n"+exe+"\n")
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tool3.tar.gz"), testTarGz(t, "bin/tool3", "#!/bin/sh\n"), 0o666))
+	argsFiles := []string{
+		nonArchive("tool1"),
+		writeArgsFile("tool3", "--url\ntool3.tar.gz\n--archive-exe-path\nbin/tool3\n"),
+		nonArchive("tool2"),
+		nonArchive("tool1"),
+	}
+
+	dirs, rc := shellEnvDirs(w, argsFiles)
+	require.Equal(t, esSuccess, rc)
+	require.Len(t, dirs, 2)
+	for _, d := range dirs {
+		assert.True(t, strings.HasPrefix(d, cacheHome+string(filepath.Separator)), d)
+	}
+	assert.Equal(t, filepath.Join(cacheHome, cacheVersion, cacheBinDir), filepath.Dir(dirs[0]))
+	for _, name := range []string{"tool1", "tool2"} {
+		data, err := os.ReadFile(filepath.Join(dirs[0], name))
+		require.NoError(t, err, name)
+		assert.Equal(t, "#!/bin/sh\n", string(data))
+	}
+	assert.FileExists(t, filepath.Join(dirs[1], "tool3"))
+
+	again, rc := shellEnvDirs(w, argsFiles)
+	require.Equal(t, esSuccess, rc)
+	assert.Equal(t, dirs, again, "bin dir reused")
+
+	_, rc = shellEnvDirs(w, []string{filepath.Join(dir, "nonexistent.args")})
+	assert.Equal(t, esUsage, rc)
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+)
+
+// spawn runs exe as a child process with args, including argv[0], env, and wrun's standard streams,
+// and waits for it to exit.
+// Signals received while waiting are forwarded to the child, see newSignalForwarder.
+// The exit status of the child is returned, 128+n if it was terminated by signal n.
+func spawn(exe string, args, env []string) (exitStatus, error) {
+	cmd := &exec.Cmd{
+		Path:   exe,
+		Args:   args,
+		Env:    env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	// Set up before starting so that we do not die of signals meant for the child
+	sigs := make(chan os.Signal, len(spawnSignals))
+	signal.Notify(sigs, spawnSignals...)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		return esError, err
+	}
+	forward := newSignalForwarder()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if forward(sig) {
+					_ = cmd.Process.Signal(sig) // nothing to do if it fails, the child is likely gone
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return esError, err
+		}
+	}
+
+	return processExitStatus(cmd.ProcessState), nil
+}
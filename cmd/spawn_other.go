@@ -0,0 +1,39 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package cmd
+
+import (
+	"os"
+)
+
+// spawnSignals are the signals to handle while waiting for a spawned child.
+var spawnSignals = []os.Signal{os.Interrupt}
+
+// newSignalForwarder returns a function that tells if a signal received while waiting for a spawned child should be forwarded to it.
+// Interrupts are not forwarded, as consoles send them to all attached processes, including the child.
+func newSignalForwarder() func(os.Signal) bool {
+	return func(os.Signal) bool {
+		return false
+	}
+}
+
+// processExitStatus gets the exit status for a process.
+func processExitStatus(ps *os.ProcessState) exitStatus {
+	return ps.ExitCode()
+}
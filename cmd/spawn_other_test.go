@@ -0,0 +1,25 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package cmd
+
+// runPlatformSpawnHelper runs a platform specific spawn test helper mode, and returns the exit status for it.
+// There are none on this platform.
+func runPlatformSpawnHelper(_, _ string) exitStatus {
+	return 103
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spawnHelperEnvVar makes the test binary act as a helper executable for spawn tests, see runSpawnHelper.
+const spawnHelperEnvVar = "WRUN_TEST_SPAWN_HELPER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(spawnHelperEnvVar); mode != "" {
+		os.Exit(runSpawnHelper(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runSpawnHelper runs a spawn test helper mode, and returns the exit status for it.
+// Modes are:
+//   - exit:N: exit with status N
+//   - cat: copy stdin to stdout, and args to stderr
+//   - other ones as implemented by runPlatformSpawnHelper
+func runSpawnHelper(mode string) exitStatus {
+	name, arg, _ := strings.Cut(mode, ":")
+	switch name {
+	case "exit":
+		rc, err := strconv.Atoi(arg)
+		if err != nil {
+			return 100
+		}
+
+		return rc
+	case "cat":
+		if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+			return 101
+		}
+		if _, err := io.WriteString(os.Stderr, strings.Join(os.Args[1:], " ")); err != nil {
+			return 102
+		}
+
+		return 0
+	}
+
+	return runPlatformSpawnHelper(name, arg)
+}
+
+// spawnHelper spawns the test binary as a helper in the given mode.
+func spawnHelper(t *testing.T, mode string, args ...string) (exitStatus, error) {
+	t.Helper()
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	t.Setenv(spawnHelperEnvVar, mode)
+
+	return spawn(exe, append([]string{exe}, args...), os.Environ())
+}
+
+func Test_spawn_exitStatus(t *testing.T) {
+	for _, want := range []exitStatus{0, 1, 3, 125} {
+		rc, err := spawnHelper(t, "exit:"+strconv.Itoa(want))
+		require.NoError(t, err)
+		assert.Equal(t, want, rc)
+	}
+}
+
+func Test_spawn_streams(t *testing.T) {
+	dir := t.TempDir()
+	stdin, stdout, stderr := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")
+	require.NoError(t, os.WriteFile(stdin, []byte("input\n"), 0o600))
+	for _, s := range []struct {
+		f    **os.File
+		name string
+		flag int
+	}{
+		{&os.Stdin, stdin, os.O_RDONLY},
+		{&os.Stdout, stdout, os.O_WRONLY | os.O_CREATE},
+		{&os.Stderr, stderr, os.O_WRONLY | os.O_CREATE},
+	} {
+		f, err := os.OpenFile(s.name, s.flag, 0o600)
+		require.NoError(t, err)
+		orig := *s.f
+		*s.f = f
+		t.Cleanup(func() {
+			*s.f = orig
+			_ = f.Close()
+		})
+	}
+
+	rc, err := spawnHelper(t, "cat", "a", "b c")
+	require.NoError(t, err)
+	assert.Equal(t, esSuccess, rc)
+	out, err := os.ReadFile(stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "input\n", string(out))
+	out, err = os.ReadFile(stderr)
+	require.NoError(t, err)
+	assert.Equal(t, "a b c", string(out))
+}
+
+func Test_spawn_notExist(t *testing.T) {
+	_, err := spawn(filepath.Join(t.TempDir(), "nonexistent"), []string{"nonexistent"}, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// spawnSignals are the signals to handle while waiting for a spawned child.
+var spawnSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2,
+}
+
+// newSignalForwarder returns a function that tells if a signal received while waiting for a spawned child should be forwarded to it.
+// Interrupt and quit are not forwarded if we are in the foreground process group of our controlling terminal,
+// as the terminal sends ones generated from the keyboard to the child as well.
+func newSignalForwarder() func(os.Signal) bool {
+	foreground := inForegroundProcessGroup()
+
+	return func(sig os.Signal) bool {
+		return !foreground || (sig != syscall.SIGINT && sig != syscall.SIGQUIT)
+	}
+}
+
+// processExitStatus gets the exit status for a process, 128+n if it was terminated by signal n.
+func processExitStatus(ps *os.ProcessState) exitStatus {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return ps.ExitCode()
+}
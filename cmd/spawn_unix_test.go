@@ -0,0 +1,88 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runPlatformSpawnHelper runs a platform specific spawn test helper mode, and returns the exit status for it.
+// Modes are:
+//   - kill:N: kill self with signal N
+//   - usr1:FILE: create FILE once ready to receive SIGUSR1, and exit with status 7 when received
+func runPlatformSpawnHelper(name, arg string) exitStatus {
+	switch name {
+	case "kill":
+		sig, err := strconv.Atoi(arg)
+		if err != nil {
+			return 100
+		}
+		if err = syscall.Kill(os.Getpid(), syscall.Signal(sig)); err != nil {
+			return 101
+		}
+		time.Sleep(10 * time.Second)
+
+		return 102
+	case "usr1":
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		if err := os.WriteFile(arg, nil, 0o600); err != nil {
+			return 101
+		}
+		select {
+		case <-sigs:
+			return 7
+		case <-time.After(10 * time.Second):
+			return 102
+		}
+	}
+
+	return 103
+}
+
+func Test_spawn_signaled(t *testing.T) {
+	rc, err := spawnHelper(t, "kill:"+strconv.Itoa(int(syscall.SIGTERM)))
+	require.NoError(t, err)
+	assert.Equal(t, 128+int(syscall.SIGTERM), rc)
+}
+
+func Test_spawn_forwardSignal(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	go func() {
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(ready)
+
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	}()
+
+	rc, err := spawnHelper(t, "usr1:"+ready)
+	require.NoError(t, err)
+	assert.Equal(t, 7, rc)
+}
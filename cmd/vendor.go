@@ -0,0 +1,245 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/scop/wrun/internal/hashes"
+	"github.com/scop/wrun/internal/policy"
+)
+
+const defaultVendorDir = "wrun-vendor"
+
+var errVendorNoDigest = errors.New("digest required for vendoring")
+
+// vendorer downloads artifacts to a vendor dir.
+type vendorer struct {
+	w      *Wrun
+	policy policy.Policy
+	dir    string
+	done   map[string]string // URL to vendored path
+}
+
+func newVendorer(w *Wrun, pol policy.Policy, dir string) *vendorer {
+	return &vendorer{w: w, policy: pol, dir: dir, done: make(map[string]string)}
+}
+
+// vendor downloads u to the vendor dir unless it is there already, and returns the path to the vendored copy.
+// The copy is stored in a dir named after its digest, retaining its base name.
+func (v *vendorer) vendor(u *url.URL) (string, error) {
+	if pth, found := v.done[u.String()]; found {
+		return pth, nil
+	}
+	h, digest, err := hashes.ParseHashFragment(u.Fragment)
+	if err != nil {
+		return "", fmt.Errorf("%s: parse hash fragment: %w", u.Redacted(), err)
+	}
+	if h == 0 {
+		return "", fmt.Errorf("%w: %s", errVendorNoDigest, u.Redacted())
+	}
+	if u.Scheme == ociScheme {
+		return "", fmt.Errorf("%s: vendoring OCI URLs is not supported", u.Redacted())
+	}
+	_, dlBase := path.Split(u.Path)
+	if dlBase == "" || dlBase == "." || dlBase == ".." {
+		return "", fmt.Errorf("%s: no file name in URL path", u.Redacted())
+	}
+	dir := filepath.Join(v.dir, digestKey(h, digest))
+	pth := filepath.Join(dir, dlBase)
+
+	if got, err := fileDigest(pth, h); err == nil && bytes.Equal(got, digest) {
+		v.w.LogInfo("already vendored: %s", pth)
+		v.done[u.String()] = pth
+
+		return pth, nil
+	}
+
+	if err = v.policy.CheckURL(u); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, 0o777); err != nil {
+		return "", err
+	}
+	tmpf, cleanUpTempFile, err := v.w.SetUpTempfile(dlBase, dir)
+	if err != nil {
+		return "", err
+	}
+	defer cleanUpTempFile()
+	resp, err := v.w.HTTPGet(u.String())
+	if err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	if err = v.w.Download(resp, tmpf, h.New(), digest); err != nil {
+		return "", fmt.Errorf("download %s: %w", u.Redacted(), err)
+	}
+	if err = os.Rename(tmpf.Name(), pth); err != nil {
+		return "", fmt.Errorf("rename tempfile: %w", err)
+	}
+	v.done[u.String()] = pth
+
+	return pth, nil
+}
+
+// vendorURLArg vendors the URL in a URL matcher argument, and returns the argument rewritten to point to the vendored copy,
+// relative to baseDir. Arguments with local paths are returned as is.
+func vendorURLArg(v *vendorer, s, baseDir string) (string, error) {
+	pattern, ur := splitURLArg(s)
+	u, err := parseURLArg(ur, baseDir)
+	if err != nil {
+		return "", err
+	}
+	if isLocalURL(u) {
+		return s, nil
+	}
+	pth, err := v.vendor(u)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(baseDir, pth)
+	if err != nil {
+		return "", err
+	}
+	vendored := filepath.ToSlash(rel) + "#" + u.Fragment
+	prefix := strings.TrimSuffix(s, ur)
+	if pattern == "" && strings.Contains(vendored, "=") {
+		prefix = "="
+	}
+
+	return prefix + vendored, nil
+}
+
+// vendorArgsFile vendors URLs in an args file, and returns its content rewritten to point to the vendored copies.
+// Comments, empty lines, and other arguments are retained as is.
+func vendorArgsFile(v *vendorer, argsFile string) ([]byte, error) {
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		return nil, err
+	}
+	baseDir, err := filepath.Abs(filepath.Dir(argsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	valueNext, flagsDone := false, false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		arg := strings.TrimSpace(line)
+		var value string
+		switch {
+		case flagsDone || arg == "" || strings.HasPrefix(arg, "#"):
+		case valueNext:
+			value, valueNext = arg, false
+		case arg == "--":
+			flagsDone = true
+		case arg == "--url" || arg == "-u":
+			valueNext = true
+		default:
+			for _, prefix := range []string{"--url=", "-u=", "-u"} {
+				if strings.HasPrefix(arg, prefix) {
+					value = strings.TrimPrefix(arg, prefix)
+
+					break
+				}
+			}
+		}
+		if value != "" {
+			vendored, err := vendorURLArg(v, value, baseDir)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", argsFile, err)
+			}
+			line = strings.Replace(line, value, vendored, 1)
+		}
+		buf.WriteString(line)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func vendorCommand(w *Wrun) *cobra.Command {
+	var dir string
+	var write bool
+	cmd := &cobra.Command{
+		Use:   "vendor [flags] FILE...",
+		Short: "vendor downloads in args files",
+		Long: `vendor downloads in args files
+
+All URLs in args files, for all OS/archs, are downloaded to the vendor dir and checked against their digest fragments.
+URLs without digests are errors.
+The args files are then rewritten to point to the vendored copies, using paths relative to the args file's directory, retaining the digest fragments.
+
+Using the rewritten args files with ` + argsFileEnvVar + ` requires no network access,
+and the vendored copies are checked against the digests like downloads are.
+
+By default, rewritten args files are written to stdout, --write writes them to the args files instead.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(_ *cobra.Command, args []string) {
+			pol, err := resolvePolicy()
+			if err != nil {
+				w.LogError("download policy: %v", err)
+				os.Exit(esUsage)
+			}
+			w.setPolicy(pol)
+			absDir, err := filepath.Abs(dir)
+			if err != nil {
+				w.LogError("vendor dir: %v", err)
+				os.Exit(esError)
+			}
+
+			v := newVendorer(w, pol, absDir)
+			for _, argsFile := range args {
+				data, err := vendorArgsFile(v, argsFile)
+				if err != nil {
+					w.LogError("%v", err)
+					if errors.Is(err, errVendorNoDigest) || policy.IsViolation(err) {
+						os.Exit(esUsage)
+					}
+					os.Exit(esError)
+				}
+				if !write {
+					if _, err = os.Stdout.Write(data); err != nil {
+						w.LogError("%v", err)
+						os.Exit(esError)
+					}
+
+					continue
+				}
+				fi, err := os.Stat(argsFile)
+				if err == nil {
+					err = os.WriteFile(argsFile, data, fi.Mode().Perm())
+				}
+				if err != nil {
+					w.LogError("%v", err)
+					os.Exit(esError)
+				}
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&dir, "dir", "d", defaultVendorDir, "directory to vendor downloads to")
+	cmd.Flags().BoolVarP(&write, "write", "w", false, "write result to args files instead of stdout")
+
+	return cmd
+}
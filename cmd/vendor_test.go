@@ -0,0 +1,103 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+	"github.com/scop/wrun/internal/policy"
+)
+
+func Test_vendorArgsFile(t *testing.T) {
+	w := NewWrun("wrun-test")
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = rw.Write([]byte("tool for " + r.URL.Path))
+	}))
+	defer srv.Close()
+	linuxDigest := sha256.Sum256([]byte("tool for /linux/tool"))
+	darwinDigest := sha256.Sum256([]byte("tool for /darwin/tool"))
+
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	require.NoError(t, os.WriteFile(argsFile, []byte(fmt.Sprintf(`# tool
+--url=linux/*=%[1]s/linux/tool#sha256-%[2]x
+-u
+darwin/*=%[1]s/darwin/tool#sha256-%[3]x
+--url=windows/*=local/tool.exe
+--dry-run
+`, srv.URL, linuxDigest, darwinDigest)), 0o666))
+
+	v := newVendorer(w, policy.Policy{}, filepath.Join(dir, "vendor"))
+	data, err := vendorArgsFile(v, argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`# tool
+--url=linux/*=vendor/sha256-%[1]x/tool#sha256-%[1]x
+-u
+darwin/*=vendor/sha256-%[2]x/tool#sha256-%[2]x
+--url=windows/*=local/tool.exe
+--dry-run
+`, linuxDigest, darwinDigest), string(data))
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Already vendored ones are not downloaded again
+	_, err = vendorArgsFile(newVendorer(w, policy.Policy{}, filepath.Join(dir, "vendor")), argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), hits.Load())
+
+	// Rewritten args file works offline
+	srv.Close()
+	require.NoError(t, os.WriteFile(argsFile, data, 0o666))
+	cfg, err := parseArgsFile(w, argsFile)
+	require.NoError(t, err)
+	base := cacheEntrySpec{cacheDir: t.TempDir(), limits: archives.DefaultLimits}
+	targets, err := fetchTargets(argsFile, cfg, []string{"linux/amd64"}, false, base)
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	exePath, err := downloadCacheEntry(w, targets[0].spec)
+	require.NoError(t, err)
+	got, err := os.ReadFile(exePath)
+	require.NoError(t, err)
+	assert.Equal(t, "tool for /linux/tool", string(got))
+
+	// Vendored copies are checked against digests
+	targets, err = fetchTargets(argsFile, cfg, []string{"darwin/arm64"}, false, base)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.FromSlash(targets[0].spec.url.Path), []byte("tampered"), 0o666))
+	_, err = downloadCacheEntry(w, targets[0].spec)
+	require.ErrorContains(t, err, "digest mismatch")
+}
+
+func Test_vendorArgsFile_noDigest(t *testing.T) {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	require.NoError(t, os.WriteFile(argsFile, []byte("--url=https://example.com/tool\n"), 0o666))
+	v := newVendorer(NewWrun("wrun-test"), policy.Policy{}, t.TempDir())
+	_, err := vendorArgsFile(v, argsFile)
+	require.ErrorIs(t, err, errVendorNoDigest)
+}
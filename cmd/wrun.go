@@ -23,15 +23,19 @@ import (
 	"hash"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+
+	"github.com/scop/wrun/internal/policy"
 )
 
 type Wrun struct {
 	ProgName   string
 	httpClient *http.Client
+	policy     policy.Policy
 	verbose    *bool
 }
 
@@ -48,6 +52,12 @@ func NewWrun(progName string) *Wrun {
 	return w
 }
 
+// setPolicy sets the download policy, applied to redirects and other URLs accessed on the way to downloads.
+func (w *Wrun) setPolicy(pol policy.Policy) {
+	w.policy = pol
+	w.httpClient.CheckRedirect = pol.CheckRedirect
+}
+
 type level = string
 
 const (
@@ -85,43 +95,74 @@ func (w *Wrun) LogBug(format string, args ...any) {
 	panic(w.logFormat(levelBug, format, args...))
 }
 
-// HTTPGet sends an HTTP GET request to url with headers.
+// HTTPStatusError is returned on HTTP responses having an unexpected status.
+type HTTPStatusError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Header     http.Header
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP status %s", e.Method, e.URL, e.Status)
+}
+
+// HTTPGet sends an HTTP GET request to rawURL with headers, see HTTPGetURL.
+func (w *Wrun) HTTPGet(rawURL string, headers ...string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s new request: %w", http.MethodGet, err)
+	}
+
+	return w.HTTPGetURL(u, headers...)
+}
+
+// HTTPGetURL sends an HTTP GET request to u with headers.
 // It returns the HTTP response and any encountered error.
 // An error is also returned on responses having status other than 200.
 // headers are colon separated name:value strings.
-func (w *Wrun) HTTPGet(url string, headers ...string) (*http.Response, error) {
+// Passwords in u are redacted in logs and errors.
+func (w *Wrun) HTTPGetURL(u *url.URL, headers ...string) (*http.Response, error) {
 	const method = http.MethodGet
-	w.LogInfo("%s %s", method, url)
-	req, err := http.NewRequest(method, url, nil)
+	redacted := u.Redacted()
+	w.LogInfo("%s %s", method, redacted)
+	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("%s %s new request: %w", method, url, err)
+		return nil, fmt.Errorf("%s %s new request: %w", method, redacted, err)
 	}
 	req.Header.Set("User-Agent", w.ProgName+"/"+version)
 	for _, h := range headers {
 		if k, v, found := strings.Cut(h, ":"); found {
 			req.Header.Set(k, v)
 		} else {
-			return nil, fmt.Errorf("%s %s set request headers: no colon in header: %q", req.Method, url, h)
+			return nil, fmt.Errorf("%s %s set request headers: no colon in header: %q", req.Method, redacted, h)
 		}
 	}
 	// TODO if no checksum, do conditional get: If-None-Match, If-Modified-Since?
 
 	resp, err := w.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("%s %s: %w", req.Method, url, err)
+		return nil, fmt.Errorf("%s %s: %w", req.Method, redacted, err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		if err = resp.Body.Close(); err != nil {
 			w.LogWarn("close HTTP response: %v", err)
 		}
 
-		return nil, fmt.Errorf("%s %s: HTTP status %s", req.Method, url, resp.Status)
+		return nil, &HTTPStatusError{Method: req.Method, URL: redacted, Status: resp.Status, StatusCode: resp.StatusCode, Header: resp.Header}
 	}
 
 	return resp, nil
 }
 
 func (w *Wrun) Download(resp *http.Response, dest io.Writer, hsh hash.Hash, expectedDigest []byte) error {
+	return w.Copy(resp.Body, dest, hsh, expectedDigest)
+}
+
+// Copy copies src to dest and/or hsh, and closes src.
+// Digest is checked if expectedDigest is non-nil, and dest is closed if it is an io.Closer.
+func (w *Wrun) Copy(src io.ReadCloser, dest io.Writer, hsh hash.Hash, expectedDigest []byte) error {
 	var wr io.Writer
 	switch {
 	case dest == nil && hsh == nil:
@@ -134,9 +175,9 @@ func (w *Wrun) Download(resp *http.Response, dest io.Writer, hsh hash.Hash, expe
 		wr = io.MultiWriter(dest, hsh)
 	}
 
-	n, err := io.Copy(wr, resp.Body)
-	if cErr := resp.Body.Close(); cErr != nil {
-		w.LogWarn("close HTTP response: %v", cErr)
+	n, err := io.Copy(wr, src)
+	if cErr := src.Close(); cErr != nil {
+		w.LogWarn("close source: %v", cErr)
 	}
 	if err != nil {
 		return fmt.Errorf("copy stream: %w", err)
@@ -0,0 +1,528 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package archives
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/mholt/archiver/v3"
+	"github.com/nwaples/rardecode"
+)
+
+var (
+	ErrAbsolutePath    = errors.New("absolute path")
+	ErrPathTraversal   = errors.New("path traversal")
+	ErrSymlinkEscape   = errors.New("symlink escapes destination")
+	ErrThroughSymlink  = errors.New("path through symlink")
+	ErrHardlink        = errors.New("hardlinks not supported")
+	ErrSpecialFile     = errors.New("special files not supported")
+	ErrMaxSize         = errors.New("total uncompressed size limit exceeded")
+	ErrMaxEntries      = errors.New("entry count limit exceeded")
+	ErrMaxRatio        = errors.New("compression ratio limit exceeded")
+	ErrNotFound        = errors.New("not found in archive")
+	errUnsupportedType = errors.New("unsupported entry type")
+)
+
+// maxSymlinkTargetLen limits symlink target lengths read from archive entry contents.
+const maxSymlinkTargetLen = 4096
+
+// Limits contains archive extraction limits.
+// Zero values mean no limit.
+type Limits struct {
+	// MaxSize is the maximum total uncompressed size in bytes.
+	MaxSize int64
+	// MaxEntries is the maximum number of entries, including directories.
+	MaxEntries int
+	// MaxRatio is the maximum ratio of total uncompressed size to archive file size.
+	MaxRatio float64
+}
+
+// DefaultLimits are limits suitable for archives containing executables.
+var DefaultLimits = Limits{
+	MaxSize:    4 << 30,
+	MaxEntries: 100_000,
+	MaxRatio:   200,
+}
+
+// EntryError records an error and the archive entry that caused it.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("entry %q: %v", e.Name, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+type entryType int
+
+const (
+	entryTypeRegular entryType = iota
+	entryTypeDir
+	entryTypeSymlink
+	entryTypeSkip
+)
+
+type extractor struct {
+	dest     string
+	limits   Limits
+	maxBytes int64
+	ratioMax int64
+	entries  int
+	written  int64
+	symlinks []string
+	err      error
+	// paths to extract, nil for all
+	paths []string
+	// paths with no entries found at or below them yet
+	remaining map[string]bool
+	// paths not yet found as non-directory entries, walk can stop early when none left
+	pending map[string]bool
+	// targets of extracted symlinks not found yet, walked again for in case they precede the links
+	links map[string]bool
+	// non-directory entries extracted, later duplicates are skipped
+	seen map[string]bool
+}
+
+// Extract extracts archive to dest, which is created if it does not exist.
+// Archive format is determined by the archive filename.
+//
+// If paths are given, only entries at or below them are extracted,
+// and an error is returned if some of them are not present in the archive.
+// Targets of extracted symlinks are extracted as well.
+// paths use / as the separator.
+//
+// If the archive contains multiple non-directory entries with the same name, the first one is extracted.
+//
+// Entries with absolute paths, paths traversing outside dest, or through symlinks,
+// symlinks pointing outside dest, hardlinks, and device and other special files cause an error,
+// as does exceeding limits.
+// Errors related to a specific entry are of type *EntryError.
+func Extract(archive, dest string, limits Limits, paths ...string) error {
+	a, err := archiver.ByExtension(archive)
+	if err != nil {
+		return err
+	}
+	walker, ok := a.(archiver.Walker)
+	if !ok {
+		return fmt.Errorf("format specified by archive filename is not an archive format: %s (%T)", archive, a)
+	}
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return err
+	}
+
+	x := &extractor{
+		dest:   dest,
+		limits: limits,
+		seen:   make(map[string]bool),
+	}
+	var requested []string // x.paths is replaced by link targets on walks again, keep these for reporting missing ones
+	if len(paths) != 0 {
+		x.remaining = make(map[string]bool, len(paths))
+		x.pending = make(map[string]bool, len(paths))
+		x.links = make(map[string]bool)
+		for _, p := range paths {
+			p = path.Clean(p)
+			x.paths = append(x.paths, p)
+			requested = append(requested, p)
+			x.remaining[p] = true
+			x.pending[p] = true
+		}
+	}
+	if limits.MaxRatio > 0 {
+		x.ratioMax = int64(limits.MaxRatio * float64(fi.Size()))
+	}
+	x.maxBytes = limits.MaxSize
+	if x.ratioMax != 0 && (x.maxBytes == 0 || x.ratioMax < x.maxBytes) {
+		x.maxBytes = x.ratioMax
+	}
+
+	if err = os.MkdirAll(dest, 0o777); err != nil {
+		return err
+	}
+	walked := make(map[string]bool)
+	for {
+		if err = walker.Walk(archive, x.extractFile); err != nil {
+			return err
+		}
+		if x.err != nil {
+			return x.err
+		}
+		// Walk again for symlink targets that were not found, in case they preceded the links.
+		// Ones not found on the walk again are dangling.
+		var links []string
+		for p := range x.links {
+			if !walked[p] {
+				walked[p] = true
+				links = append(links, p)
+			}
+		}
+		if len(links) == 0 {
+			break
+		}
+		x.paths = links
+		x.pending = make(map[string]bool, len(links))
+		for _, p := range links {
+			x.pending[p] = true
+		}
+		x.entries = 0
+	}
+	if len(x.remaining) != 0 {
+		missing := make([]string, 0, len(x.remaining))
+		for _, p := range requested {
+			if x.remaining[p] {
+				missing = append(missing, p)
+			}
+		}
+
+		return fmt.Errorf("%w: %s", ErrNotFound, strings.Join(missing, ", "))
+	}
+
+	return x.checkSymlinks()
+}
+
+// Contains tells if archive contains a non-directory entry at name, which uses / as the separator.
+// Archive format is determined by the archive filename.
+// Entries are not validated, Extract does that.
+func Contains(archive, name string) (bool, error) {
+	a, err := archiver.ByExtension(archive)
+	if err != nil {
+		return false, err
+	}
+	walker, ok := a.(archiver.Walker)
+	if !ok {
+		return false, fmt.Errorf("format specified by archive filename is not an archive format: %s (%T)", archive, a)
+	}
+
+	name = path.Clean(name)
+	found := false
+	err = walker.Walk(archive, func(f archiver.File) error {
+		entryName, typ, _, err := entryInfo(f)
+		if err != nil || typ == entryTypeDir || typ == entryTypeSkip {
+			return nil //nolint:nilerr // not interested in invalid entries here
+		}
+		if p, err := localPath(entryName); err == nil && filepath.ToSlash(p) == name {
+			found = true
+
+			return archiver.ErrStopWalk
+		}
+
+		return nil
+	})
+
+	return found, err
+}
+
+// IsArchive tells if filename has the extension of a supported archive format.
+func IsArchive(filename string) bool {
+	a, err := archiver.ByExtension(filename)
+	if err != nil {
+		return false
+	}
+	_, ok := a.(archiver.Walker)
+
+	return ok
+}
+
+// selected tells whether the entry with the given cleaned name should be extracted,
+// and bookkeeps found paths.
+func (x *extractor) selected(name string, typ entryType) bool {
+	if x.paths == nil {
+		return true
+	}
+	sel := false
+	for _, p := range x.paths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			sel = true
+			delete(x.remaining, p)
+			delete(x.links, p)
+			if name == p && typ != entryTypeDir {
+				delete(x.pending, p)
+			}
+		}
+	}
+
+	return sel
+}
+
+// extractFile is an archiver.WalkFunc.
+// Errors are stored in x.err, because archiver does not wrap the ones returned from here.
+func (x *extractor) extractFile(f archiver.File) error {
+	name, typ, linkTarget, err := entryInfo(f)
+	if err == nil {
+		err = x.extractEntry(f, name, typ, linkTarget)
+	}
+	if err != nil {
+		if name == "" {
+			x.err = err
+		} else {
+			x.err = &EntryError{Name: name, Err: err}
+		}
+
+		return archiver.ErrStopWalk
+	}
+	if x.pending != nil && len(x.pending) == 0 {
+		return archiver.ErrStopWalk // all wanted files found
+	}
+
+	return nil
+}
+
+func entryInfo(f archiver.File) (name string, typ entryType, linkTarget string, err error) {
+	var mode os.FileMode
+	switch h := f.Header.(type) {
+	case *tar.Header:
+		name = h.Name
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse: //nolint:staticcheck // TypeRegA is deprecated, but still might occur in archives
+			typ = entryTypeRegular
+		case tar.TypeDir:
+			typ = entryTypeDir
+		case tar.TypeSymlink:
+			typ = entryTypeSymlink
+			linkTarget = h.Linkname
+		case tar.TypeLink:
+			err = ErrHardlink
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			err = ErrSpecialFile
+		case tar.TypeXGlobalHeader:
+			typ = entryTypeSkip
+		default:
+			err = fmt.Errorf("%w: %q", errUnsupportedType, h.Typeflag)
+		}
+
+		return
+	case zip.FileHeader:
+		name = h.Name
+		mode = h.Mode()
+	case *rardecode.FileHeader:
+		name = h.Name
+		mode = h.Mode()
+	default:
+		return "", 0, "", fmt.Errorf("%w: %T", errUnsupportedType, f.Header)
+	}
+
+	switch {
+	case mode.IsDir():
+		typ = entryTypeDir
+	case mode&os.ModeSymlink != 0:
+		typ = entryTypeSymlink
+		var target []byte
+		target, err = io.ReadAll(io.LimitReader(f, maxSymlinkTargetLen))
+		linkTarget = string(target)
+	case mode.IsRegular():
+		typ = entryTypeRegular
+	default:
+		err = ErrSpecialFile
+	}
+
+	return
+}
+
+// localPath validates an archive entry name and returns it as a local filesystem path relative to destination.
+func localPath(name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, `\`) {
+		return "", ErrAbsolutePath
+	}
+	p := filepath.FromSlash(path.Clean(name))
+	if !filepath.IsLocal(p) {
+		return "", ErrPathTraversal
+	}
+
+	return p, nil
+}
+
+// checkParents checks that no existing parent directory of p within destination is a symlink.
+func (x *extractor) checkParents(p string) error {
+	dir := x.dest
+	parts := strings.Split(filepath.Dir(p), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return ErrThroughSymlink
+		}
+	}
+
+	return nil
+}
+
+func (x *extractor) extractEntry(f archiver.File, name string, typ entryType, linkTarget string) error {
+	if typ == entryTypeSkip {
+		return nil
+	}
+	x.entries++
+	if x.limits.MaxEntries > 0 && x.entries > x.limits.MaxEntries {
+		return fmt.Errorf("%w: %d", ErrMaxEntries, x.limits.MaxEntries)
+	}
+
+	p, err := localPath(name)
+	if err != nil {
+		return err
+	}
+	if p == "." {
+		return nil // destination itself
+	}
+	if !x.selected(filepath.ToSlash(p), typ) {
+		return nil
+	}
+	if typ != entryTypeDir {
+		if x.seen[p] {
+			return nil // first one wins, consistently with stopping early when extracting only some paths
+		}
+		x.seen[p] = true
+	}
+	if err = x.checkParents(p); err != nil {
+		return err
+	}
+	dest := filepath.Join(x.dest, p)
+
+	switch typ {
+	case entryTypeDir:
+		return os.MkdirAll(dest, 0o777)
+	case entryTypeSymlink:
+		if path.IsAbs(linkTarget) || filepath.IsAbs(linkTarget) {
+			return fmt.Errorf("%w: %q", ErrSymlinkEscape, linkTarget)
+		}
+		if !filepath.IsLocal(filepath.Join(filepath.Dir(p), filepath.FromSlash(linkTarget))) {
+			return fmt.Errorf("%w: %q", ErrSymlinkEscape, linkTarget)
+		}
+		if err = x.prepareDest(dest); err != nil {
+			return err
+		}
+		if err = os.Symlink(linkTarget, dest); err != nil {
+			return err
+		}
+		x.symlinks = append(x.symlinks, dest)
+		x.follow(path.Join(path.Dir(filepath.ToSlash(p)), filepath.ToSlash(linkTarget)))
+
+		return nil
+	case entryTypeRegular:
+		return x.writeFile(f, dest)
+	default:
+		return fmt.Errorf("%w: %d", errUnsupportedType, typ)
+	}
+}
+
+// follow adds symlink target to paths to extract, if only some are being extracted and it is not among them already.
+func (x *extractor) follow(target string) {
+	if x.paths == nil {
+		return
+	}
+	for _, p := range x.paths {
+		if target == p || strings.HasPrefix(target, p+"/") {
+			return
+		}
+	}
+	x.paths = append(x.paths, target)
+	x.pending[target] = true
+	x.links[target] = true
+}
+
+// prepareDest creates parent directories of dest, and removes dest if it exists.
+func (x *extractor) prepareDest(dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o777); err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (x *extractor) writeFile(f archiver.File, dest string) error {
+	if err := x.prepareDest(dest); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, f.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(f)
+	var budget int64
+	if x.maxBytes > 0 {
+		budget = x.maxBytes - x.written
+		r = io.LimitReader(f, budget+1)
+	}
+	n, err := io.Copy(out, r)
+	x.written += n
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if x.maxBytes > 0 && n > budget {
+		if x.ratioMax != 0 && x.ratioMax == x.maxBytes {
+			return fmt.Errorf("%w: %g", ErrMaxRatio, x.limits.MaxRatio)
+		}
+
+		return fmt.Errorf("%w: %d bytes", ErrMaxSize, x.limits.MaxSize)
+	}
+
+	return nil
+}
+
+// checkSymlinks checks that extracted symlinks that resolve do so within destination.
+func (x *extractor) checkSymlinks() error {
+	if len(x.symlinks) == 0 {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(x.dest)
+	if err != nil {
+		return err
+	}
+	for _, link := range x.symlinks {
+		resolved, err := filepath.EvalSymlinks(link)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // dangling, target validated to be within destination at creation
+		} else if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) && rel != "." {
+			name, _ := filepath.Rel(x.dest, link)
+			target, _ := os.Readlink(link)
+
+			return &EntryError{Name: filepath.ToSlash(name), Err: fmt.Errorf("%w: %q", ErrSymlinkEscape, target)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,355 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package archives_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/archives"
+)
+
+type testEntry struct {
+	header  tar.Header
+	content string
+}
+
+func writeTarGz(t *testing.T, entries []testEntry) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "test.tar.gz")
+	f, err := os.Create(fn)
+	require.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := e.header
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.content))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		if e.content != "" {
+			_, err = tw.Write([]byte(e.content))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	require.NoError(t, f.Close())
+
+	return fn
+}
+
+func writeZip(t *testing.T, entries map[string]string, symlinks map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	for name, target := range symlinks {
+		fh := &zip.FileHeader{Name: name}
+		fh.SetMode(os.ModeSymlink | 0o777)
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(target))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	fn := filepath.Join(t.TempDir(), "test.zip")
+	require.NoError(t, os.WriteFile(fn, buf.Bytes(), 0o644))
+
+	return fn
+}
+
+func TestExtract_TarGz(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks")
+	}
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "./", Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "dir/exe", Typeflag: tar.TypeReg, Mode: 0o755}, content: "#!/bin/sh\n"},
+		{header: tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "exe"}},
+		{header: tar.Header{Name: "uplink", Typeflag: tar.TypeSymlink, Linkname: "dir/../dir/exe"}},
+	})
+	dest := filepath.Join(t.TempDir(), "dest")
+	require.NoError(t, archives.Extract(fn, dest, archives.DefaultLimits))
+
+	data, err := os.ReadFile(filepath.Join(dest, "dir", "exe"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\n", string(data))
+	target, err := os.Readlink(filepath.Join(dest, "dir", "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "exe", target)
+	_, err = os.Stat(filepath.Join(dest, "uplink"))
+	require.NoError(t, err)
+}
+
+func TestExtract_Zip(t *testing.T) {
+	fn := writeZip(t, map[string]string{
+		"dir/exe.exe": "MZ",
+		"other":       "data",
+	}, nil)
+	dest := t.TempDir()
+	require.NoError(t, archives.Extract(fn, dest, archives.DefaultLimits))
+
+	data, err := os.ReadFile(filepath.Join(dest, "dir", "exe.exe"))
+	require.NoError(t, err)
+	assert.Equal(t, "MZ", string(data))
+}
+
+func TestExtract_Rejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []testEntry
+		wantErr   error
+		wantEntry string
+	}{
+		{
+			name:      "traversal",
+			entries:   []testEntry{{header: tar.Header{Name: "dir/../../evil", Typeflag: tar.TypeReg}, content: "x"}},
+			wantErr:   archives.ErrPathTraversal,
+			wantEntry: "dir/../../evil",
+		},
+		{
+			name:      "absolute",
+			entries:   []testEntry{{header: tar.Header{Name: "/etc/evil", Typeflag: tar.TypeReg}, content: "x"}},
+			wantErr:   archives.ErrAbsolutePath,
+			wantEntry: "/etc/evil",
+		},
+		{
+			name:      "symlink absolute",
+			entries:   []testEntry{{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+			wantErr:   archives.ErrSymlinkEscape,
+			wantEntry: "link",
+		},
+		{
+			name:      "symlink traversal",
+			entries:   []testEntry{{header: tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}}},
+			wantErr:   archives.ErrSymlinkEscape,
+			wantEntry: "dir/link",
+		},
+		{
+			name: "through symlink",
+			entries: []testEntry{
+				{header: tar.Header{Name: "dir", Typeflag: tar.TypeDir}},
+				{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"}},
+				{header: tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, content: "x"},
+			},
+			wantErr:   archives.ErrThroughSymlink,
+			wantEntry: "link/file",
+		},
+		{
+			name: "symlink chain",
+			entries: []testEntry{
+				{header: tar.Header{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+				{header: tar.Header{Name: "a/escape", Typeflag: tar.TypeSymlink, Linkname: "up/.."}},
+			},
+			wantErr:   archives.ErrSymlinkEscape,
+			wantEntry: "a/escape",
+		},
+		{
+			name: "hardlink",
+			entries: []testEntry{
+				{header: tar.Header{Name: "file", Typeflag: tar.TypeReg}, content: "x"},
+				{header: tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "file"}},
+			},
+			wantErr:   archives.ErrHardlink,
+			wantEntry: "hardlink",
+		},
+		{
+			name:      "device",
+			entries:   []testEntry{{header: tar.Header{Name: "dev", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}},
+			wantErr:   archives.ErrSpecialFile,
+			wantEntry: "dev",
+		},
+		{
+			name:      "fifo",
+			entries:   []testEntry{{header: tar.Header{Name: "fifo", Typeflag: tar.TypeFifo}}},
+			wantErr:   archives.ErrSpecialFile,
+			wantEntry: "fifo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && tt.wantErr == archives.ErrSymlinkEscape {
+				t.Skip("symlinks")
+			}
+			fn := writeTarGz(t, tt.entries)
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+			err := archives.Extract(fn, dest, archives.DefaultLimits)
+			require.ErrorIs(t, err, tt.wantErr)
+			var entryErr *archives.EntryError
+			require.ErrorAs(t, err, &entryErr)
+			assert.Equal(t, tt.wantEntry, entryErr.Name)
+			_, err = os.Lstat(filepath.Join(parent, "evil"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+func TestExtract_ZipSymlinkEscape(t *testing.T) {
+	fn := writeZip(t, nil, map[string]string{"link": "../outside"})
+	err := archives.Extract(fn, t.TempDir(), archives.DefaultLimits)
+	require.ErrorIs(t, err, archives.ErrSymlinkEscape)
+}
+
+func TestExtract_Limits(t *testing.T) {
+	big := string(bytes.Repeat([]byte{'0'}, 100_000))
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "a", Typeflag: tar.TypeReg}, content: big},
+		{header: tar.Header{Name: "b", Typeflag: tar.TypeReg}, content: big},
+	})
+
+	tests := []struct {
+		name    string
+		limits  archives.Limits
+		wantErr error
+	}{
+		{"unlimited", archives.Limits{}, nil},
+		{"size", archives.Limits{MaxSize: 150_000}, archives.ErrMaxSize},
+		{"entries", archives.Limits{MaxEntries: 1}, archives.ErrMaxEntries},
+		{"ratio", archives.Limits{MaxRatio: 10}, archives.ErrMaxRatio},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := archives.Extract(fn, t.TempDir(), tt.limits)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.wantErr)
+				var entryErr *archives.EntryError
+				require.ErrorAs(t, err, &entryErr)
+			}
+		})
+	}
+}
+
+func TestExtract_Paths(t *testing.T) {
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "pkg/", Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "pkg/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755}, content: "tool"},
+		{header: tar.Header{Name: "pkg/lib/a", Typeflag: tar.TypeReg}, content: "a"},
+		{header: tar.Header{Name: "pkg/lib/b", Typeflag: tar.TypeReg}, content: "b"},
+		{header: tar.Header{Name: "pkg/share/doc", Typeflag: tar.TypeReg}, content: "doc"},
+	})
+
+	dest := t.TempDir()
+	require.NoError(t, archives.Extract(fn, dest, archives.DefaultLimits, "pkg/bin/tool", "pkg/lib/"))
+	for _, p := range []string{"pkg/bin/tool", "pkg/lib/a", "pkg/lib/b"} {
+		_, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p)))
+		require.NoError(t, err, p)
+	}
+	_, err := os.Stat(filepath.Join(dest, "pkg", "share"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = archives.Extract(fn, t.TempDir(), archives.DefaultLimits, "pkg/bin/tool", "pkg/missing")
+	require.ErrorIs(t, err, archives.ErrNotFound)
+	assert.ErrorContains(t, err, "pkg/missing")
+}
+
+func TestExtract_PathsSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks not reliably supported on Windows")
+	}
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "pkg/libexec/tool-1.0", Typeflag: tar.TypeReg, Mode: 0o755}, content: "tool"},
+		{header: tar.Header{Name: "pkg/bin/tool", Typeflag: tar.TypeSymlink, Linkname: "../libexec/tool"}},
+		{header: tar.Header{Name: "pkg/libexec/tool", Typeflag: tar.TypeSymlink, Linkname: "tool-1.0"}},
+		{header: tar.Header{Name: "pkg/bin/dangling", Typeflag: tar.TypeSymlink, Linkname: "missing"}},
+		{header: tar.Header{Name: "pkg/share/doc", Typeflag: tar.TypeReg}, content: "doc"},
+	})
+
+	dest := t.TempDir()
+	require.NoError(t, archives.Extract(fn, dest, archives.DefaultLimits, "pkg/bin"))
+	data, err := os.ReadFile(filepath.Join(dest, "pkg", "bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, "tool", string(data))
+	_, err = os.Stat(filepath.Join(dest, "pkg", "share"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	err = archives.Extract(fn, t.TempDir(), archives.DefaultLimits, "pkg/bin", "pkg/missing")
+	require.ErrorIs(t, err, archives.ErrNotFound)
+	assert.ErrorContains(t, err, "not found in archive: pkg/missing")
+}
+
+func TestExtract_Duplicates(t *testing.T) {
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "pkg/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755}, content: "first"},
+		{header: tar.Header{Name: "pkg/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755}, content: "second"},
+	})
+
+	for _, paths := range [][]string{nil, {"pkg/bin/tool"}} {
+		dest := t.TempDir()
+		require.NoError(t, archives.Extract(fn, dest, archives.DefaultLimits, paths...), paths)
+		data, err := os.ReadFile(filepath.Join(dest, "pkg", "bin", "tool"))
+		require.NoError(t, err, paths)
+		assert.Equal(t, "first", string(data), paths)
+	}
+}
+
+func TestContains(t *testing.T) {
+	fn := writeTarGz(t, []testEntry{
+		{header: tar.Header{Name: "./pkg/", Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "./pkg/bin/tool", Typeflag: tar.TypeReg, Mode: 0o755}, content: "tool"},
+		{header: tar.Header{Name: "pkg/link", Typeflag: tar.TypeSymlink, Linkname: "bin/tool"}},
+	})
+
+	for name, want := range map[string]bool{
+		"pkg/bin/tool":   true,
+		"./pkg/bin/tool": true,
+		"pkg/link":       true,
+		"pkg":            false,
+		"pkg/missing":    false,
+	} {
+		got, err := archives.Contains(fn, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	for name, want := range map[string]bool{
+		"tool.tar.gz":  true,
+		"tool.tgz":     true,
+		"tool.tar.xz":  true,
+		"tool.zip":     true,
+		"tool.gz":      false,
+		"tool.exe":     false,
+		"tool":         false,
+		"tool-v1.2.3":  false,
+		"tool.tar.zst": true,
+	} {
+		assert.Equal(t, want, archives.IsArchive(name), name)
+	}
+}
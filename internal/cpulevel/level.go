@@ -0,0 +1,119 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package cpulevel detects CPU microarchitecture levels.
+package cpulevel
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// Detect detects the microarchitecture level of the CPU, for example v3 for x86-64-v3 on amd64, and v7 for ARMv7 on arm.
+// The empty string is returned if unknown or not applicable.
+func Detect() string {
+	return detect()
+}
+
+// CPUID feature bits.
+const (
+	// Leaf 1, ECX
+	ecx1SSE3    = 1 << 0
+	ecx1SSSE3   = 1 << 9
+	ecx1FMA     = 1 << 12
+	ecx1CX16    = 1 << 13
+	ecx1SSE41   = 1 << 19
+	ecx1SSE42   = 1 << 20
+	ecx1MOVBE   = 1 << 22
+	ecx1POPCNT  = 1 << 23
+	ecx1OSXSAVE = 1 << 27
+	ecx1AVX     = 1 << 28
+	ecx1F16C    = 1 << 29
+
+	// Leaf 7, EBX
+	ebx7BMI1     = 1 << 3
+	ebx7AVX2     = 1 << 5
+	ebx7BMI2     = 1 << 8
+	ebx7AVX512F  = 1 << 16
+	ebx7AVX512DQ = 1 << 17
+	ebx7AVX512CD = 1 << 28
+	ebx7AVX512BW = 1 << 30
+	ebx7AVX512VL = 1 << 31
+
+	// Leaf 0x80000001, ECX
+	ecxExtLAHF  = 1 << 0
+	ecxExtLZCNT = 1 << 5
+
+	// XCR0 state components enabled by the OS
+	xcr0AVX    = 1<<1 | 1<<2
+	xcr0AVX512 = 1<<5 | 1<<6 | 1<<7
+)
+
+// amd64Level gets the x86-64 microarchitecture level from CPUID and XCR0 register values,
+// as specified in the x86-64 psABI.
+func amd64Level(ecx1, ebx7, ecxExt, xcr0 uint32) string {
+	const (
+		v2ecx1   = ecx1SSE3 | ecx1SSSE3 | ecx1CX16 | ecx1SSE41 | ecx1SSE42 | ecx1POPCNT
+		v2ecxExt = ecxExtLAHF
+		v3ecx1   = ecx1FMA | ecx1MOVBE | ecx1OSXSAVE | ecx1AVX | ecx1F16C
+		v3ebx7   = ebx7BMI1 | ebx7AVX2 | ebx7BMI2
+		v3ecxExt = ecxExtLZCNT
+		v4ebx7   = ebx7AVX512F | ebx7AVX512DQ | ebx7AVX512CD | ebx7AVX512BW | ebx7AVX512VL
+	)
+	has := func(v, bits uint32) bool { return v&bits == bits }
+
+	switch {
+	case !has(ecx1, v2ecx1) || !has(ecxExt, v2ecxExt):
+		return "v1"
+	case !has(ecx1, v3ecx1) || !has(ebx7, v3ebx7) || !has(ecxExt, v3ecxExt) || !has(xcr0, xcr0AVX):
+		return "v2"
+	case !has(ebx7, v4ebx7) || !has(xcr0, xcr0AVX512):
+		return "v3"
+	}
+
+	return "v4"
+}
+
+// armLevel gets the ARM architecture level from /proc/cpuinfo content.
+// Levels above v7, i.e. 64-bit capable CPUs running in 32-bit mode, are reported as v7.
+func armLevel(cpuinfo string) string {
+	sc := bufio.NewScanner(strings.NewReader(cpuinfo))
+	for sc.Scan() {
+		key, value, found := strings.Cut(sc.Text(), ":")
+		if !found || strings.TrimSpace(key) != "CPU architecture" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		// Some kernels report AArch64 for 64-bit capable CPUs
+		if strings.EqualFold(value, "AArch64") {
+			return "v7"
+		}
+		// Older ones may have suffixes, such as 5TEJ
+		digits := strings.TrimRightFunc(value, func(r rune) bool { return r < '0' || r > '9' })
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return ""
+		}
+		if n > 7 {
+			n = 7
+		}
+
+		return "v" + strconv.Itoa(n)
+	}
+
+	return ""
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cpulevel
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+func detect() string {
+	maxLeaf, _, _, _ := cpuid(0, 0)
+	if maxLeaf < 7 {
+		return "v1"
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	_, ebx7, _, _ := cpuid(7, 0)
+	var ecxExt uint32
+	if maxExtLeaf, _, _, _ := cpuid(0x80000000, 0); maxExtLeaf >= 0x80000001 {
+		_, _, ecxExt, _ = cpuid(0x80000001, 0)
+	}
+	var xcr0 uint32
+	if ecx1&ecx1OSXSAVE != 0 {
+		xcr0, _ = xgetbv()
+	}
+
+	return amd64Level(ecx1, ebx7, ecxExt, xcr0)
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package cpulevel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_amd64Level(t *testing.T) {
+	const (
+		v2ecx1 = ecx1SSE3 | ecx1SSSE3 | ecx1CX16 | ecx1SSE41 | ecx1SSE42 | ecx1POPCNT
+		v3ecx1 = v2ecx1 | ecx1FMA | ecx1MOVBE | ecx1OSXSAVE | ecx1AVX | ecx1F16C
+		v3ebx7 = ebx7BMI1 | ebx7AVX2 | ebx7BMI2
+		v4ebx7 = v3ebx7 | ebx7AVX512F | ebx7AVX512DQ | ebx7AVX512CD | ebx7AVX512BW | ebx7AVX512VL
+	)
+	tests := []struct {
+		name                     string
+		ecx1, ebx7, ecxExt, xcr0 uint32
+		want                     string
+	}{
+		{"none", 0, 0, 0, 0, "v1"},
+		{"v2 no lahf", v2ecx1, 0, 0, 0, "v1"},
+		{"v2", v2ecx1, 0, ecxExtLAHF, 0, "v2"},
+		{"v3 no os avx", v3ecx1, v3ebx7, ecxExtLAHF | ecxExtLZCNT, 0, "v2"},
+		{"v3", v3ecx1, v3ebx7, ecxExtLAHF | ecxExtLZCNT, xcr0AVX, "v3"},
+		{"v4 no os avx512", v3ecx1, v4ebx7, ecxExtLAHF | ecxExtLZCNT, xcr0AVX, "v3"},
+		{"v4", v3ecx1, v4ebx7, ecxExtLAHF | ecxExtLZCNT, xcr0AVX | xcr0AVX512, "v4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, amd64Level(tt.ecx1, tt.ebx7, tt.ecxExt, tt.xcr0))
+		})
+	}
+}
+
+func Test_armLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuinfo string
+		want    string
+	}{
+		{"armv6", "processor\t: 0\nmodel name\t: ARMv6-compatible processor rev 7 (v6l)\nCPU architecture: 6\n", "v6"},
+		{"armv7", "processor\t: 0\nCPU architecture: 7\nCPU variant\t: 0x0\n", "v7"},
+		{"armv8 32-bit", "CPU architecture: 8\n", "v7"},
+		{"aarch64", "CPU architecture: AArch64\n", "v7"},
+		{"armv5", "CPU architecture: 5TEJ\n", "v5"},
+		{"unknown", "processor\t: 0\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, armLevel(tt.cpuinfo))
+		})
+	}
+}
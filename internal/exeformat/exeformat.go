@@ -0,0 +1,294 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package exeformat inspects executable file formats.
+package exeformat
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Executable format kinds.
+const (
+	ELF    = "ELF"
+	MachO  = "Mach-O"
+	PE     = "PE"
+	Script = "script"
+)
+
+// Info describes the format of an executable.
+type Info struct {
+	Kind        string   // one of the format kinds, empty if unrecognized
+	OS          string   // Go OS name, empty if not determined by the format
+	Archs       []string // Go arch names, more than one for universal Mach-O binaries, empty if unknown
+	Interpreter string   // script interpreter
+}
+
+func (i Info) String() string {
+	switch i.Kind {
+	case "":
+		return "unrecognized"
+	case Script:
+		return Script + " (" + i.Interpreter + ")"
+	}
+	var sb strings.Builder
+	sb.WriteString(i.Kind)
+	if i.OS != "" {
+		sb.WriteString(" " + i.OS)
+	}
+	if len(i.Archs) != 0 {
+		if i.OS != "" {
+			sb.WriteString("/")
+		} else {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(strings.Join(i.Archs, "+"))
+	}
+
+	return sb.String()
+}
+
+// elfOSs are the Go OSs using ELF executables.
+var elfOSs = []string{"android", "dragonfly", "freebsd", "illumos", "linux", "netbsd", "openbsd", "solaris"}
+
+// Compatible tells if an executable of this format is for goos and goarch.
+// Unrecognized formats, scripts, and unknown archs are considered compatible with everything.
+func (i Info) Compatible(goos, goarch string) bool {
+	switch i.Kind {
+	case ELF:
+		if !slices.Contains(elfOSs, goos) {
+			return false
+		}
+		if i.OS != "" && i.OS != goos && (i.OS != "linux" || goos != "android") && (i.OS != "solaris" || goos != "illumos") {
+			return false
+		}
+	case MachO:
+		if goos != "darwin" && goos != "ios" {
+			return false
+		}
+	case PE:
+		if goos != "windows" {
+			return false
+		}
+	default:
+		return true
+	}
+
+	return len(i.Archs) == 0 || slices.Contains(i.Archs, goarch)
+}
+
+// Inspect inspects the format of the executable at name.
+func Inspect(name string) (Info, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	return InspectReader(f)
+}
+
+// InspectReader inspects the format of the executable in r.
+func InspectReader(r io.ReaderAt) (Info, error) {
+	var magic [4]byte
+	if n, err := r.ReadAt(magic[:], 0); n < 2 {
+		if err == io.EOF {
+			err = nil
+		}
+
+		return Info{}, err
+	}
+	switch {
+	case bytes.HasPrefix(magic[:], []byte(elf.ELFMAG)):
+		return inspectELF(r)
+	case bytes.HasPrefix(magic[:], []byte("MZ")):
+		return inspectPE(r)
+	case bytes.HasPrefix(magic[:], []byte("#!")):
+		return inspectScript(r)
+	}
+	switch be, le := bigEndian(magic), littleEndian(magic); {
+	case be == macho.MagicFat:
+		return inspectFatMachO(r)
+	case be == macho.Magic32, be == macho.Magic64, le == macho.Magic32, le == macho.Magic64:
+		return inspectMachO(r)
+	}
+
+	return Info{}, nil
+}
+
+func bigEndian(b [4]byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func littleEndian(b [4]byte) uint32 {
+	return uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
+}
+
+func inspectELF(r io.ReaderAt) (Info, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Kind: ELF}
+	switch f.OSABI {
+	case elf.ELFOSABI_LINUX:
+		info.OS = "linux"
+	case elf.ELFOSABI_FREEBSD:
+		info.OS = "freebsd"
+	case elf.ELFOSABI_NETBSD:
+		info.OS = "netbsd"
+	case elf.ELFOSABI_OPENBSD:
+		info.OS = "openbsd"
+	case elf.ELFOSABI_SOLARIS:
+		info.OS = "solaris"
+	}
+	is64, isLE := f.Class == elf.ELFCLASS64, f.Data == elf.ELFDATA2LSB
+	var arch string
+	switch f.Machine {
+	case elf.EM_386:
+		arch = "386"
+	case elf.EM_X86_64:
+		arch = "amd64"
+	case elf.EM_ARM:
+		arch = "arm"
+	case elf.EM_AARCH64:
+		arch = "arm64"
+	case elf.EM_LOONGARCH:
+		arch = "loong64"
+	case elf.EM_MIPS:
+		arch = "mips"
+		if is64 {
+			arch += "64"
+		}
+		if isLE {
+			arch += "le"
+		}
+	case elf.EM_PPC64:
+		arch = "ppc64"
+		if isLE {
+			arch += "le"
+		}
+	case elf.EM_RISCV:
+		if is64 {
+			arch = "riscv64"
+		}
+	case elf.EM_S390:
+		arch = "s390x"
+	}
+	if arch != "" {
+		info.Archs = []string{arch}
+	}
+
+	return info, nil
+}
+
+// machOArch gets the Go arch for a Mach-O CPU type, empty if unknown.
+func machOArch(cpu macho.Cpu) string {
+	switch cpu {
+	case macho.Cpu386:
+		return "386"
+	case macho.CpuAmd64:
+		return "amd64"
+	case macho.CpuArm:
+		return "arm"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.CpuPpc64:
+		return "ppc64"
+	}
+
+	return ""
+}
+
+func inspectMachO(r io.ReaderAt) (Info, error) {
+	f, err := macho.NewFile(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Kind: MachO, OS: "darwin"}
+	if arch := machOArch(f.Cpu); arch != "" {
+		info.Archs = []string{arch}
+	}
+
+	return info, nil
+}
+
+func inspectFatMachO(r io.ReaderAt) (Info, error) {
+	f, err := macho.NewFatFile(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Kind: MachO, OS: "darwin"}
+	for _, a := range f.Arches {
+		arch := machOArch(a.Cpu)
+		if arch == "" {
+			// Unknown one may be anything
+			info.Archs = nil
+
+			break
+		}
+		if !slices.Contains(info.Archs, arch) {
+			info.Archs = append(info.Archs, arch)
+		}
+	}
+
+	return info, nil
+}
+
+func inspectPE(r io.ReaderAt) (Info, error) {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{Kind: PE, OS: "windows"}
+	var arch string
+	switch f.Machine {
+	case pe.IMAGE_FILE_MACHINE_I386:
+		arch = "386"
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		arch = "amd64"
+	case pe.IMAGE_FILE_MACHINE_ARMNT:
+		arch = "arm"
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		arch = "arm64"
+	}
+	if arch != "" {
+		info.Archs = []string{arch}
+	}
+
+	return info, nil
+}
+
+func inspectScript(r io.ReaderAt) (Info, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(r, 2, 254)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return Info{}, err
+	}
+	info := Info{Kind: Script}
+	if fields := strings.Fields(line); len(fields) != 0 {
+		info.Interpreter = fields[0]
+	}
+
+	return info, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package exeformat_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/exeformat"
+)
+
+func elfHeader(t *testing.T, class elf.Class, data elf.Data, osABI elf.OSABI, machine elf.Machine) []byte {
+	t.Helper()
+	var order binary.ByteOrder = binary.LittleEndian
+	if data == elf.ELFDATA2MSB {
+		order = binary.BigEndian
+	}
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS], ident[elf.EI_DATA], ident[elf.EI_VERSION], ident[elf.EI_OSABI] = byte(class), byte(data), byte(elf.EV_CURRENT), byte(osABI)
+	var buf bytes.Buffer
+	var hdr any
+	if class == elf.ELFCLASS64 {
+		hdr = elf.Header64{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT), Ehsize: 64}
+	} else {
+		hdr = elf.Header32{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT), Ehsize: 52}
+	}
+	require.NoError(t, binary.Write(&buf, order, hdr))
+
+	return buf.Bytes()
+}
+
+func machOHeader(t *testing.T, cpu macho.Cpu) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, macho.FileHeader{Magic: macho.Magic64, Cpu: cpu, Type: macho.TypeExec}))
+	buf.Write(make([]byte, 4)) // reserved
+
+	return buf.Bytes()
+}
+
+func fatMachO(t *testing.T, cpus ...macho.Cpu) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, [2]uint32{macho.MagicFat, uint32(len(cpus))}))
+	const align = 12
+	for i, cpu := range cpus {
+		require.NoError(t, binary.Write(&buf, binary.BigEndian, macho.FatArchHeader{
+			Cpu: cpu, Offset: uint32(i+1) << align, Size: 32, Align: align,
+		}))
+	}
+	for i, cpu := range cpus {
+		buf.Write(make([]byte, (i+1)<<align-buf.Len()))
+		buf.Write(machOHeader(t, cpu))
+	}
+
+	return buf.Bytes()
+}
+
+func peHeader(t *testing.T, machine uint16) []byte {
+	t.Helper()
+	const peOffset = 0x80
+	b := make([]byte, peOffset)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint32(b[0x3c:], peOffset)
+	buf := bytes.NewBuffer(b)
+	buf.WriteString("PE\x00\x00")
+	require.NoError(t, binary.Write(buf, binary.LittleEndian, pe.FileHeader{Machine: machine}))
+
+	return buf.Bytes()
+}
+
+func TestInspectReader(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want exeformat.Info
+	}{
+		{"empty", nil, exeformat.Info{}},
+		{"text", []byte("hello\n"), exeformat.Info{}},
+		{"script", []byte("#!/usr/bin/env python3\nprint()\n"), exeformat.Info{Kind: exeformat.Script, Interpreter: "/usr/bin/env"}},
+		{"script no newline", []byte("#! /bin/sh"), exeformat.Info{Kind: exeformat.Script, Interpreter: "/bin/sh"}},
+		{
+			"elf linux amd64", elfHeader(t, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.ELFOSABI_NONE, elf.EM_X86_64),
+			exeformat.Info{Kind: exeformat.ELF, Archs: []string{"amd64"}},
+		},
+		{
+			"elf freebsd arm64", elfHeader(t, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.ELFOSABI_FREEBSD, elf.EM_AARCH64),
+			exeformat.Info{Kind: exeformat.ELF, OS: "freebsd", Archs: []string{"arm64"}},
+		},
+		{
+			"elf linux arm", elfHeader(t, elf.ELFCLASS32, elf.ELFDATA2LSB, elf.ELFOSABI_LINUX, elf.EM_ARM),
+			exeformat.Info{Kind: exeformat.ELF, OS: "linux", Archs: []string{"arm"}},
+		},
+		{
+			"elf mips64", elfHeader(t, elf.ELFCLASS64, elf.ELFDATA2MSB, elf.ELFOSABI_NONE, elf.EM_MIPS),
+			exeformat.Info{Kind: exeformat.ELF, Archs: []string{"mips64"}},
+		},
+		{
+			"elf ppc64le", elfHeader(t, elf.ELFCLASS64, elf.ELFDATA2LSB, elf.ELFOSABI_NONE, elf.EM_PPC64),
+			exeformat.Info{Kind: exeformat.ELF, Archs: []string{"ppc64le"}},
+		},
+		{
+			"elf unknown arch", elfHeader(t, elf.ELFCLASS32, elf.ELFDATA2MSB, elf.ELFOSABI_NONE, elf.EM_SPARC),
+			exeformat.Info{Kind: exeformat.ELF},
+		},
+		{"macho arm64", machOHeader(t, macho.CpuArm64), exeformat.Info{Kind: exeformat.MachO, OS: "darwin", Archs: []string{"arm64"}}},
+		{
+			"macho universal", fatMachO(t, macho.CpuAmd64, macho.CpuArm64),
+			exeformat.Info{Kind: exeformat.MachO, OS: "darwin", Archs: []string{"amd64", "arm64"}},
+		},
+		{"pe amd64", peHeader(t, pe.IMAGE_FILE_MACHINE_AMD64), exeformat.Info{Kind: exeformat.PE, OS: "windows", Archs: []string{"amd64"}}},
+		{"pe arm64", peHeader(t, pe.IMAGE_FILE_MACHINE_ARM64), exeformat.Info{Kind: exeformat.PE, OS: "windows", Archs: []string{"arm64"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := exeformat.InspectReader(bytes.NewReader(tt.data))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestInspectReader_invalid(t *testing.T) {
+	_, err := exeformat.InspectReader(bytes.NewReader([]byte("\x7fELF\x02")))
+	assert.Error(t, err)
+}
+
+func TestInspect(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	info, err := exeformat.Inspect(exe)
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.Kind)
+	assert.True(t, info.Compatible(runtime.GOOS, runtime.GOARCH), info.String())
+
+	_, err = exeformat.Inspect(exe + ".nonexistent")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestInfo_Compatible(t *testing.T) {
+	elfAny := exeformat.Info{Kind: exeformat.ELF, Archs: []string{"arm64"}}
+	elfLinux := exeformat.Info{Kind: exeformat.ELF, OS: "linux", Archs: []string{"amd64"}}
+	universal := exeformat.Info{Kind: exeformat.MachO, OS: "darwin", Archs: []string{"amd64", "arm64"}}
+	pe386 := exeformat.Info{Kind: exeformat.PE, OS: "windows", Archs: []string{"386"}}
+	script := exeformat.Info{Kind: exeformat.Script, Interpreter: "/bin/sh"}
+
+	for _, tt := range []struct {
+		info         exeformat.Info
+		goos, goarch string
+		want         bool
+	}{
+		{elfAny, "linux", "arm64", true},
+		{elfAny, "freebsd", "arm64", true},
+		{elfAny, "linux", "amd64", false},
+		{elfAny, "darwin", "arm64", false},
+		{elfLinux, "linux", "amd64", true},
+		{elfLinux, "android", "amd64", true},
+		{elfLinux, "freebsd", "amd64", false},
+		{universal, "darwin", "amd64", true},
+		{universal, "darwin", "arm64", true},
+		{universal, "linux", "arm64", false},
+		{pe386, "windows", "386", true},
+		{pe386, "windows", "amd64", false},
+		{script, "windows", "amd64", true},
+		{exeformat.Info{}, "plan9", "386", true},
+	} {
+		assert.Equal(t, tt.want, tt.info.Compatible(tt.goos, tt.goarch), "%s %s/%s", tt.info, tt.goos, tt.goarch)
+	}
+}
+
+func TestInfo_String(t *testing.T) {
+	for want, info := range map[string]exeformat.Info{
+		"unrecognized":              {},
+		"script (/bin/sh)":          {Kind: exeformat.Script, Interpreter: "/bin/sh"},
+		"ELF arm64":                 {Kind: exeformat.ELF, Archs: []string{"arm64"}},
+		"ELF linux/arm":             {Kind: exeformat.ELF, OS: "linux", Archs: []string{"arm"}},
+		"ELF":                       {Kind: exeformat.ELF},
+		"Mach-O darwin/amd64+arm64": {Kind: exeformat.MachO, OS: "darwin", Archs: []string{"amd64", "arm64"}},
+	} {
+		assert.Equal(t, want, info.String())
+	}
+}
@@ -18,6 +18,7 @@ package files
 
 import (
 	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -30,11 +31,16 @@ import (
 // If an override regular expression matches an asset filename, it will cause the asset to be treated as the preferred one for the OS/arch in the override.
 //
 // The returned osArchPreferred is has OS/arch strings as keys, and the corresponding assets as values.
+// If both GNU and musl libc variants are available for an OS/arch, they are included with the libc as a qualifier,
+// for example linux/amd64/gnu and linux/amd64/musl, in addition to the preferred one for the unqualified OS/arch.
+// Similarly, ARMv6 and ARMv7 variants are included as arm/v6 and arm/v7 if both are available.
+// Assets for x86-64 microarchitecture levels are included only with the level as a qualifier, for example linux/amd64/v3.
 // All given assets are present in at most one of the return values.
 // The only ones that are not in any are ones that apply to an OS/architecture combination, but for which a more preferred one was found.
 func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Regexp) (osArchPreferred map[string]T, checksums, others []T) {
 	// OS and arch parts slices are patterns to match in decreasing order of preference.
-	// For example, we want to match musl linuxes before gnu ones for portability reasons, and similarly armv7 for arm before armv6 etc.
+	// For example, we want to match musl linuxes before gnu ones for portability reasons for unqualified OS/archs,
+	// and similarly armv7 for arm before armv6 etc.
 
 	// This code is expected to run at most once per wrun invocation, so generate regexps inline
 	// instead of on init or such.
@@ -47,6 +53,7 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 		`(?P<arch>i?[36]86|amd64|arm|arm64|loong64|mips|mips64|mips64le|mipsle|p(?:ower)?pc64(?:le)?|riscv64|s390x|wasm|x86_64)`,
 		`(?P<arch>32bit|64bit|aarch64|armv7)`,
 		`(?P<arch>armv6|armv6hf)`,
+		`(?P<arch>(?:amd64|x86_64)[_-]v[1-4])`,
 	}
 	extParts := []string{ // Prefer tarballs over zips, mostly just for stable ordering, possibly also for smaller size at times
 		`\.tar\.[gx]z$`,
@@ -107,6 +114,13 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 						panic("wrun: BUG : unhandled subexpression name: " + name)
 					}
 				}
+				var libc string
+				switch os {
+				case "unknown-linux-gnu", "unknown-linux-gnueabihf":
+					libc = LibcGNU
+				case "unknown-linux-musl", "unknown-linux-musleabihf":
+					libc = LibcMusl
+				}
 				switch os {
 				case "apple-darwin", "macos":
 					os = "darwin"
@@ -115,6 +129,11 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 				case "unknown-linux-gnu", "unknown-linux-gnueabihf", "unknown-linux-musl", "unknown-linux-musleabihf":
 					os = "linux"
 				}
+				var level string
+				levelOnly := false // whether the asset is for the level only, not for all of its arch
+				if i := strings.LastIndexAny(arch, "_-"); i != -1 && strings.HasPrefix(arch[i+1:], "v") {
+					arch, level, levelOnly = arch[:i], arch[i+1:], true
+				}
 				switch arch {
 				case "32bit", "i386", "686", "i686":
 					arch = "386"
@@ -122,16 +141,32 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 					arch = "amd64"
 				case "aarch64":
 					arch = "arm64"
-				case "armv6", "armv6hf", "armv7":
-					arch = "arm"
+				case "armv6", "armv6hf":
+					arch, level = "arm", "v6"
+				case "armv7":
+					arch, level = "arm", "v7"
 				case "powerpc64":
 					arch = "ppc64"
 				case "powerpc64le":
 					arch = "ppc64le"
 				}
-				osArch := os + "/" + arch
-				if _, found := osArchPreferred[osArch]; !found {
-					osArchPreferred[osArch] = fileAssets[name]
+				osArchs := []string{os + "/" + arch}
+				if level != "" {
+					if levelOnly {
+						osArchs = nil
+					}
+					osArchs = append(osArchs, os+"/"+arch+"/"+level)
+				}
+				for _, osArch := range osArchs {
+					keys := []string{osArch}
+					if libc != "" {
+						keys = append(keys, osArch+"/"+libc)
+					}
+					for _, key := range keys {
+						if _, found := osArchPreferred[key]; !found {
+							osArchPreferred[key] = fileAssets[name]
+						}
+					}
 				}
 			} else {
 				unknownFiles = append(unknownFiles, name)
@@ -140,6 +175,9 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 		work = unknownFiles
 	}
 
+	PruneVariants(osArchPreferred, LibcGNU, LibcMusl)
+	PruneVariants(osArchPreferred, "v6", "v7")
+
 	others = make([]T, 0, len(work))
 	for _, name := range work {
 		if checksumsRE.MatchString(name) {
@@ -151,3 +189,37 @@ func Categorize[T any](fileAssets map[string]T, overrides map[string]*regexp.Reg
 
 	return osArchPreferred, checksums, others
 }
+
+// Libc OS/arch qualifiers.
+const (
+	LibcGNU  = "gnu"
+	LibcMusl = "musl"
+)
+
+// PruneVariants removes OS/arch keys qualified with one of the given qualifiers from osArchPreferred,
+// for ones that have only one variant of them, as the less qualified OS/arch is expected to refer to it in that case.
+func PruneVariants[T any](osArchPreferred map[string]T, qualifiers ...string) {
+	variants := make(map[string]int)
+	for osArch := range osArchPreferred {
+		if base, found := cutQualifier(osArch, qualifiers); found {
+			variants[base]++
+		}
+	}
+	for osArch := range osArchPreferred {
+		if base, found := cutQualifier(osArch, qualifiers); found && variants[base] < 2 {
+			delete(osArchPreferred, osArch)
+		}
+	}
+}
+
+// cutQualifier returns osArch without the first of the given qualifiers it has, and whether it had one.
+func cutQualifier(osArch string, qualifiers []string) (string, bool) {
+	parts := strings.Split(osArch, "/")
+	for i := 2; i < len(parts); i++ {
+		if slices.Contains(qualifiers, parts[i]) {
+			return strings.Join(slices.Delete(parts, i, i+1), "/"), true
+		}
+	}
+
+	return osArch, false
+}
@@ -33,27 +33,32 @@ func TestCategorize_Basic(t *testing.T) {
 			path + "example-1.0.0-darwin-arm64.tar.gz":      "darwin-arm64",
 			path + "example-1.0.0-linux-amd64.deb":          "deb",
 			path + "example-1.0.0-linux-x86_64.tar.gz":      "linux-amd64",
-			path + "example-1.0.0-linux-armv6.tar.gz":       "linux-armv6-ignored", // expected ignored, armv7 takes precedence
+			path + "example-1.0.0-linux-armv6.tar.gz":       "linux-armv6",
 			path + "example-1.0.0-linux-armv7.tar.gz":       "linux-armv7",
 			path + "example-1.0.0-windows-amd64.zip":        "windows-amd64",
 			path + "example-1.0.0-windows-amd64.zip.sha256": "windows-amd64-sha256",
 			path + "example-foo.zip":                        "override-foo",
 			path + "example.linux.loong64.tar.xz":           "linux-loong64",
 			path + "example-aarch64-unknown-linux-musl.zip": "linux-arm64",
-			path + "example-aarch64-unknown-linux-gnu.zip":  "linux-arm64-ignored", // expected ignored, musl takes precedence
+			path + "example-aarch64-unknown-linux-gnu.zip":  "linux-arm64-gnu",
+			path + "example-x86_64-unknown-linux-musl.zip":  "linux-amd64-musl-ignored", // expected ignored, linux-amd64 takes precedence
 			path + "example-other.tar.bz2":                  "example-other",
 		}
 		overrides := map[string]*regexp.Regexp{
 			"linux/s390x": regexp.MustCompile(`-foo\.zip$`),
 		}
 		expectedPreferred := map[string]string{
-			"darwin/arm64":  "darwin-arm64",
-			"linux/amd64":   "linux-amd64",
-			"linux/arm":     "linux-armv7",
-			"linux/arm64":   "linux-arm64",
-			"linux/loong64": "linux-loong64",
-			"linux/s390x":   "override-foo",
-			"windows/amd64": "windows-amd64",
+			"darwin/arm64":     "darwin-arm64",
+			"linux/amd64":      "linux-amd64",
+			"linux/arm":        "linux-armv7",
+			"linux/arm/v6":     "linux-armv6",
+			"linux/arm/v7":     "linux-armv7",
+			"linux/arm64":      "linux-arm64",
+			"linux/arm64/gnu":  "linux-arm64-gnu",
+			"linux/arm64/musl": "linux-arm64",
+			"linux/loong64":    "linux-loong64",
+			"linux/s390x":      "override-foo",
+			"windows/amd64":    "windows-amd64",
 		}
 		expectedSums := []string{
 			"checksums",
@@ -105,3 +110,28 @@ func TestCategorize_NonArchive(t *testing.T) {
 		assert.ElementsMatch(t, expectedOthers, others, "other assets")
 	}
 }
+
+func TestCategorize_Levels(t *testing.T) {
+	fileAssets := map[string]string{
+		"tool_linux_amd64.tar.gz":    "linux-amd64",
+		"tool_linux_amd64_v3.tar.gz": "linux-amd64-v3",
+		"tool_linux_x86_64-v4.zip":   "linux-amd64-v4",
+		"tool_linux_armv6.tar.gz":    "linux-armv6",
+		"tool_linux_armv7.tar.gz":    "linux-armv7",
+		"tool_darwin_armv7.tar.gz":   "darwin-armv7",
+	}
+	expectedPreferred := map[string]string{
+		"darwin/arm":     "darwin-armv7",
+		"linux/amd64":    "linux-amd64",
+		"linux/amd64/v3": "linux-amd64-v3",
+		"linux/amd64/v4": "linux-amd64-v4",
+		"linux/arm":      "linux-armv7",
+		"linux/arm/v6":   "linux-armv6",
+		"linux/arm/v7":   "linux-armv7",
+	}
+
+	preferred, sums, others := files.Categorize(fileAssets, nil)
+	assert.Equal(t, expectedPreferred, preferred, "preferred assets")
+	assert.Empty(t, sums, "checksum assets")
+	assert.Empty(t, others, "other assets")
+}
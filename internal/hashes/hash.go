@@ -45,6 +45,14 @@ var hashesByName = map[string]crypto.Hash{
 	HashName(crypto.BLAKE2b_512): crypto.BLAKE2b_512,
 }
 
+// Approximate collision resistance of hashes in bits.
+// For broken ones, this is the best known attack complexity rather than half the digest size.
+var hashStrengths = map[crypto.Hash]int{
+	crypto.MD4:  2,
+	crypto.MD5:  18,
+	crypto.SHA1: 63,
+}
+
 func HashName(h crypto.Hash) string {
 	hn := h.String()
 	hn = strings.ToLower(hn)
@@ -67,6 +75,19 @@ func HashByName(name string) (crypto.Hash, error) {
 	return hashType, nil
 }
 
+// Strength returns the approximate collision resistance of h in bits.
+// It can be used to compare hashes against each other, 0 is returned for unknown ones.
+func Strength(h crypto.Hash) int {
+	if s, found := hashStrengths[h]; found {
+		return s
+	}
+	if _, found := hashesByName[HashName(h)]; !found {
+		return 0
+	}
+
+	return h.Size() * 8 / 2 // birthday bound
+}
+
 // ParseHashFragment prepares a hash corresponding to the given URL fragment string.
 // It returns the hash and the digest to check with it.
 // If s is empty, 0 is returned as the hash.
@@ -0,0 +1,116 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/scop/wrun/internal/hashes"
+)
+
+var (
+	ErrDigestRequired = errors.New("download digest required")
+	ErrInsecureScheme = errors.New("insecure URL scheme")
+	ErrHostNotAllowed = errors.New("host not allowed")
+	ErrWeakHash       = errors.New("digest algorithm too weak")
+)
+
+// Policy contains download restrictions.
+// The zero value allows everything.
+type Policy struct {
+	// RequireDigest requires URLs to have a digest fragment.
+	RequireDigest bool
+	// HTTPSOnly rejects schemes other than https, also on redirects.
+	// oci is allowed, because registries are accessed using https.
+	HTTPSOnly bool
+	// AllowedHosts are host name globs downloads are allowed from, also on redirects.
+	// If empty, all hosts are allowed.
+	AllowedHosts []string
+	// MinHash is the weakest allowed digest algorithm.
+	// If 0, all supported ones are allowed.
+	MinHash crypto.Hash
+}
+
+// IsViolation tells whether err is caused by a policy violation.
+func IsViolation(err error) bool {
+	return errors.Is(err, ErrDigestRequired) ||
+		errors.Is(err, ErrInsecureScheme) ||
+		errors.Is(err, ErrHostNotAllowed) ||
+		errors.Is(err, ErrWeakHash)
+}
+
+// CheckURL checks u against the policy before download.
+// Scheme and host checks do not apply to local paths, i.e. file URLs and ones with neither scheme nor host.
+func (p Policy) CheckURL(u *url.URL) error {
+	if p.RequireDigest && u.Fragment == "" {
+		return fmt.Errorf("%w: %s", ErrDigestRequired, u.Redacted())
+	}
+	if !strings.EqualFold(u.Scheme, "file") && (u.Scheme != "" || u.Host != "") {
+		if err := p.CheckLocation(u); err != nil {
+			return err
+		}
+	}
+	if p.MinHash != 0 && u.Fragment != "" {
+		h, _, err := hashes.ParseHashFragment(u.Fragment)
+		if err != nil {
+			return err
+		}
+		if hashes.Strength(h) < hashes.Strength(p.MinHash) {
+			return fmt.Errorf("%w: %s, minimum is %s", ErrWeakHash, hashes.HashName(h), hashes.HashName(p.MinHash))
+		}
+	}
+
+	return nil
+}
+
+// CheckRedirect is usable as http.Client.CheckRedirect, checks redirect targets against the policy.
+func (p Policy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	const maxRedirects = 10 // Same as net/http default
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	return p.CheckLocation(req.URL)
+}
+
+// CheckLocation checks u's scheme and host against the policy.
+// It is for URLs accessed on the way to downloads, such as redirect targets and token endpoints.
+func (p Policy) CheckLocation(u *url.URL) error {
+	if p.HTTPSOnly && !strings.EqualFold(u.Scheme, "https") && !strings.EqualFold(u.Scheme, "oci") {
+		return fmt.Errorf("%w: %q in %s", ErrInsecureScheme, u.Scheme, u.Redacted())
+	}
+	if len(p.AllowedHosts) != 0 {
+		host := strings.ToLower(u.Hostname())
+		for _, pattern := range p.AllowedHosts {
+			if match, err := path.Match(strings.ToLower(pattern), host); err != nil {
+				return fmt.Errorf("allowed host %q: %w", pattern, err)
+			} else if match {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%w: %q in %s", ErrHostNotAllowed, host, u.Redacted())
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Ville Skyttä
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy_test
+
+import (
+	"crypto"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scop/wrun/internal/policy"
+)
+
+const sha256Fragment = "#sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestPolicy_CheckURL(t *testing.T) {
+	pol := policy.Policy{
+		RequireDigest: true,
+		HTTPSOnly:     true,
+		AllowedHosts:  []string{"example.com", "*.example.org"},
+		MinHash:       crypto.SHA256,
+	}
+	tests := []struct {
+		url     string
+		wantErr error
+	}{
+		{"https://example.com/file" + sha256Fragment, nil},
+		{"https://EXAMPLE.com:8443/file" + sha256Fragment, nil},
+		{"https://dl.example.org/file" + sha256Fragment, nil},
+		{"https://example.com/file#sha512-" + "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e", nil},
+		{"https://example.com/file", policy.ErrDigestRequired},
+		{"http://example.com/file" + sha256Fragment, policy.ErrInsecureScheme},
+		{"https://example.org/file" + sha256Fragment, policy.ErrHostNotAllowed},
+		{"https://example.net/file" + sha256Fragment, policy.ErrHostNotAllowed},
+		{"https://example.com/file#md5-7d793037a0760186574b0282f2f435e7", policy.ErrWeakHash},
+		{"https://example.com/file#sha1-aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", policy.ErrWeakHash},
+		{"/vendor/file" + sha256Fragment, nil},
+		{"/vendor/file", policy.ErrDigestRequired},
+		{"/vendor/file#md5-7d793037a0760186574b0282f2f435e7", policy.ErrWeakHash},
+		{"file:///vendor/file" + sha256Fragment, nil},
+		{"file:///vendor/file", policy.ErrDigestRequired},
+		{"oci://example.com/tool@sha256:00" + sha256Fragment, nil},
+		{"oci://example.net/tool@sha256:00" + sha256Fragment, policy.ErrHostNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			err = pol.CheckURL(u)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.wantErr)
+				assert.True(t, policy.IsViolation(err))
+			}
+		})
+	}
+}
+
+func TestPolicy_CheckURL_Zero(t *testing.T) {
+	u, err := url.Parse("http://example.com/file#md5-7d793037a0760186574b0282f2f435e7")
+	require.NoError(t, err)
+	require.NoError(t, policy.Policy{}.CheckURL(u))
+}
+
+func TestPolicy_CheckRedirect(t *testing.T) {
+	pol := policy.Policy{
+		HTTPSOnly:    true,
+		AllowedHosts: []string{"github.com", "objects.githubusercontent.com"},
+	}
+	via := []*http.Request{{URL: &url.URL{Scheme: "https", Host: "github.com"}}}
+	tests := []struct {
+		url     string
+		wantErr error
+	}{
+		{"https://objects.githubusercontent.com/file", nil},
+		{"http://objects.githubusercontent.com/file", policy.ErrInsecureScheme},
+		{"https://evil.example.com/file", policy.ErrHostNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			err = pol.CheckRedirect(&http.Request{URL: u}, via)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
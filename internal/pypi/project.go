@@ -26,6 +26,8 @@ import (
 	"strings"
 
 	pep440 "github.com/aquasecurity/go-pep440-version"
+
+	"github.com/scop/wrun/internal/files"
 )
 
 // https://packaging.python.org/en/latest/specifications/simple-repository-api/#json-based-simple-api-for-python-package-indexes
@@ -209,15 +211,24 @@ func (p SimpleProject) ValidVersions() []pep440.Version {
 
 var osArchPlatformTags = []map[string]string{
 	{
-		"darwin/amd64":  "macosx_*_x86_64",
-		"darwin/arm64":  "macosx_*_arm64",
-		"linux/386":     "musllinux_*_i686",
-		"linux/amd64":   "musllinux_*_x86_64",
-		"linux/arm":     "musllinux_*_armv7l",
-		"linux/arm64":   "musllinux_*_aarch64",
-		"windows/386":   "win32",
-		"windows/amd64": "win_amd64",
-		"windows/arm64": "win_arm64",
+		"darwin/amd64":     "macosx_*_x86_64",
+		"darwin/arm64":     "macosx_*_arm64",
+		"linux/386":        "musllinux_*_i686",
+		"linux/amd64":      "musllinux_*_x86_64",
+		"linux/arm":        "musllinux_*_armv7l",
+		"linux/arm64":      "musllinux_*_aarch64",
+		"linux/386/musl":   "musllinux_*_i686",
+		"linux/amd64/musl": "musllinux_*_x86_64",
+		"linux/arm/musl":   "musllinux_*_armv7l",
+		"linux/arm64/musl": "musllinux_*_aarch64",
+		"linux/386/gnu":    "manylinux*_i686",
+		"linux/amd64/gnu":  "manylinux*_x86_64",
+		"linux/arm/gnu":    "manylinux*_armv7l",
+		"linux/arm64/gnu":  "manylinux*_aarch64",
+		"linux/arm/v7":     "musllinux_*_armv7l",
+		"windows/386":      "win32",
+		"windows/amd64":    "win_amd64",
+		"windows/arm64":    "win_arm64",
 	},
 	{
 		"darwin/amd64":  "macosx_*_universal2",
@@ -225,25 +236,32 @@ var osArchPlatformTags = []map[string]string{
 		"linux/386":     "manylinux*_i686",
 		"linux/amd64":   "manylinux*_x86_64",
 		"linux/arm":     "manylinux*_armv7l",
+		"linux/arm/v7":  "manylinux*_armv7l",
 		"linux/arm64":   "manylinux*_aarch64",
 		"linux/ppc64":   "manylinux*_ppc64",
 		"linux/ppc64le": "manylinux*_ppc64le",
 		"linux/s390x":   "manylinux*_s390x",
 	},
 	{
-		"linux/arm": "linux_armv6l",
+		"linux/arm":    "linux_armv6l",
+		"linux/arm/v6": "linux_armv6l",
 	},
 }
 
 func (p SimpleProject) PreferredOsArchSimpleFiles(version string) (osArchPreferred map[string]SimpleFile, others []SimpleFile) {
 	osArchPreferred = make(map[string]SimpleFile, len(p.Files))
+	var candidates []SimpleFile
 	for _, file := range p.Files {
 		if !file.Filename.Info.IsBinaryDistribution || file.Yanked != "" || file.Filename.Info.Version.String() != version {
 			continue
 		}
+		candidates = append(candidates, file)
+	}
 
-		gotMatch := false
-		for _, oapt := range osArchPlatformTags {
+	// Process tiers in the outer loop so that preference order is independent of the order of files
+	gotMatch := make([]bool, len(candidates))
+	for _, oapt := range osArchPlatformTags {
+		for i, file := range candidates {
 			for osArch, pattern := range oapt {
 				for _, pt := range file.Filename.Info.PlatformTags {
 					// Try match first before existing osArch lookup for proper tracking of others
@@ -251,15 +269,19 @@ func (p SimpleProject) PreferredOsArchSimpleFiles(version string) (osArchPreferr
 						if _, found := osArchPreferred[osArch]; !found {
 							osArchPreferred[osArch] = file
 						}
-						gotMatch = true
+						gotMatch[i] = true
 					}
 				}
 			}
 		}
-		if !gotMatch {
+	}
+	for i, file := range candidates {
+		if !gotMatch[i] {
 			others = append(others, file)
 		}
 	}
+	files.PruneVariants(osArchPreferred, files.LibcGNU, files.LibcMusl)
+	files.PruneVariants(osArchPreferred, "v6", "v7")
 
 	return osArchPreferred, others
 }
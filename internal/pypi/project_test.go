@@ -142,26 +142,25 @@ func TestPreferredOsArchSimpleFiles(t *testing.T) {
 	}
 	version := "1.1.1"
 	expectedPreferred := map[string]pypi.SimpleFile{
-		"darwin/amd64":  {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-macosx_10_9_universal2.whl", p.Name, version))},
-		"darwin/arm64":  {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-macosx_10_9_universal2.whl", p.Name, version))},
-		"linux/386":     {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_i686.manylinux2014_i686.whl", p.Name, version))},
-		"linux/amd64":   {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_x86_64.whl", p.Name, version))},
-		"linux/arm64":   {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_aarch64.whl", p.Name, version))},
-		"windows/386":   {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-win32.whl", p.Name, version))},
-		"windows/amd64": {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-win_amd64.whl", p.Name, version))},
-	}
-	expectedIgnored := []pypi.SimpleFile{
-		{Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_aarch64.manylinux2014_aarch64.whl", p.Name, version))},
-		{Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_x86_64.manylinux2014_x86_64.whl", p.Name, version))},
+		"darwin/amd64":     {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-macosx_10_9_universal2.whl", p.Name, version))},
+		"darwin/arm64":     {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-macosx_10_9_universal2.whl", p.Name, version))},
+		"linux/386":        {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_i686.manylinux2014_i686.whl", p.Name, version))},
+		"linux/amd64":      {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_x86_64.whl", p.Name, version))},
+		"linux/amd64/gnu":  {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_x86_64.manylinux2014_x86_64.whl", p.Name, version))},
+		"linux/amd64/musl": {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_x86_64.whl", p.Name, version))},
+		"linux/arm64":      {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_aarch64.whl", p.Name, version))},
+		"linux/arm64/gnu":  {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-manylinux_2_17_aarch64.manylinux2014_aarch64.whl", p.Name, version))},
+		"linux/arm64/musl": {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-musllinux_1_2_aarch64.whl", p.Name, version))},
+		"windows/386":      {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-win32.whl", p.Name, version))},
+		"windows/amd64":    {Filename: pypi.NewFilename(fmt.Sprintf("%s-%s-py3-none-win_amd64.whl", p.Name, version))},
 	}
 
 	for _, sf := range expectedPreferred {
 		p.Files = append(p.Files, sf)
 	}
-	p.Files = append(p.Files, expectedIgnored...)
 
 	osArchPreferred, others := p.PreferredOsArchSimpleFiles(version)
 
 	assert.Equal(t, expectedPreferred, osArchPreferred)
-	assert.Empty(t, others) // expectedIgnored NOT to be included here, but silently skipped
+	assert.Empty(t, others)
 }